@@ -0,0 +1,442 @@
+package smtpserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc8617
+
+const (
+	ARCNone      = "none"
+	ARCPass      = "pass"
+	ARCFail      = "fail"
+	ARCTempError = "temperror"
+)
+
+// ARCMaxInstances is the highest instance number of an ARC set.
+const ARCMaxInstances = 50
+
+// ARCResult is the outcome of the validation of the ARC chain of a message.
+type ARCResult struct {
+	Result     string
+	Instance   int // highest instance of the chain
+	OldestPass int // lowest instance from which all the message signatures verify
+	Domains    []string
+	Err        error
+}
+
+// ARCSet is the three header fields of an instance of the chain.
+type ARCSet struct {
+	AuthenticationResults *MessageHeader
+	MessageSignature      *MessageHeader
+	Seal                  *MessageHeader
+}
+
+// ARC validates the ARC chains of the received messages and, if Key is
+// set, adds our ARC set to them. The chain is validated before the DMARC
+// evaluation and sealed with the Authentication-Results of the session, so
+// the filters are meant to be registered around the others:
+//
+//	s.AddFilter("DATA", verifier.Filter(&s.Smtp))
+//	s.AddFilter("DATA", arc.Filter(&s.Smtp))
+//	s.AddFilter("DATA", dmarc.Filter(&s.Smtp))
+//	s.AddFilter("DATA", results.Filter(&s.Smtp))
+//	s.AddFilter("DATA", arc.SealFilter(&s.Smtp))
+type ARC struct {
+	Resolver   Resolver // default DefaultResolver
+	Key        *DKIMKey // sealing key, nil to only validate
+	Headers    []string // fields signed by our message signatures (default DefaultDKIMHeaders)
+	AuthServID string   // authserv-id of our ARC-Authentication-Results (default the hostname)
+}
+
+// ARCInstance returns the i= tag leading the value of an
+// ARC-Authentication-Results header field.
+func ARCInstance(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[:i]
+	}
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) != "i" {
+		return 0, fmt.Errorf("missing i= tag")
+	}
+	return arcInstance(kv[1])
+}
+
+// ARCSignatureInstance returns the i= tag of an ARC-Message-Signature or
+// ARC-Seal header field, which are tag lists in any order.
+func ARCSignatureInstance(value string) (int, error) {
+	tags, err := ParseTagList(value)
+	if err != nil {
+		return 0, err
+	}
+	i, ok := tags["i"]
+	if ok == false {
+		return 0, fmt.Errorf("missing i= tag")
+	}
+	return arcInstance(i)
+}
+
+func arcInstance(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 1 || n > ARCMaxInstances {
+		return 0, fmt.Errorf("invalid instance %q", strings.TrimSpace(value))
+	}
+	return n, nil
+}
+
+// arcTemporaryError is a failure to get the key of a signature, which
+// makes the validation a temperror.
+type arcTemporaryError struct {
+	error
+}
+
+// ARCSets returns the ARC sets of a message by instance. A header field
+// without a valid instance, or appearing twice for an instance, is an
+// error.
+func ARCSets(m *Message) (map[int]*ARCSet, error) {
+	sets := make(map[int]*ARCSet)
+	for _, h := range m.Headers {
+		var field **MessageHeader
+		name := strings.ToLower(h.Name)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+
+		instance := ARCSignatureInstance
+		if name == "arc-authentication-results" {
+			instance = ARCInstance
+		}
+		n, err := instance(h.Value())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", h.Name, err)
+		}
+		set, ok := sets[n]
+		if ok == false {
+			set = &ARCSet{}
+			sets[n] = set
+		}
+		switch name {
+		case "arc-authentication-results":
+			field = &set.AuthenticationResults
+		case "arc-message-signature":
+			field = &set.MessageSignature
+		case "arc-seal":
+			field = &set.Seal
+		}
+		if *field != nil {
+			return nil, fmt.Errorf("several %s for instance %d", h.Name, n)
+		}
+		*field = h
+	}
+	return sets, nil
+}
+
+func (a *ARC) resolver() Resolver {
+	if a.Resolver == nil {
+		return DefaultResolver
+	}
+	return a.Resolver
+}
+
+// verifyHash checks the b= tag of an ARC signature against a hash.
+func (a *ARC) verifyHash(tags TagList, hash []byte) error {
+	algorithm := tags["a"]
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	key, temporary, err := LookupDKIMKey(a.resolver(), tags["s"], strings.ToLower(tags["d"]))
+	if temporary {
+		return arcTemporaryError{err}
+	}
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(StripWSP(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("malformed b= tag")
+	}
+	return key.VerifyHash(algorithm, hash, signature)
+}
+
+// VerifyMessageSignature verifies an ARC-Message-Signature header field.
+func (a *ARC) VerifyMessageSignature(m *Message, header *MessageHeader) error {
+	tags, err := ParseTagList(header.Value())
+	if err != nil {
+		return err
+	}
+	for _, required := range []string{"i", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; ok == false {
+			return fmt.Errorf("missing %s= tag", required)
+		}
+	}
+
+	names := strings.Split(tags["h"], ":")
+	for _, name := range names {
+		if strings.EqualFold(strings.TrimSpace(name), "arc-seal") {
+			return fmt.Errorf("ARC-Seal field signed")
+		}
+	}
+
+	headerCanon, bodyCanon, err := ParseCanonicalization(tags["c"])
+	if err != nil {
+		return err
+	}
+	bodyHash, err := BodyHash(m.Body, bodyCanon, -1)
+	if err != nil {
+		return err
+	}
+	if bodyHash != StripWSP(tags["bh"]) {
+		return fmt.Errorf("body hash did not verify")
+	}
+
+	hash := HeaderHash(SelectHeaders(m, names), StripSignature(header.Raw), headerCanon)
+	return a.verifyHash(tags, hash)
+}
+
+// sealHeaders returns the header fields covered by the seal of an
+// instance, its own ARC-Seal excepted.
+func sealHeaders(sets map[int]*ARCSet, instance int) []*MessageHeader {
+	var headers []*MessageHeader
+	for i := 1; i <= instance; i++ {
+		headers = append(headers, sets[i].AuthenticationResults, sets[i].MessageSignature)
+		if i < instance {
+			headers = append(headers, sets[i].Seal)
+		}
+	}
+	return headers
+}
+
+// VerifySeal verifies the ARC-Seal header field of an instance.
+func (a *ARC) VerifySeal(sets map[int]*ARCSet, instance int) error {
+	tags, err := ParseTagList(sets[instance].Seal.Value())
+	if err != nil {
+		return err
+	}
+	for _, required := range []string{"i", "a", "b", "cv", "d", "s"} {
+		if _, ok := tags[required]; ok == false {
+			return fmt.Errorf("missing %s= tag", required)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return fmt.Errorf("h= tag in ARC-Seal")
+	}
+
+	hash := HeaderHash(sealHeaders(sets, instance), StripSignature(sets[instance].Seal.Raw), "relaxed")
+	return a.verifyHash(tags, hash)
+}
+
+// chainValidation returns the cv= tag of the seal of an instance.
+func chainValidation(set *ARCSet) string {
+	tags, err := ParseTagList(set.Seal.Value())
+	if err != nil {
+		return ""
+	}
+	return tags["cv"]
+}
+
+// Validate validates the ARC chain of a message.
+func (a *ARC) Validate(data string) *ARCResult {
+	m := ParseMessage(data)
+	result := &ARCResult{Result: ARCNone}
+	fail := func(format string, args ...interface{}) *ARCResult {
+		result.Result = ARCFail
+		result.Err = fmt.Errorf(format, args...)
+		for _, arg := range args {
+			if _, ok := arg.(arcTemporaryError); ok {
+				result.Result = ARCTempError
+			}
+		}
+		return result
+	}
+
+	sets, err := ARCSets(m)
+	if err != nil {
+		return fail("%v", err)
+	}
+	if len(sets) == 0 {
+		return result
+	}
+
+	instances := make([]int, 0, len(sets))
+	for i := range sets {
+		instances = append(instances, i)
+	}
+	sort.Ints(instances)
+	n := instances[len(instances)-1]
+	result.Instance = n
+
+	for i := 1; i <= n; i++ {
+		set, ok := sets[i]
+		if ok == false || set.AuthenticationResults == nil || set.MessageSignature == nil || set.Seal == nil {
+			return fail("incomplete ARC set %d", i)
+		}
+		if tags, err := ParseTagList(set.Seal.Value()); err == nil {
+			result.Domains = append(result.Domains, strings.ToLower(tags["d"]))
+		}
+	}
+
+	if cv := chainValidation(sets[n]); cv == ARCFail {
+		return fail("chain failed at instance %d", n)
+	}
+	for i := 1; i <= n; i++ {
+		cv := chainValidation(sets[i])
+		if (i == 1 && cv != ARCNone) || (i > 1 && cv != ARCPass) {
+			return fail("unexpected cv=%s at instance %d", cv, i)
+		}
+	}
+
+	if err := a.VerifyMessageSignature(m, sets[n].MessageSignature); err != nil {
+		return fail("message signature %d: %v", n, err)
+	}
+	result.OldestPass = n
+	for i := n - 1; i >= 1; i-- {
+		err := a.VerifyMessageSignature(m, sets[i].MessageSignature)
+		if _, ok := err.(arcTemporaryError); ok {
+			return fail("message signature %d: %v", i, err)
+		}
+		if err != nil {
+			break
+		}
+		result.OldestPass = i
+	}
+
+	for i := n; i >= 1; i-- {
+		if err := a.VerifySeal(sets, i); err != nil {
+			return fail("seal %d: %v", i, err)
+		}
+	}
+
+	result.Result = ARCPass
+	return result
+}
+
+// Seal adds our ARC set to a message. chain is the validation of the
+// message, results the payload of our ARC-Authentication-Results: the
+// authserv-id and the results. A chain which already failed, is full, or
+// couldn't be validated yet isn't sealed again and the message is returned
+// unchanged.
+func (a *ARC) Seal(data string, chain *ARCResult, results string) (string, error) {
+	if a.Key == nil {
+		return "", fmt.Errorf("no ARC sealing key")
+	}
+	m := ParseMessage(data)
+	sets, err := ARCSets(m)
+	if err != nil {
+		sets = nil
+	}
+
+	instance := chain.Instance + 1
+	if instance > ARCMaxInstances || chain.Result == ARCTempError {
+		return data, nil
+	}
+	if set, ok := sets[chain.Instance]; ok && set.Seal != nil && chainValidation(set) == ARCFail {
+		return data, nil
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	i := "i=" + strconv.Itoa(instance)
+
+	aar := &MessageHeader{
+		Name: "ARC-Authentication-Results",
+		Raw:  "ARC-Authentication-Results: " + i + "; " + results + "\r\n",
+	}
+
+	bodyHash, err := BodyHash(m.Body, "relaxed", -1)
+	if err != nil {
+		return "", err
+	}
+	names := (&DKIMSigner{Headers: a.Headers}).SignedHeaders(m)
+	tags := []string{
+		i,
+		"a=" + a.Key.Algorithm(),
+		"c=relaxed/relaxed",
+		"d=" + a.Key.Domain,
+		"s=" + a.Key.Selector,
+		"t=" + now,
+		"h=" + strings.Join(names, ":"),
+		"bh=" + bodyHash,
+	}
+	unsigned := "ARC-Message-Signature: " + strings.Join(tags, ";\r\n\t") + ";\r\n\tb="
+	signature, err := SignHash(a.Key.Signer, HeaderHash(SelectHeaders(m, names), unsigned, "relaxed"))
+	if err != nil {
+		return "", err
+	}
+	ams := &MessageHeader{
+		Name: "ARC-Message-Signature",
+		Raw:  unsigned + FoldBase64(base64.StdEncoding.EncodeToString(signature)) + "\r\n",
+	}
+
+	cv := chain.Result
+	if instance > 1 && cv == ARCNone {
+		cv = ARCFail
+	}
+	tags = []string{
+		i,
+		"a=" + a.Key.Algorithm(),
+		"cv=" + cv,
+		"d=" + a.Key.Domain,
+		"s=" + a.Key.Selector,
+		"t=" + now,
+	}
+	unsigned = "ARC-Seal: " + strings.Join(tags, ";\r\n\t") + ";\r\n\tb="
+	if sets == nil {
+		sets = make(map[int]*ARCSet)
+	}
+	sets[instance] = &ARCSet{AuthenticationResults: aar, MessageSignature: ams}
+	var headers []*MessageHeader
+	if cv != ARCFail {
+		headers = sealHeaders(sets, instance)
+	} else {
+		// a failed chain may be broken, only our own set is covered
+		headers = []*MessageHeader{aar, ams}
+	}
+	signature, err = SignHash(a.Key.Signer, HeaderHash(headers, unsigned, "relaxed"))
+	if err != nil {
+		return "", err
+	}
+	seal := &MessageHeader{
+		Name: "ARC-Seal",
+		Raw:  unsigned + FoldBase64(base64.StdEncoding.EncodeToString(signature)) + "\r\n",
+	}
+
+	m.Headers = append([]*MessageHeader{seal, ams, aar}, m.Headers...)
+	return m.String(), nil
+}
+
+// Filter returns a DATA filter validating the chain of the message. The
+// outcome is kept in ARC for the callbacks and Authentication-Results.
+func (a *ARC) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		s.ARC = a.Validate(args[0])
+		return nil
+	}
+}
+
+// SealFilter returns a DATA filter adding our ARC set to the message, with
+// the Authentication-Results of the session. Sealing errors reject the
+// message temporarily.
+func (a *ARC) SealFilter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		if a.Key == nil {
+			return nil
+		}
+		chain := s.ARC
+		if chain == nil {
+			chain = a.Validate(args[0])
+		}
+
+		results := (&AuthenticationResults{AuthServID: a.AuthServID}).Value(s)
+		sealed, err := a.Seal(args[0], chain, results)
+		if err != nil {
+			return &Reply{0, 451, "4.3.0 Temporary failure while sealing the message"}
+		}
+		args[0] = sealed
+		return nil
+	}
+}
@@ -0,0 +1,138 @@
+package smtpserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestARC(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	resolver := &FakeResolver{TXT: map[string][]string{
+		"list._domainkey.lists.example.org":  []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"arc._domainkey.forward.example.net": []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+	list := &ARC{Resolver: resolver, Key: &DKIMKey{Domain: "lists.example.org", Selector: "list", Signer: rsaKey}}
+	forward := &ARC{Resolver: resolver, Key: &DKIMKey{Domain: "forward.example.net", Selector: "arc", Signer: edKey}}
+
+	message := "From: joe@example.com\r\nTo: list@lists.example.org\r\nSubject: Hi\r\n\r\nHello.\r\n"
+	if result := list.Validate(message); result.Result != ARCNone {
+		t.Errorf("Unexpected chain: %+v", result)
+	}
+
+	sealed, err := list.Seal(message, list.Validate(message), "lists.example.org; spf=pass smtp.mailfrom=example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(sealed, "ARC-Seal: i=1;\r\n\ta=rsa-sha256;\r\n\tcv=none;") == false {
+		t.Error("Wrong seal: " + sealed)
+	}
+	if result := forward.Validate(sealed); result.Result != ARCPass || result.Instance != 1 {
+		t.Errorf("Chain not validated: %+v", result)
+	}
+
+	// the list modifies the subject of the message before forwarding it
+	modified := strings.Replace(sealed, "Subject: Hi", "Subject: [list] Hi", 1)
+	if result := forward.Validate(modified); result.Result != ARCFail {
+		t.Errorf("Modified message validated: %+v", result)
+	}
+
+	sealed2, err := forward.Seal(sealed, forward.Validate(sealed), "forward.example.net; arc=pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := list.Validate(sealed2)
+	if result.Result != ARCPass || result.Instance != 2 || result.OldestPass != 1 {
+		t.Errorf("Chain not validated: %+v", result)
+	}
+	if len(result.Domains) != 2 || result.Domains[1] != "forward.example.net" {
+		t.Errorf("Wrong domains: %v", result.Domains)
+	}
+
+	// a seal of the chain is altered
+	broken := strings.Replace(sealed2, "ARC-Authentication-Results: i=1; lists.example.org", "ARC-Authentication-Results: i=1; evil.example.com", 1)
+	if result := list.Validate(broken); result.Result != ARCFail || strings.Contains(result.Err.Error(), "seal") == false {
+		t.Errorf("Altered chain validated: %+v", result)
+	}
+
+	// the chain failed: it is sealed once with cv=fail, then no more
+	failed, err := forward.Seal(modified, forward.Validate(modified), "forward.example.net; arc=fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(failed, "cv=fail") == false {
+		t.Error("Failed chain not sealed: " + failed)
+	}
+	if again, _ := list.Seal(failed, list.Validate(failed), "lists.example.org; arc=fail"); again != failed {
+		t.Error("Failed chain sealed again")
+	}
+
+	if result := list.Validate("ARC-Seal: i=1; cv=none\r\n\r\n"); result.Result != ARCFail {
+		t.Errorf("Incomplete set validated: %+v", result)
+	}
+
+	// the key of a signature can't be looked up for now
+	resolver.Errors = map[string]error{
+		"arc._domainkey.forward.example.net": &net.DNSError{Err: "server misbehaving", Name: "arc._domainkey.forward.example.net", IsTemporary: true},
+	}
+	if result := list.Validate(sealed2); result.Result != ARCTempError {
+		t.Errorf("Wrong result without key: %+v", result)
+	}
+	if again, _ := list.Seal(sealed2, list.Validate(sealed2), "lists.example.org; arc=temperror"); again != sealed2 {
+		t.Error("Chain sealed without validation")
+	}
+}
+
+func TestARCSets(t *testing.T) {
+	// only ARC-Authentication-Results starts with i=
+	m := ParseMessage("ARC-Seal: a=rsa-sha256; cv=none; d=example.org; i=1; s=arc; b=\r\n" +
+		"ARC-Message-Signature: a=rsa-sha256; c=relaxed/relaxed; d=example.org;\r\n\ti=1; s=arc; h=from; bh=; b=\r\n" +
+		"ARC-Authentication-Results: i=1; example.org; spf=pass\r\n\r\n")
+	sets, err := ARCSets(m)
+	if err != nil || sets[1] == nil || sets[1].Seal == nil || sets[1].MessageSignature == nil || sets[1].AuthenticationResults == nil {
+		t.Errorf("Wrong sets: %+v %v", sets, err)
+	}
+	m = ParseMessage("ARC-Authentication-Results: example.org; i=1; spf=pass\r\n\r\n")
+	if _, err := ARCSets(m); err == nil {
+		t.Error("ARC-Authentication-Results without leading i= accepted")
+	}
+}
+
+func TestARCFilters(t *testing.T) {
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	resolver := &FakeResolver{TXT: map[string][]string{
+		"arc._domainkey.example.org": []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+	arc := &ARC{Resolver: resolver, Key: &DKIMKey{Domain: "example.org", Selector: "arc", Signer: edKey}, AuthServID: "mx.example.org"}
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.SPFMailFrom = &SPFCheck{Result: SPFPass, Sender: "joe@example.com", Domain: "example.com"}
+
+	args := []string{"From: joe@example.com\r\n\r\nHello.\r\n"}
+	arc.Filter(s)(args...)
+	(&AuthenticationResults{AuthServID: "mx.example.org"}).Filter(s)(args...)
+	if reply := arc.SealFilter(s)(args...); reply != nil {
+		t.Errorf("Unexpected reply: %+v", reply)
+	}
+
+	m := ParseMessage(args[0])
+	aar := m.Get("ARC-Authentication-Results")
+	if aar == nil || strings.Contains(aar.Value(), "i=1; mx.example.org;\tspf=pass smtp.mailfrom=joe@example.com;\tarc=none") == false {
+		t.Errorf("Wrong ARC-Authentication-Results: %+v", aar)
+	}
+	if ar := m.Get("Authentication-Results"); ar == nil || strings.Contains(ar.Value(), "arc=none") == false {
+		t.Errorf("Wrong Authentication-Results: %+v", ar)
+	}
+	if result := arc.Validate(args[0]); result.Result != ARCPass {
+		t.Errorf("Chain not validated: %+v", result)
+	}
+}
@@ -0,0 +1,145 @@
+package smtpserver
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// https://tools.ietf.org/html/rfc8601
+
+// AuthenticationResults adds an Authentication-Results header field
+// reporting the SPF, DKIM, ARC, DMARC and SMTP AUTH outcomes of the session. It
+// is meant to be registered as the last DATA filter, as it rewrites the
+// message handed to the DATA callback:
+//
+//	s.AddFilter("DATA", verifier.Filter(&s.Smtp))
+//	s.AddFilter("DATA", dmarc.Filter(&s.Smtp))
+//	s.AddFilter("DATA", results.Filter(&s.Smtp))
+type AuthenticationResults struct {
+	AuthServID string // default the hostname
+}
+
+func (a *AuthenticationResults) authServID(s *Smtp) string {
+	if a.AuthServID == "" {
+		return s.GetHostname()
+	}
+	return a.AuthServID
+}
+
+var commentRe = regexp.MustCompile("\\([^()]*\\)")
+
+// ParseAuthServID returns the authserv-id of an Authentication-Results
+// header field value.
+func ParseAuthServID(value string) string {
+	value = commentRe.ReplaceAllString(value, " ")
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[:i]
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(fields[0], "\"")
+}
+
+func quoteReason(reason string) string {
+	reason = strings.Replace(reason, "\\", "\\\\", -1)
+	reason = strings.Replace(reason, "\"", "\\\"", -1)
+	return "reason=\"" + reason + "\""
+}
+
+// Collect returns the resinfo entries of the session.
+func (a *AuthenticationResults) Collect(s *Smtp) []string {
+	var results []string
+
+	if s.Authenticated {
+		result := "auth=pass"
+		if s.AuthUser != "" {
+			result += " smtp.auth=" + s.AuthUser
+		}
+		results = append(results, result)
+	}
+
+	if s.SPFMailFrom != nil {
+		results = append(results, "spf="+string(s.SPFMailFrom.Result)+" smtp.mailfrom="+s.SPFMailFrom.Sender)
+	}
+	if s.SPFHelo != nil {
+		results = append(results, "spf="+string(s.SPFHelo.Result)+" smtp.helo="+s.SPFHelo.Domain)
+	}
+
+	if s.DKIMResults != nil && len(s.DKIMResults) == 0 {
+		results = append(results, "dkim=none")
+	}
+	for _, dkim := range s.DKIMResults {
+		result := "dkim=" + dkim.Result
+		if dkim.Result != DKIMPass && dkim.Err != nil {
+			result += " " + quoteReason(dkim.Err.Error())
+		}
+		if dkim.Domain != "" {
+			result += " header.d=" + dkim.Domain
+		}
+		if dkim.Selector != "" {
+			result += " header.s=" + dkim.Selector
+		}
+		if len(dkim.Signature) >= 8 {
+			result += " header.b=" + dkim.Signature[:8]
+		}
+		results = append(results, result)
+	}
+
+	if s.ARC != nil {
+		result := "arc=" + s.ARC.Result
+		if (s.ARC.Result == ARCFail || s.ARC.Result == ARCTempError) && s.ARC.Err != nil {
+			result += " " + quoteReason(s.ARC.Err.Error())
+		}
+		if s.ARC.Result == ARCPass {
+			result += " header.oldest-pass=" + strconv.Itoa(s.ARC.OldestPass)
+		}
+		results = append(results, result)
+	}
+
+	if s.DMARC != nil {
+		result := "dmarc=" + s.DMARC.Result
+		if s.DMARC.Policy != "" {
+			result += " (p=" + s.DMARC.Policy + " dis=" + s.DMARC.Disposition + ")"
+		}
+		if s.DMARC.FromDomain != "" {
+			result += " header.from=" + s.DMARC.FromDomain
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// Value returns the value of the header field for the session.
+func (a *AuthenticationResults) Value(s *Smtp) string {
+	results := a.Collect(s)
+	if len(results) == 0 {
+		return a.authServID(s) + "; none"
+	}
+	return a.authServID(s) + ";\r\n\t" + strings.Join(results, ";\r\n\t")
+}
+
+// Apply removes the Authentication-Results header fields bearing our
+// authserv-id from a message and prepends ours.
+func (a *AuthenticationResults) Apply(s *Smtp, data string) string {
+	m := ParseMessage(data)
+	id := a.authServID(s)
+	for _, h := range m.GetAll("Authentication-Results") {
+		if strings.EqualFold(ParseAuthServID(h.Value()), id) {
+			m.Remove(h)
+		}
+	}
+	m.Prepend("Authentication-Results", a.Value(s))
+	return m.String()
+}
+
+// Filter returns a DATA filter adding the header field to the message.
+func (a *AuthenticationResults) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		args[0] = a.Apply(s, args[0])
+		return nil
+	}
+}
@@ -0,0 +1,37 @@
+package smtpserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAuthenticationResults(t *testing.T) {
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.SPFMailFrom = &SPFCheck{Result: SPFPass, Sender: "joe@example.com", Domain: "example.com"}
+	s.DKIMResults = []*DKIMVerification{&DKIMVerification{Result: DKIMFail, Domain: "example.com", Selector: "sel", Signature: "abcdefghijkl", Err: errors.New("body hash did not verify")}}
+	s.DMARC = &DMARCCheck{Result: DMARCFail, FromDomain: "example.com", Policy: "reject", Disposition: "reject"}
+
+	results := &AuthenticationResults{AuthServID: "mx.example.org"}
+	data := "Authentication-Results: mx.example.org; dkim=pass\r\n" +
+		"Authentication-Results: other.example.net; spf=pass\r\n" +
+		"From: joe@example.com\r\n\r\nbody\r\n"
+
+	args := []string{data}
+	results.Filter(s)(args...)
+
+	expected := "Authentication-Results: mx.example.org;\r\n" +
+		"\tspf=pass smtp.mailfrom=joe@example.com;\r\n" +
+		"\tdkim=fail reason=\"body hash did not verify\" header.d=example.com header.s=sel header.b=abcdefgh;\r\n" +
+		"\tdmarc=fail (p=reject dis=reject) header.from=example.com\r\n" +
+		"Authentication-Results: other.example.net; spf=pass\r\n" +
+		"From: joe@example.com\r\n\r\nbody\r\n"
+	if args[0] != expected {
+		t.Error("Wrong message: " + args[0])
+	}
+
+	if strings.Contains(results.Apply(&Smtp{}, "From: a@b\r\n\r\n"), "; none") == false {
+		t.Error("Missing none result")
+	}
+}
@@ -0,0 +1,110 @@
+package smtpserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+
+// ClamAV scans the messages with clamd through its INSTREAM command. It
+// is meant to be registered as a DATA filter:
+//
+//	s.AddFilter("DATA", clamav.Filter(&s.Smtp))
+type ClamAV struct {
+	Network    string        // "tcp" or "unix"
+	Address    string        // e.g. "127.0.0.1:3310" or "/run/clamav/clamd.ctl"
+	Timeout    time.Duration // connection and scan timeout (default 30s)
+	MaxSize    int           // larger messages aren't scanned, 0 for no limit
+	ChunkSize  int           // default 64KB, below clamd's StreamMaxLength
+	FailClosed bool          // tempfail the messages the scanner fails on instead of accepting them
+}
+
+// Scan sends data to clamd. It returns the name of the signature found,
+// or "" if the data is clean.
+func (c *ClamAV) Scan(data string) (string, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	chunkSize := c.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = 64 * 1024
+	}
+
+	conn, err := net.DialTimeout(c.Network, c.Address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.WriteString(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return "", err
+	}
+	return ParseClamdReply(reply)
+}
+
+// ParseClamdReply parses the reply of a scan, e.g.
+// "stream: Eicar-Signature FOUND".
+func ParseClamdReply(reply string) (string, error) {
+	reply = strings.TrimRight(reply, "\x00\n")
+	if i := strings.Index(reply, ": "); i >= 0 {
+		reply = reply[i+2:]
+	}
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+	return "", fmt.Errorf("unexpected clamd reply %q", reply)
+}
+
+// Filter returns a DATA filter rejecting the infected messages. Messages
+// above MaxSize go through unscanned.
+func (c *ClamAV) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		if c.MaxSize > 0 && len(args[0]) > c.MaxSize {
+			return nil
+		}
+
+		virus, err := c.Scan(args[0])
+		if err != nil {
+			if c.FailClosed {
+				return &Reply{0, 451, "4.3.0 Virus scan failed, try again later"}
+			}
+			return nil
+		}
+		if virus != "" {
+			return &Reply{0, 554, fmt.Sprintf("5.7.1 Message rejected, virus found: %s", virus)}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,101 @@
+package smtpserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// StartFakeClamd serves INSTREAM scans, finding the EICAR test string and
+// refusing streams larger than limit.
+func StartFakeClamd(limit int) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if command, _ := r.ReadString(0); command != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data []byte
+				for {
+					var size [4]byte
+					if _, err := io.ReadFull(r, size[:]); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size[:])
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+					if len(data) > limit {
+						conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+						return
+					}
+				}
+
+				if strings.Contains(string(data), eicar) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestClamAV(t *testing.T) {
+	clamd := StartFakeClamd(1024)
+	defer clamd.Close()
+
+	clamav := &ClamAV{Network: "tcp", Address: clamd.Addr().String(), ChunkSize: 16, Timeout: time.Second}
+	filter := clamav.Filter(&Smtp{})
+
+	if reply := filter("Subject: Hi\r\n\r\nHello.\r\n"); reply != nil {
+		t.Errorf("Clean message refused: %+v", reply)
+	}
+
+	infected := "Subject: Hi\r\n\r\n" + eicar + "\r\n"
+	if reply := filter(infected); reply == nil || reply.Code != 554 || reply.Message != "5.7.1 Message rejected, virus found: Eicar-Test-Signature" {
+		t.Errorf("Wrong reply: %+v", reply)
+	}
+
+	large := "Subject: Hi\r\n\r\n" + strings.Repeat("Hello.\r\n", 200)
+	if reply := filter(large); reply != nil {
+		t.Errorf("Scanner error didn't fail open: %+v", reply)
+	}
+	clamav.FailClosed = true
+	if reply := filter(large); reply == nil || reply.Code != 451 {
+		t.Errorf("Scanner error didn't fail closed: %+v", reply)
+	}
+	clamav.MaxSize = 1024
+	if reply := filter(large); reply != nil {
+		t.Errorf("Large message scanned: %+v", reply)
+	}
+
+	clamd.Close()
+	if reply := filter(infected); reply == nil || reply.Code != 451 {
+		t.Errorf("Unavailable scanner didn't fail closed: %+v", reply)
+	}
+}
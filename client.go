@@ -0,0 +1,398 @@
+package smtpserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClientReply is a reply received by a Client. It is also the error
+// returned when a command fails.
+type ClientReply struct {
+	Code  int
+	Lines []string
+}
+
+func (r *ClientReply) Message() string {
+	return strings.Join(r.Lines, "\n")
+}
+
+func (r *ClientReply) String() string {
+	return strconv.Itoa(r.Code) + " " + strings.Join(r.Lines, " ")
+}
+
+func (r *ClientReply) Error() string {
+	return r.String()
+}
+
+// Positive tells whether the reply is a 2xx or 3xx.
+func (r *ClientReply) Positive() bool {
+	return r.Code >= 200 && r.Code < 400
+}
+
+// Temporary tells whether the reply is a 4xx.
+func (r *ClientReply) Temporary() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+// Client is the client side of an SMTP or LMTP session, as used to
+// deliver the queued messages.
+type Client struct {
+	Hostname   string            // name given in EHLO
+	LMTP       bool              // speak LMTP: LHLO, and a reply per recipient to the message
+	Timeout    time.Duration     // timeout of each command (default 5m)
+	Greeting   *ClientReply      // reply to the connection
+	Extensions map[string]string // EHLO keywords and their parameters
+	TLS        bool              // the session is encrypted
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewClient starts a session on conn, reading the greeting of the server.
+// A greeting other than 220 is returned as error.
+func NewClient(conn net.Conn, hostname string, timeout time.Duration) (*Client, error) {
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	c := &Client{Hostname: hostname, Timeout: timeout, conn: conn, reader: bufio.NewReader(conn)}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	c.Greeting = reply
+	if reply.Code != 220 {
+		return nil, reply
+	}
+	return c, nil
+}
+
+// clientHostname returns the name to greet servers with: hostname, or by
+// default the name of the host.
+func clientHostname(hostname string) string {
+	if hostname != "" {
+		return hostname
+	}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return "localhost"
+}
+
+// DialClient connects to a server and reads its greeting.
+func DialClient(network string, address string, hostname string, timeout time.Duration) (*Client, error) {
+	if timeout == 0 {
+		timeout = 5 * time.Minute
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, hostname, timeout)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) readReply() (*ClientReply, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	reply := &ClientReply{}
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 3 {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || (reply.Code != 0 && code != reply.Code) {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		reply.Code = code
+		if len(line) > 4 {
+			reply.Lines = append(reply.Lines, line[4:])
+		} else {
+			reply.Lines = append(reply.Lines, "")
+		}
+		if len(line) == 3 || line[3] != '-' {
+			return reply, nil
+		}
+	}
+}
+
+func (c *Client) write(s string) error {
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	_, err := c.conn.Write([]byte(s))
+	return err
+}
+
+// Command sends a command and returns its reply. A negative reply is
+// returned as error too.
+func (c *Client) Command(format string, args ...interface{}) (*ClientReply, error) {
+	if err := c.write(fmt.Sprintf(format, args...) + "\r\n"); err != nil {
+		return nil, err
+	}
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if reply.Positive() == false {
+		return reply, reply
+	}
+	return reply, nil
+}
+
+// Hello greets the server with EHLO, or HELO if it doesn't know EHLO. An
+// LMTP server is greeted with LHLO.
+func (c *Client) Hello() error {
+	c.Extensions = map[string]string{}
+	verb := "EHLO"
+	if c.LMTP {
+		verb = "LHLO"
+	}
+	reply, err := c.Command("%s %s", verb, c.Hostname)
+	if err == nil {
+		for _, line := range reply.Lines[1:] {
+			fields := strings.SplitN(line, " ", 2)
+			keyword := strings.ToUpper(fields[0])
+			c.Extensions[keyword] = ""
+			if len(fields) > 1 {
+				c.Extensions[keyword] = fields[1]
+			}
+		}
+		return nil
+	}
+	if reply == nil || reply.Temporary() || c.LMTP {
+		return err
+	}
+	_, err = c.Command("HELO %s", c.Hostname)
+	return err
+}
+
+// Supports tells whether the server advertised an extension.
+func (c *Client) Supports(keyword string) bool {
+	_, ok := c.Extensions[keyword]
+	return ok
+}
+
+// StartTLS upgrades the session to TLS and greets the server again.
+func (c *Client) StartTLS(config *tls.Config) error {
+	if _, err := c.Command("STARTTLS"); err != nil {
+		return err
+	}
+	conn := tls.Client(c.conn, config)
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.TLS = true
+	return c.Hello()
+}
+
+// Auth authenticates with PLAIN, or LOGIN if the server doesn't offer
+// PLAIN. The session should be encrypted first.
+func (c *Client) Auth(username string, password string) error {
+	mechanisms := map[string]bool{}
+	for _, mechanism := range strings.Fields(c.Extensions["AUTH"]) {
+		mechanisms[strings.ToUpper(mechanism)] = true
+	}
+
+	encode := base64.StdEncoding.EncodeToString
+	switch {
+	case mechanisms["PLAIN"]:
+		_, err := c.Command("AUTH PLAIN %s", encode([]byte("\x00"+username+"\x00"+password)))
+		return err
+	case mechanisms["LOGIN"]:
+		for _, command := range []string{"AUTH LOGIN", encode([]byte(username)), encode([]byte(password))} {
+			if _, err := c.Command("%s", command); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported authentication mechanism offered (%s)", c.Extensions["AUTH"])
+}
+
+// Reset aborts the current transaction.
+func (c *Client) Reset() error {
+	_, err := c.Command("RSET")
+	return err
+}
+
+// Quit ends the session and closes the connection.
+func (c *Client) Quit() error {
+	_, err := c.Command("QUIT")
+	c.conn.Close()
+	return err
+}
+
+// Close closes the connection without ending the session.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// DotStuff converts a message to CRLF line endings, doubles the dots
+// starting a line and appends the end of data indicator.
+func DotStuff(message []byte) string {
+	data := ToCRLF(string(message))
+	if data != "" && strings.HasSuffix(data, "\r\n") == false {
+		data += "\r\n"
+	}
+	if strings.HasPrefix(data, ".") {
+		data = "." + data
+	}
+	return strings.Replace(data, "\r\n.", "\r\n..", -1) + ".\r\n"
+}
+
+// is8bit tells whether a message has bytes above 127.
+func is8bit(message []byte) bool {
+	for _, b := range message {
+		if b > 127 {
+			return true
+		}
+	}
+	return false
+}
+
+// Send runs a mail transaction, pipelined if the server allows it. It
+// returns the outcome of each recipient: the reply to its RCPT command if
+// refused, else the reply to the message (its own reply with LMTP). The
+// error is the reply to MAIL if the sender is refused, or a connection
+// failure.
+func (c *Client) Send(from string, recipients []string, message []byte) ([]*ClientReply, error) {
+	return c.SendDSN(from, recipients, message, nil)
+}
+
+// SendDSN runs a mail transaction as Send does, passing the DSN parameters
+// on if the server supports DSN. The parameters of the recipients are
+// looked up by address.
+func (c *Client) SendDSN(from string, recipients []string, message []byte, params *DSNParams) ([]*ClientReply, error) {
+	if c.Supports("DSN") == false {
+		params = nil
+	}
+	mail := "MAIL FROM:<" + from + ">"
+	if c.Supports("SIZE") {
+		mail += " SIZE=" + strconv.Itoa(len(message))
+	}
+	if c.Supports("8BITMIME") && is8bit(message) {
+		mail += " BODY=8BITMIME"
+	}
+	if params != nil && params.Ret != "" {
+		mail += " RET=" + params.Ret
+	}
+	if params != nil && params.EnvID != "" {
+		mail += " ENVID=" + EncodeXtext(params.EnvID)
+	}
+	commands := []string{mail}
+	for _, rcpt := range recipients {
+		command := "RCPT TO:<" + rcpt + ">"
+		if params != nil && len(params.Notify[rcpt]) > 0 {
+			command += " NOTIFY=" + strings.Join(params.Notify[rcpt], ",")
+		}
+		if params != nil && params.ORcpt[rcpt] != "" {
+			command += " ORCPT=" + EncodeXtext(params.ORcpt[rcpt])
+		}
+		commands = append(commands, command)
+	}
+	commands = append(commands, "DATA")
+
+	results := make([]*ClientReply, len(recipients))
+	var replies []*ClientReply
+	if c.Supports("PIPELINING") {
+		if err := c.write(strings.Join(commands, "\r\n") + "\r\n"); err != nil {
+			return nil, err
+		}
+		for range commands {
+			reply, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+	} else {
+		for i, command := range commands {
+			if i > 0 && replies[0].Positive() == false {
+				break
+			}
+			if i == len(commands)-1 {
+				accepted := false
+				for _, reply := range replies[1:] {
+					accepted = accepted || reply.Positive()
+				}
+				if accepted == false {
+					break
+				}
+			}
+			if err := c.write(command + "\r\n"); err != nil {
+				return nil, err
+			}
+			reply, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			replies = append(replies, reply)
+		}
+	}
+
+	var accepted []int
+	for i := range recipients {
+		if i+1 < len(replies) && replies[i+1].Positive() {
+			accepted = append(accepted, i)
+		} else if i+1 < len(replies) {
+			results[i] = replies[i+1]
+		}
+	}
+
+	data := replies[len(replies)-1]
+	if len(replies) < len(commands) {
+		data = nil
+	} else if data.Code == 354 && (replies[0].Positive() == false || len(accepted) == 0) {
+		// a pipelined DATA the server went on with: send an empty message
+		c.write(".\r\n")
+		c.readReply()
+		data = nil
+	}
+
+	if replies[0].Positive() == false {
+		c.Reset()
+		return nil, replies[0]
+	}
+	if data == nil {
+		c.Reset()
+		return results, nil
+	}
+	if data.Code != 354 {
+		c.Reset()
+		for _, i := range accepted {
+			results[i] = data
+		}
+		return results, nil
+	}
+
+	if err := c.write(DotStuff(message)); err != nil {
+		return nil, err
+	}
+	var reply *ClientReply
+	for n, i := range accepted {
+		if n == 0 || c.LMTP {
+			var err error
+			if reply, err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		results[i] = reply
+	}
+	return results, nil
+}
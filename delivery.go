@@ -0,0 +1,567 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+// Delivery delivers the queued messages to the MX hosts of the recipient
+// domains, or to the transports the recipients are routed to. Recipients
+// deferred are retried with an exponential backoff until the message
+// expires:
+//
+//	delivery := &Delivery{Queue: q, Hostname: "mx.example.com"}
+//	go delivery.Run(stop)
+type Delivery struct {
+	Queue        *queue.Queue
+	Resolver     Resolver      // default DefaultResolver
+	Hostname     string        // name given in EHLO (default os.Hostname())
+	Port         int           // port of the MX hosts (default 25)
+	TLSConfig    *tls.Config   // STARTTLS settings; nil to encrypt without checking certificates
+	DisableTLS   bool          // don't use STARTTLS, unless a transport requires it
+	Transports   TransportMap  // routes of the recipients, MX delivery for the others
+	Local        LocalAgent    // agent of the local transport
+	DSN          *DSN          // notifies the senders of the outcomes; nil for no notifications
+	DelayWarning time.Duration // age of a deferred message its sender is warned about (default 4h)
+	Timeout      time.Duration // timeout of the connections and commands (default 5m)
+	MinBackoff   time.Duration // delay before the first retry, doubled at each retry (default 5m)
+	MaxBackoff   time.Duration // longest delay between retries (default 1h)
+	MaxLifetime  time.Duration // how long deferred messages stay queued (default 5 days)
+	Interval     time.Duration // queue scan interval of Run (default 1m)
+}
+
+// LocalAgent delivers messages to local mailboxes, as the local transport.
+// It returns the outcome of each recipient: nil once delivered, else an
+// error; a *ClientReply gives the reply to report, other errors are
+// temporary failures.
+type LocalAgent interface {
+	Deliver(from string, recipients []string, message []byte) []error
+}
+
+// deliveryError is a failure to deliver to a domain, for all its
+// recipients.
+type deliveryError struct {
+	Code      int
+	Status    string
+	Text      string
+	RemoteMTA string
+	Reply     *ClientReply // reply of the remote MTA, if any
+	Permanent bool
+}
+
+func (e *deliveryError) Error() string {
+	if e.Reply != nil {
+		return e.Reply.String()
+	}
+	return fmt.Sprintf("%d %s %s", e.Code, e.Status, e.Text)
+}
+
+func (d *Delivery) resolver() Resolver {
+	if d.Resolver == nil {
+		return DefaultResolver
+	}
+	return d.Resolver
+}
+
+func (d *Delivery) duration(value time.Duration, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+func (d *Delivery) hostname() string {
+	return clientHostname(d.Hostname)
+}
+
+// Backoff returns the delay before the next attempt of a message that
+// failed attempts times already.
+func (d *Delivery) Backoff(attempts int) time.Duration {
+	delay := d.duration(d.MinBackoff, 5*time.Minute)
+	max := d.duration(d.MaxBackoff, time.Hour)
+	for i := 0; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// Run delivers the due messages every Interval until stop is closed.
+func (d *Delivery) Run(stop <-chan struct{}) {
+	for {
+		d.Flush()
+		select {
+		case <-stop:
+			return
+		case <-time.After(d.duration(d.Interval, time.Minute)):
+		}
+	}
+}
+
+// Flush attempts the delivery of the due messages. A message that fails
+// doesn't stop the others; the first error is returned.
+func (d *Delivery) Flush() error {
+	entries, err := d.Queue.Due(time.Now())
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, entry := range entries {
+		if err := d.Deliver(entry.ID); err != nil && err != queue.ErrNotFound && first == nil {
+			first = fmt.Errorf("delivering %s: %v", entry.ID, err)
+		}
+	}
+	return first
+}
+
+// Deliver attempts the delivery of a message to its pending recipients.
+// The message leaves the queue once each recipient is delivered or has
+// failed; otherwise it is deferred, or expired once older than
+// MaxLifetime.
+func (d *Delivery) Deliver(id string) error {
+	entry, err := d.Queue.Activate(id)
+	if err != nil {
+		return err
+	}
+	message, err := d.message(id)
+	if err != nil {
+		d.Queue.Defer(entry, time.Now().Add(d.Backoff(entry.Attempts)), err.Error())
+		return err
+	}
+
+	// recipients are grouped by transport, and by domain for MX delivery
+	type route struct {
+		transport  *Transport
+		domain     string
+		recipients []*queue.Recipient
+	}
+	var routes []*route
+	byKey := map[string]*route{}
+	for _, rcpt := range entry.Pending() {
+		domain := ""
+		if i := strings.LastIndex(rcpt.Address, "@"); i >= 0 {
+			domain = strings.ToLower(rcpt.Address[i+1:])
+		}
+		t := d.Transports.Lookup(rcpt.Address)
+		if t == nil {
+			t = &Transport{Kind: TransportSMTP}
+		}
+		key := fmt.Sprintf("%s %p", t, t)
+		if t.Kind == TransportSMTP && t.Nexthop == "" {
+			key = "mx " + domain
+		}
+		if byKey[key] == nil {
+			byKey[key] = &route{transport: t, domain: domain}
+			routes = append(routes, byKey[key])
+		}
+		byKey[key].recipients = append(byKey[key].recipients, rcpt)
+	}
+
+	lastError := ""
+	for _, r := range routes {
+		if err := d.deliverRoute(r.transport, r.domain, &entry.Envelope, r.recipients, message); err != nil {
+			lastError = err.Error()
+		}
+	}
+
+	pending := entry.Pending()
+	expired := time.Since(entry.Created) >= d.duration(d.MaxLifetime, 5*24*time.Hour)
+	if len(pending) > 0 && expired {
+		for _, rcpt := range pending {
+			rcpt.Status = queue.Failed
+			if rcpt.Diagnostic == "" {
+				rcpt.Diagnostic = "451 4.4.7 Message expired in the queue"
+			}
+		}
+		pending = nil
+	}
+	if err := d.notify(entry, message); err != nil {
+		// the message stays queued until its notifications are
+		d.Queue.Defer(entry, time.Now().Add(d.Backoff(entry.Attempts)), err.Error())
+		return err
+	}
+	if len(pending) == 0 {
+		return d.Queue.Complete(id)
+	}
+	if lastError == "" {
+		lastError = pending[0].Diagnostic
+	}
+	return d.Queue.Defer(entry, time.Now().Add(d.Backoff(entry.Attempts)), lastError)
+}
+
+// notify queues the notifications due to the sender of a message: the
+// final outcomes of the recipients not notified yet, and a single warning
+// once the message has been deferred for DelayWarning.
+func (d *Delivery) notify(entry *queue.Entry, message []byte) error {
+	if d.DSN == nil {
+		return nil
+	}
+	var final []*queue.Recipient
+	for _, rcpt := range entry.Recipients {
+		if rcpt.Status != queue.Pending && rcpt.Notified == false {
+			final = append(final, rcpt)
+		}
+	}
+	if len(final) > 0 {
+		if err := d.DSN.Notify(d.Queue, &entry.Envelope, final, message); err != nil {
+			return err
+		}
+	}
+
+	pending := entry.Pending()
+	if len(pending) == 0 || entry.Delayed || time.Since(entry.Created) < d.duration(d.DelayWarning, 4*time.Hour) {
+		return nil
+	}
+	if report := d.DSN.Report(&entry.Envelope, pending, message); report != nil {
+		if _, err := d.Queue.Enqueue(&queue.Envelope{Recipients: queue.Recipients([]string{entry.From})}, report); err != nil {
+			return fmt.Errorf("queueing the notification: %v", err)
+		}
+	}
+	entry.Delayed = true
+	return nil
+}
+
+func (d *Delivery) message(id string) ([]byte, error) {
+	r, err := d.Queue.Message(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// fail records a failure for recipients, permanent or not.
+func fail(recipients []*queue.Recipient, err *deliveryError) {
+	for _, rcpt := range recipients {
+		rcpt.Diagnostic = err.Error()
+		rcpt.RemoteMTA = err.RemoteMTA
+		if err.Permanent {
+			rcpt.Status = queue.Failed
+		}
+	}
+}
+
+// MXHosts returns the hosts mail for a domain goes to, in order of
+// preference: the MX hosts, or the domain itself if it has no MX. A
+// domain with a null MX (RFC 7505) has no hosts.
+func (d *Delivery) MXHosts(domain string) ([]string, error) {
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		return []string{domain}, nil
+	}
+	mxs, err := d.resolver().LookupMX(domain)
+	if IsNotFound(err) {
+		return []string{domain}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	mxs = append([]*net.MX{}, mxs...)
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	var hosts []string
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			// null MX
+			return nil, nil
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// addresses resolves a host, or an address literal.
+func (d *Delivery) addresses(host string) ([]string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		literal := strings.TrimPrefix(host[1:len(host)-1], "IPv6:")
+		if net.ParseIP(literal) == nil {
+			return nil, &net.DNSError{Err: "invalid address literal", Name: host, IsNotFound: true}
+		}
+		return []string{literal}, nil
+	}
+	return d.resolver().LookupHost(host)
+}
+
+// deliverRoute delivers to the recipients of a transport.
+func (d *Delivery) deliverRoute(t *Transport, domain string, env *queue.Envelope, recipients []*queue.Recipient, message []byte) error {
+	var err *deliveryError
+	switch t.Kind {
+	case TransportLocal:
+		err = d.deliverLocal(env.From, recipients, message)
+	case TransportLMTP:
+		err = d.deliverLMTP(t, env, recipients, message)
+	default:
+		err = d.deliverSMTP(t, domain, env, recipients, message)
+	}
+	if err != nil {
+		fail(recipients, err)
+		return err
+	}
+	return nil
+}
+
+// deliverLocal hands the recipients to the local agent.
+func (d *Delivery) deliverLocal(from string, recipients []*queue.Recipient, message []byte) *deliveryError {
+	if d.Local == nil {
+		return &deliveryError{Code: 451, Status: "4.3.5", Text: "No local delivery agent configured"}
+	}
+
+	var addresses []string
+	for _, rcpt := range recipients {
+		addresses = append(addresses, rcpt.Address)
+	}
+	results := d.Local.Deliver(from, addresses, message)
+	for i, rcpt := range recipients {
+		var err error
+		if i < len(results) {
+			err = results[i]
+		}
+		switch err := err.(type) {
+		case nil:
+			rcpt.Status = queue.Delivered
+			rcpt.Diagnostic = "250 2.0.0 Ok: delivered to mailbox"
+		case *ClientReply:
+			rcpt.Diagnostic = err.String()
+			if err.Temporary() == false {
+				rcpt.Status = queue.Failed
+			}
+		default:
+			rcpt.Diagnostic = "451 4.3.0 " + err.Error()
+		}
+	}
+	return nil
+}
+
+// targetAddress returns the network and address of a server given as
+// unix:/path, /path, inet:host:port or host:port, with a default port.
+func targetAddress(nexthop string, port string) (string, string) {
+	switch {
+	case strings.HasPrefix(nexthop, "unix:"):
+		return "unix", strings.TrimPrefix(nexthop, "unix:")
+	case strings.HasPrefix(nexthop, "/"):
+		return "unix", nexthop
+	}
+	address := strings.TrimPrefix(nexthop, "inet:")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	return "tcp", address
+}
+
+// deliverLMTP delivers to the recipients through an LMTP server.
+func (d *Delivery) deliverLMTP(t *Transport, env *queue.Envelope, recipients []*queue.Recipient, message []byte) *deliveryError {
+	h := &Handoff{Target: t.Nexthop, LMTP: true, Hostname: d.Hostname, Timeout: d.Timeout}
+	c, err := h.connect()
+	if err != nil {
+		return &deliveryError{Code: 451, Status: "4.4.1", Text: "Connection to " + t.Nexthop + " failed: " + err.Error()}
+	}
+	if err := c.Hello(); err != nil {
+		c.Close()
+		return &deliveryError{Code: 451, Status: "4.4.0", Text: "LHLO to " + t.Nexthop + " failed: " + err.Error()}
+	}
+	defer c.Quit()
+	return d.transaction(c, t.Nexthop, env, recipients, message)
+}
+
+// splitNexthop splits the port off a next hop.
+func splitNexthop(nexthop string) (string, int, error) {
+	host, port := nexthop, ""
+	if strings.HasPrefix(nexthop, "[") {
+		if i := strings.Index(nexthop, "]"); i >= 0 {
+			host, port = nexthop[:i+1], strings.TrimPrefix(nexthop[i+1:], ":")
+		}
+	} else if i := strings.LastIndex(nexthop, ":"); i >= 0 {
+		host, port = nexthop[:i], nexthop[i+1:]
+	}
+	if port == "" {
+		return host, 0, nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return "", 0, fmt.Errorf("invalid port in next hop %q", nexthop)
+	}
+	return host, n, nil
+}
+
+// deliverSMTP delivers to the recipients of a domain through the MX hosts
+// of the domain or the next hop of the transport, trying the hosts in turn
+// until one of them gives an outcome.
+func (d *Delivery) deliverSMTP(t *Transport, domain string, env *queue.Envelope, recipients []*queue.Recipient, message []byte) *deliveryError {
+	port := d.Port
+	if port == 0 {
+		port = 25
+	}
+
+	name := t.Nexthop
+	if name == "" {
+		if domain == "" {
+			return &deliveryError{Code: 550, Status: "5.1.3", Text: "Bad recipient address syntax", Permanent: true}
+		}
+		name = domain
+	} else {
+		host, p, err := splitNexthop(t.Nexthop)
+		if err != nil {
+			return &deliveryError{Code: 451, Status: "4.3.5", Text: err.Error()}
+		}
+		if p != 0 {
+			port = p
+		}
+		name = host
+	}
+
+	var hosts []string
+	if strings.HasPrefix(name, "[") && strings.HasSuffix(name, "]") && net.ParseIP(strings.TrimPrefix(name[1:len(name)-1], "IPv6:")) == nil {
+		// [host]: no MX lookup
+		hosts = []string{name[1 : len(name)-1]}
+	} else {
+		var err error
+		hosts, err = d.MXHosts(name)
+		if err != nil {
+			return &deliveryError{Code: 451, Status: "4.4.3", Text: fmt.Sprintf("Host or domain name lookup failed for %s: %v", name, err)}
+		}
+		if len(hosts) == 0 {
+			return &deliveryError{Code: 556, Status: "5.1.10", Text: fmt.Sprintf("Domain %s does not accept mail (null MX)", name), Permanent: true}
+		}
+	}
+
+	var last *deliveryError
+	for _, host := range hosts {
+		addresses, err := d.addresses(host)
+		if err != nil {
+			last = &deliveryError{Code: 451, Status: "4.4.3", Text: fmt.Sprintf("Host or domain name lookup failed for %s: %v", host, err)}
+			if IsNotFound(err) && len(hosts) == 1 {
+				last = &deliveryError{Code: 550, Status: "5.1.2", Text: fmt.Sprintf("Host or domain name not found: %s", host), Permanent: true}
+			}
+			continue
+		}
+		for _, address := range addresses {
+			c, err := d.dial(t, host, address, port, true)
+			if err != nil {
+				last = err
+				continue
+			}
+			last = d.transaction(c, host, env, recipients, message)
+			c.Quit()
+			if last == nil || last.Permanent {
+				return last
+			}
+		}
+	}
+	if last == nil {
+		last = &deliveryError{Code: 451, Status: "4.4.4", Text: "No address found for " + name}
+	}
+	return last
+}
+
+// transaction runs a transaction with a host, passing the DSN parameters
+// of the envelope on. It returns nil once the recipients have an outcome,
+// or the error preventing it; a permanent error from the host fails all
+// the recipients.
+func (d *Delivery) transaction(c *Client, host string, env *queue.Envelope, recipients []*queue.Recipient, message []byte) *deliveryError {
+	var addresses []string
+	params := &DSNParams{Ret: env.Ret, EnvID: env.EnvID, Notify: map[string][]string{}, ORcpt: map[string]string{}}
+	for _, rcpt := range recipients {
+		addresses = append(addresses, rcpt.Address)
+		params.Notify[rcpt.Address] = rcpt.Notify
+		params.ORcpt[rcpt.Address] = rcpt.ORcpt
+	}
+	results, err := c.SendDSN(env.From, addresses, message, params)
+	if err != nil {
+		if reply, ok := err.(*ClientReply); ok {
+			return &deliveryError{Reply: reply, RemoteMTA: host, Permanent: reply.Temporary() == false}
+		}
+		return &deliveryError{Code: 451, Status: "4.4.2", Text: "Lost connection with " + host + ": " + err.Error()}
+	}
+
+	for i, rcpt := range recipients {
+		reply := results[i]
+		rcpt.Diagnostic = reply.String()
+		rcpt.RemoteMTA = host
+		switch {
+		case reply.Positive():
+			rcpt.Status = queue.Delivered
+			// a next hop speaking DSN reports the outcome itself
+			rcpt.Relayed = c.LMTP == false && c.Supports("DSN") == false
+		case reply.Temporary() == false:
+			rcpt.Status = queue.Failed
+		}
+	}
+	return nil
+}
+
+// dial connects to a host, greets it, starts TLS and authenticates as the
+// transport requires. At the may level, a failed handshake is followed by
+// a plain session.
+func (d *Delivery) dial(t *Transport, host string, address string, port int, starttls bool) (*Client, *deliveryError) {
+	c, err := DialClient("tcp", net.JoinHostPort(address, strconv.Itoa(port)), d.hostname(), d.duration(d.Timeout, 5*time.Minute))
+	if err == nil {
+		err = c.Hello()
+		if err != nil {
+			c.Close()
+		}
+	}
+	if err != nil {
+		if reply, ok := err.(*ClientReply); ok && reply.Code != 421 {
+			// a server refusing the connection gets another chance with
+			// the next host
+			return nil, &deliveryError{Code: 451, Status: "4.4.0", Text: "Host " + host + " refused to talk to us: " + reply.String(), RemoteMTA: host}
+		}
+		return nil, &deliveryError{Code: 451, Status: "4.4.1", Text: "Connection to " + host + " failed: " + err.Error()}
+	}
+
+	level := t.TLS
+	if level == "" {
+		level = TLSMay
+		if d.DisableTLS {
+			level = TLSNone
+		}
+	}
+	if level != TLSNone && starttls && c.Supports("STARTTLS") {
+		config := t.TLSConfig
+		if config == nil {
+			config = d.TLSConfig
+		}
+		if config == nil {
+			config = &tls.Config{InsecureSkipVerify: level != TLSVerify}
+		} else {
+			config = config.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if err := c.StartTLS(config); err != nil {
+			c.Close()
+			if level == TLSMay {
+				return d.dial(t, host, address, port, false)
+			}
+			return nil, &deliveryError{Code: 451, Status: "4.7.5", Text: "TLS with " + host + " failed: " + err.Error(), RemoteMTA: host}
+		}
+	}
+	if (level == TLSEncrypt || level == TLSVerify) && c.TLS == false {
+		c.Close()
+		return nil, &deliveryError{Code: 451, Status: "4.7.4", Text: "TLS is required, but was not offered by host " + host, RemoteMTA: host}
+	}
+
+	if t.Username != "" {
+		if c.Supports("AUTH") == false {
+			c.Close()
+			return nil, &deliveryError{Code: 451, Status: "4.7.0", Text: "Authentication is required, but was not offered by host " + host, RemoteMTA: host}
+		}
+		if err := c.Auth(t.Username, t.Password); err != nil {
+			c.Close()
+			return nil, &deliveryError{Code: 451, Status: "4.7.0", Text: "SASL authentication failed with host " + host + ": " + err.Error(), RemoteMTA: host}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,425 @@
+package smtpserver
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+// TestMTA is an instance of this library's server recording the messages
+// it accepts. It advertises the given extensions; with AUTH, it relays for
+// joe (password secret) only.
+type TestMTA struct {
+	Listener net.Listener
+
+	mu       sync.Mutex
+	Messages []string     // "from rcpt,rcpt\r\n" + data
+	Users    []string     // authenticated user of each message
+	Hellos   []string     // name given in EHLO of each session
+	Params   []*DSNParams // DSN parameters of each message
+}
+
+func StartTestMTA(extensions ...string) *TestMTA {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	mta := &TestMTA{Listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go mta.serve(conn, extensions)
+		}
+	}()
+	return mta
+}
+
+func (mta *TestMTA) serve(conn net.Conn, extensions []string) {
+	defer conn.Close()
+	esmtp := &Esmtp{}
+	esmtp.Init(&Option{Socket: conn})
+	auth := false
+	for _, extension := range extensions {
+		switch strings.Fields(extension)[0] {
+		case "PIPELINING":
+			esmtp.Register(&Pipelining{})
+		case "8BITMIME":
+			esmtp.Register(&Bit8mime{})
+		case "DSN":
+			esmtp.Register(&Dsn{})
+		case "AUTH":
+			auth = true
+		}
+	}
+	esmtp.SetCallback("EHLO", func(args ...string) *Reply {
+		mta.mu.Lock()
+		mta.Hellos = append(mta.Hellos, args[0])
+		mta.mu.Unlock()
+		return &Reply{1, 250, strings.Join(append([]string{esmtp.GetHostname() + " Service ready"}, extensions...), "\n")}
+	})
+	esmtp.DefVerb("AUTH", func(obj interface{}, args ...string) bool {
+		if args[0] != "PLAIN "+base64.StdEncoding.EncodeToString([]byte("\x00joe\x00secret")) {
+			esmtp.Reply(535, "5.7.8 Authentication credentials invalid")
+			return false
+		}
+		esmtp.Authenticated = true
+		esmtp.AuthUser = "joe"
+		esmtp.Reply(235, "2.7.0 Authentication successful")
+		return false
+	})
+	esmtp.SetCallback("RCPT", func(args ...string) *Reply {
+		if auth && esmtp.Authenticated == false {
+			return &Reply{0, 554, "5.7.1 Relay access denied"}
+		}
+		switch strings.SplitN(args[0], "@", 2)[0] {
+		case "temp":
+			return &Reply{0, 450, "4.2.0 Mailbox busy"}
+		case "unknown":
+			return &Reply{0, 550, "5.1.1 User unknown"}
+		}
+		return &Reply{1, -1, ""}
+	})
+	esmtp.SetCallback("DATA", func(args ...string) *Reply {
+		mta.mu.Lock()
+		defer mta.mu.Unlock()
+		mta.Messages = append(mta.Messages, esmtp.GetSender()+" "+strings.Join(esmtp.GetRecipients(), ",")+"\r\n"+args[0])
+		mta.Users = append(mta.Users, esmtp.AuthUser)
+		mta.Params = append(mta.Params, esmtp.DSNParams)
+		return &Reply{1, 250, "2.0.0 Ok: queued"}
+	})
+	esmtp.Process()
+}
+
+// Records returns copies of the names given in EHLO and of the messages,
+// as the sessions may still be running.
+func (mta *TestMTA) Records() ([]string, []string) {
+	mta.mu.Lock()
+	defer mta.mu.Unlock()
+	return append([]string{}, mta.Hellos...), append([]string{}, mta.Messages...)
+}
+
+func (mta *TestMTA) Port() int {
+	return mta.Listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestClientSend(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		mta := StartTestMTA()
+		if pipelining {
+			mta = StartTestMTA("PIPELINING", "8BITMIME")
+		}
+		c, err := DialClient("tcp", mta.Listener.Addr().String(), "client.example.net", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello(); err != nil {
+			t.Fatal(err)
+		}
+		if c.Supports("PIPELINING") != pipelining {
+			t.Errorf("Wrong extensions: %v", c.Extensions)
+		}
+
+		results, err := c.Send("from@example.net", []string{"a@example.org", "temp@example.org", "unknown@example.org"},
+			[]byte("Subject: Hi\n\n.hidden\nHello.\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results[0].Code != 250 || results[1].Code != 450 || results[2].Code != 550 || results[2].String() != "550 5.1.1 User unknown" {
+			t.Errorf("Wrong results: %v", results)
+		}
+
+		// no recipient accepted
+		results, err = c.Send("from@example.net", []string{"unknown@example.org"}, []byte("x\r\n"))
+		if err != nil || results[0].Code != 550 {
+			t.Errorf("Wrong results: %v %v", results, err)
+		}
+		if results, err = c.Send("from@example.net", []string{"b@example.org"}, []byte("y\r\n")); err != nil || results[0].Code != 250 {
+			t.Errorf("Session broken after a failed transaction: %v %v", results, err)
+		}
+		c.Quit()
+
+		if _, messages := mta.Records(); len(messages) != 2 || messages[0] != "from@example.net a@example.org\r\nSubject: Hi\r\n\r\n.hidden\r\nHello.\r\n" {
+			t.Errorf("Wrong messages: %q", messages)
+		}
+		mta.Listener.Close()
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	mta := StartTestMTA("PIPELINING")
+	defer mta.Listener.Close()
+
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &FakeResolver{
+		MX: map[string][]*net.MX{
+			"example.org":  []*net.MX{&net.MX{Host: "mx.example.org.", Pref: 10}, &net.MX{Host: "down.example.org.", Pref: 5}},
+			"null.example": []*net.MX{&net.MX{Host: ".", Pref: 0}},
+		},
+		Hosts: map[string][]string{
+			"mx.example.org": []string{"127.0.0.1"},
+		},
+		Errors: map[string]error{
+			"down.example.org": &net.DNSError{Err: "server misbehaving", Name: "down.example.org", IsTemporary: true},
+		},
+	}
+	d := &Delivery{Queue: q, Resolver: resolver, Hostname: "mx.example.com", Port: mta.Port(), Timeout: time.Second, MinBackoff: time.Minute}
+
+	id, err := q.Enqueue(&queue.Envelope{
+		From:       "from@example.net",
+		Recipients: queue.Recipients([]string{"a@example.org", "temp@example.org", "unknown@example.org", "b@null.example", "c@nowhere.example"}),
+	}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.State != queue.Deferred || entry.Attempts != 1 || entry.NextAttempt.Before(time.Now().Add(50*time.Second)) {
+		t.Errorf("Wrong entry: %+v", entry)
+	}
+	for i, expected := range []string{
+		"delivered 250 2.0.0 Ok: queued",
+		" 450 4.2.0 Mailbox busy",
+		"failed 550 5.1.1 User unknown",
+		"failed 556 5.1.10 Domain null.example does not accept mail (null MX)",
+		"failed 550 5.1.2 Host or domain name not found: nowhere.example",
+	} {
+		if rcpt := entry.Recipients[i]; rcpt.Status+" "+rcpt.Diagnostic != expected {
+			t.Errorf("Wrong outcome for %s: %s %s", rcpt.Address, rcpt.Status, rcpt.Diagnostic)
+		}
+	}
+	if entry.Recipients[0].RemoteMTA != "mx.example.org" {
+		t.Errorf("Wrong remote MTA: %s", entry.Recipients[0].RemoteMTA)
+	}
+	if _, messages := mta.Records(); len(messages) != 1 || strings.HasPrefix(messages[0], "from@example.net a@example.org\r\n") == false {
+		t.Errorf("Wrong messages: %q", messages)
+	}
+
+	// retried only once due, until the message expires
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := q.Get(id); entry.Attempts != 1 {
+		t.Error("Deferred message retried early")
+	}
+	entry.Created = time.Now().Add(-6 * 24 * time.Hour)
+	if err := q.Update(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Get(id); err != queue.ErrNotFound {
+		t.Errorf("Expired message still queued: %v", err)
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	d := &Delivery{MinBackoff: time.Minute, MaxBackoff: 10 * time.Minute}
+	for attempts, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if backoff := d.Backoff(attempts); backoff != expected {
+			t.Errorf("Wrong backoff after %d attempts: %v", attempts, backoff)
+		}
+	}
+}
+
+func testCertificate() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.org"},
+		DNSNames:     []string{"mx.example.org"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// StartTLSMTA is a scripted server offering STARTTLS, or failing the
+// handshake if broken.
+func StartTLSMTA(broken bool) (net.Listener, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate()}}
+	sessions := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprintf(conn, "220 mx.example.org ESMTP\r\n")
+				encrypted := false
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch verb := strings.ToUpper(strings.Fields(line + " x")[0]); verb {
+					case "EHLO":
+						if encrypted {
+							fmt.Fprintf(conn, "250 mx.example.org\r\n")
+						} else {
+							fmt.Fprintf(conn, "250-mx.example.org\r\n250 STARTTLS\r\n")
+						}
+					case "STARTTLS":
+						fmt.Fprintf(conn, "220 Ready to start TLS\r\n")
+						if broken {
+							conn.Write([]byte("garbage\r\n"))
+							return
+						}
+						tlsConn := tls.Server(conn, config)
+						if tlsConn.Handshake() != nil {
+							return
+						}
+						conn, r, encrypted = tlsConn, bufio.NewReader(tlsConn), true
+					case "DATA":
+						fmt.Fprintf(conn, "354 Go ahead\r\n")
+						for line != ".\r\n" {
+							if line, err = r.ReadString('\n'); err != nil {
+								return
+							}
+						}
+						sessions <- fmt.Sprintf("tls=%v", encrypted)
+						fmt.Fprintf(conn, "250 Ok\r\n")
+					case "QUIT":
+						fmt.Fprintf(conn, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprintf(conn, "250 Ok\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return listener, sessions
+}
+
+func TestDeliveryStartTLS(t *testing.T) {
+	for _, broken := range []bool{false, true} {
+		listener, sessions := StartTLSMTA(broken)
+
+		dir, err := ioutil.TempDir("", "queue")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q, err := queue.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolver := &FakeResolver{Hosts: map[string][]string{"example.org": []string{"127.0.0.1"}}}
+		d := &Delivery{Queue: q, Resolver: resolver, Hostname: "mx.example.com", Port: listener.Addr().(*net.TCPAddr).Port, Timeout: time.Second}
+
+		id, _ := q.Enqueue(&queue.Envelope{Recipients: queue.Recipients([]string{"a@example.org"})}, []byte("Hello.\r\n"))
+		if err := d.Deliver(id); err != nil {
+			t.Fatal(err)
+		}
+		// a failed handshake falls back to a plain session
+		if session := <-sessions; session != fmt.Sprintf("tls=%v", broken == false) {
+			t.Errorf("Wrong session: %s", session)
+		}
+		if _, err := q.Get(id); err != queue.ErrNotFound {
+			t.Errorf("Message still queued: %v", err)
+		}
+
+		listener.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeliveryFlushErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &FakeLocalAgent{Mailboxes: map[string][]string{"joe@local.example": nil}}
+	d := &Delivery{Queue: q, Hostname: "mx.example.com", Transports: TransportMap{"*": &Transport{Kind: TransportLocal}}, Local: local}
+
+	// the message that can't be read doesn't stop the next one
+	broken, _ := q.Enqueue(&queue.Envelope{From: "from@example.net", Recipients: queue.Recipients([]string{"joe@local.example"}), Created: time.Now().Add(-time.Minute)}, []byte("x"))
+	os.Remove(filepath.Join(dir, "data", broken))
+	os.Mkdir(filepath.Join(dir, "data", broken), 0755)
+	q.Enqueue(&queue.Envelope{From: "from@example.net", Recipients: queue.Recipients([]string{"joe@local.example"})}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err := d.Flush(); err == nil || strings.Contains(err.Error(), broken) == false {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if len(local.Mailboxes["joe@local.example"]) != 1 {
+		t.Errorf("Message not delivered: %v", local.Mailboxes)
+	}
+}
+
+func TestDeliveryHostname(t *testing.T) {
+	mta := StartTestMTA()
+	defer mta.Listener.Close()
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without Hostname, the name of the host is given in EHLO
+	d := &Delivery{Queue: q, Transports: TransportMap{"*": &Transport{Nexthop: mta.Listener.Addr().String()}}, Timeout: time.Second}
+	q.Enqueue(&queue.Envelope{From: "from@example.net", Recipients: queue.Recipients([]string{"a@example.org"})}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	if hellos, messages := mta.Records(); len(hellos) != 1 || hellos[0] != host || len(messages) != 1 {
+		t.Errorf("Wrong EHLO: %q (messages %q)", hellos, messages)
+	}
+}
@@ -0,0 +1,306 @@
+package smtpserver
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirectoryEntry is a mailbox known to a Directory.
+type DirectoryEntry struct {
+	Address string // canonical address of the mailbox
+	Quota   int64  // size limit of the mailbox in bytes; 0 for no limit
+}
+
+// Directory tells which mailboxes exist. Lookup returns the mailbox of an
+// address, or nil if there is none; an error is a temporary failure.
+type Directory interface {
+	Lookup(address string) (*DirectoryEntry, error)
+}
+
+// LookupRecipient checks the recipient of a RCPT event in a directory. It
+// is meant to be called from the RCPT callback:
+//
+//	s.SetCallback("RCPT", func(args ...string) *Reply {
+//		return s.LookupRecipient(directory, args...)
+//	})
+func (s *Smtp) LookupRecipient(dir Directory, args ...string) *Reply {
+	address := strings.Trim(args[0], "<>")
+	entry, err := dir.Lookup(address)
+	if err != nil {
+		return &Reply{0, 451, "4.3.0 <" + address + ">: Temporary lookup failure"}
+	}
+	if entry == nil {
+		return &Reply{0, 550, "5.1.1 <" + address + ">: Recipient address rejected: User unknown"}
+	}
+	return &Reply{1, -1, ""}
+}
+
+// VerifyAddress answers a VRFY event with the canonical address of a
+// mailbox of a directory. The argument is an address, or a name with the
+// address in angle brackets, as in "Joe Smith <joe@example.com>".
+func (s *Smtp) VerifyAddress(dir Directory, args ...string) *Reply {
+	return s.verifyAddress("VRFY", dir, args...)
+}
+
+// ExpandAddress answers an EXPN event as VerifyAddress does VRFY: the
+// mailboxes of a directory expand to their canonical address.
+func (s *Smtp) ExpandAddress(dir Directory, args ...string) *Reply {
+	return s.verifyAddress("EXPN", dir, args...)
+}
+
+func (s *Smtp) verifyAddress(verb string, dir Directory, args ...string) *Reply {
+	if len(args) == 0 || strings.TrimSpace(args[0]) == "" {
+		return &Reply{0, 501, "5.5.4 Syntax: " + verb + " address"}
+	}
+	address := strings.TrimSpace(args[0])
+	if i := strings.LastIndex(address, "<"); i >= 0 {
+		address = address[i+1:]
+		if j := strings.Index(address, ">"); j >= 0 {
+			address = address[:j]
+		}
+	}
+	if address == "" || strings.ContainsAny(address, " \t<>") {
+		return &Reply{0, 501, "5.5.4 Syntax: " + verb + " address"}
+	}
+	entry, err := dir.Lookup(address)
+	if err != nil {
+		return &Reply{0, 451, "4.3.0 <" + address + ">: Temporary lookup failure"}
+	}
+	if entry == nil {
+		return &Reply{0, 550, "5.1.1 <" + address + ">: Recipient address rejected: User unknown"}
+	}
+	return &Reply{1, 250, "2.1.5 <" + entry.Address + ">"}
+}
+
+// DirectoryMailboxes returns the MailboxLookup of a Maildir or an Mbox for
+// the mailboxes of a directory: path gives the mailbox of a canonical
+// address, and the quota comes from the directory.
+func DirectoryMailboxes(dir Directory, path func(address string) string) MailboxLookup {
+	return func(address string) (*Mailbox, error) {
+		entry, err := dir.Lookup(address)
+		if entry == nil || err != nil {
+			return nil, err
+		}
+		return &Mailbox{Path: path(entry.Address), Quota: entry.Quota}, nil
+	}
+}
+
+// MapDirectory is a directory in memory. Keys are lower case addresses,
+// or @domain for the other addresses of a domain. An entry without
+// address is canonical as looked up.
+type MapDirectory map[string]*DirectoryEntry
+
+func (m MapDirectory) Lookup(address string) (*DirectoryEntry, error) {
+	key := strings.ToLower(address)
+	entry, ok := m[key]
+	if ok == false {
+		if i := strings.LastIndex(key, "@"); i >= 0 {
+			entry = m[key[i:]]
+		}
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	if entry.Address == "" {
+		return &DirectoryEntry{Address: address, Quota: entry.Quota}, nil
+	}
+	return entry, nil
+}
+
+// ParseQuota parses a quota in bytes, with an optional K, M or G suffix.
+func ParseQuota(value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("empty quota")
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(value[len(value)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid quota %q", value)
+	}
+	return n * multiplier, nil
+}
+
+// FileDirectory is a directory in a file in the Postfix format: an address
+// or @domain per line, then optionally its canonical address (- to keep
+// it) and its quota; # starts comments:
+//
+//	joe@example.com         -                       1G
+//	postmaster@example.com  joe@example.com
+//	@example.org            catchall@example.com
+//
+// The file is read again once changed.
+type FileDirectory struct {
+	Path string
+
+	mu      sync.Mutex
+	entries MapDirectory
+	modTime time.Time
+	size    int64
+}
+
+func (d *FileDirectory) Lookup(address string) (*DirectoryEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	info, err := os.Stat(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	if d.entries == nil || info.ModTime().Equal(d.modTime) == false || info.Size() != d.size {
+		entries, err := d.load()
+		if err != nil {
+			return nil, err
+		}
+		d.entries, d.modTime, d.size = entries, info.ModTime(), info.Size()
+	}
+	return d.entries.Lookup(address)
+}
+
+func (d *FileDirectory) load() (MapDirectory, error) {
+	f, err := os.Open(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := MapDirectory{}
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%s, line %d: too many fields", d.Path, n)
+		}
+		entry := &DirectoryEntry{}
+		if len(fields) > 1 && fields[1] != "-" {
+			entry.Address = fields[1]
+		}
+		if len(fields) > 2 {
+			if entry.Quota, err = ParseQuota(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s, line %d: %v", d.Path, n, err)
+			}
+		}
+		entries[strings.ToLower(fields[0])] = entry
+	}
+	return entries, scanner.Err()
+}
+
+// SQLDirectory is a directory in a database. The query takes the address
+// and returns the canonical address and the quota of its mailbox, e.g.
+// with SQLite:
+//
+//	SELECT address, quota FROM mailboxes WHERE address = ? AND active = 1
+//
+// A NULL quota is no limit.
+type SQLDirectory struct {
+	DB    *sql.DB
+	Query string
+}
+
+func (d *SQLDirectory) Lookup(address string) (*DirectoryEntry, error) {
+	var canonical string
+	var quota sql.NullInt64
+	err := d.DB.QueryRow(d.Query, address).Scan(&canonical, &quota)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &DirectoryEntry{Address: canonical, Quota: quota.Int64}, nil
+}
+
+// DirectoryCache caches the answers of a directory, the unknown addresses
+// too. Failures are not cached.
+type DirectoryCache struct {
+	Directory   Directory
+	TTL         time.Duration // how long mailboxes are cached (default 5m)
+	NegativeTTL time.Duration // how long unknown addresses are cached (default 1m)
+	Size        int           // number of addresses cached (default 10000)
+
+	mu    sync.Mutex
+	cache map[string]*directoryCacheItem
+}
+
+type directoryCacheItem struct {
+	entry   *DirectoryEntry
+	expires time.Time
+}
+
+func (c *DirectoryCache) Lookup(address string) (*DirectoryEntry, error) {
+	key := strings.ToLower(address)
+	now := time.Now()
+	c.mu.Lock()
+	if item, ok := c.cache[key]; ok && now.Before(item.expires) {
+		c.mu.Unlock()
+		return item.entry, nil
+	}
+	c.mu.Unlock()
+
+	entry, err := c.Directory.Lookup(address)
+	if err != nil {
+		return nil, err
+	}
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = 5 * time.Minute
+	}
+	if entry == nil {
+		ttl = c.NegativeTTL
+		if ttl == 0 {
+			ttl = time.Minute
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := c.Size
+	if size == 0 {
+		size = 10000
+	}
+	if c.cache == nil || len(c.cache) >= size {
+		// drop the expired items, or everything if that's not enough
+		for k, item := range c.cache {
+			if now.Before(item.expires) == false {
+				delete(c.cache, k)
+			}
+		}
+		if c.cache == nil || len(c.cache) >= size {
+			c.cache = map[string]*directoryCacheItem{}
+		}
+	}
+	c.cache[key] = &directoryCacheItem{entry, now.Add(ttl)}
+	return entry, nil
+}
+
+// Flush empties the cache.
+func (c *DirectoryCache) Flush() {
+	c.mu.Lock()
+	c.cache = nil
+	c.mu.Unlock()
+}
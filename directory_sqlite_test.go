@@ -0,0 +1,60 @@
+//go:build sqlite
+
+// The SQLDirectory test runs against SQLite, with github.com/mattn/go-sqlite3
+// installed:
+//
+//	go test -tags sqlite -run SQLDirectorySQLite
+
+package smtpserver
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLDirectorySQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "mailboxes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		`CREATE TABLE mailboxes (alias TEXT PRIMARY KEY, address TEXT NOT NULL, quota INTEGER, active INTEGER NOT NULL)`,
+		`INSERT INTO mailboxes VALUES ('joe@example.com', 'joe@example.com', 1024, 1)`,
+		`INSERT INTO mailboxes VALUES ('postmaster@example.com', 'joe@example.com', NULL, 1)`,
+		`INSERT INTO mailboxes VALUES ('jane@example.com', 'jane@example.com', NULL, 0)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	directory := &SQLDirectory{DB: db, Query: "SELECT address, quota FROM mailboxes WHERE alias = ? AND active = 1"}
+	if entry, err := directory.Lookup("joe@example.com"); err != nil || entry == nil || entry.Address != "joe@example.com" || entry.Quota != 1024 {
+		t.Errorf("Wrong entry: %+v %v", entry, err)
+	}
+	if entry, err := directory.Lookup("postmaster@example.com"); err != nil || entry == nil || entry.Address != "joe@example.com" || entry.Quota != 0 {
+		t.Errorf("Wrong entry: %+v %v", entry, err)
+	}
+	for _, address := range []string{"jane@example.com", "unknown@example.com"} {
+		if entry, err := directory.Lookup(address); err != nil || entry != nil {
+			t.Errorf("Wrong entry for %s: %+v %v", address, entry, err)
+		}
+	}
+
+	// a broken query is a temporary failure
+	broken := &SQLDirectory{DB: db, Query: "SELECT address, quota FROM aliases WHERE alias = ?"}
+	if entry, err := broken.Lookup("joe@example.com"); err == nil || entry != nil {
+		t.Errorf("Wrong entry: %+v %v", entry, err)
+	}
+}
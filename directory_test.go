@@ -0,0 +1,241 @@
+package smtpserver
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "mailboxes")
+	ioutil.WriteFile(path, []byte(`
+# mailboxes
+joe@example.com         -                       1G
+postmaster@example.com  joe@example.com
+@example.org            catchall@example.com
+`), 0644)
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	file := &FileDirectory{Path: path}
+	for _, test := range []struct{ address, rcpt, vrfy string }{
+		{"Joe@example.com", "1 -1 ", "1 250 2.1.5 <Joe@example.com>"},
+		{"<postmaster@example.com>", "1 -1 ", "1 250 2.1.5 <joe@example.com>"},
+		{"jane@example.org", "1 -1 ", "1 250 2.1.5 <catchall@example.com>"},
+		{"jane@example.com", "0 550 5.1.1 <jane@example.com>: Recipient address rejected: User unknown", "0 550 5.1.1 <jane@example.com>: Recipient address rejected: User unknown"},
+	} {
+		if reply := s.LookupRecipient(file, test.address); fmt.Sprintf("%d %d %s", reply.Success, reply.Code, reply.Message) != test.rcpt {
+			t.Errorf("Wrong RCPT reply for %s: %+v", test.address, reply)
+		}
+		if reply := s.VerifyAddress(file, test.address); fmt.Sprintf("%d %d %s", reply.Success, reply.Code, reply.Message) != test.vrfy {
+			t.Errorf("Wrong VRFY reply for %s: %+v", test.address, reply)
+		}
+	}
+	for _, test := range []struct{ argument, reply string }{
+		{"Joe Smith <joe@example.com>", "250 2.1.5 <joe@example.com>"},
+		{" <postmaster@example.com> ", "250 2.1.5 <joe@example.com>"},
+		{"Joe Smith", "501 5.5.4 Syntax: VRFY address"},
+		{"Joe <>", "501 5.5.4 Syntax: VRFY address"},
+	} {
+		if reply := s.VerifyAddress(file, test.argument); fmt.Sprintf("%d %s", reply.Code, reply.Message) != test.reply {
+			t.Errorf("Wrong VRFY reply for %q: %+v", test.argument, reply)
+		}
+	}
+	if reply := s.ExpandAddress(file, "postmaster@example.com"); fmt.Sprintf("%d %s", reply.Code, reply.Message) != "250 2.1.5 <joe@example.com>" {
+		t.Errorf("Wrong EXPN reply: %+v", reply)
+	}
+	if reply := s.ExpandAddress(file, ""); fmt.Sprintf("%d %s", reply.Code, reply.Message) != "501 5.5.4 Syntax: EXPN address" {
+		t.Errorf("Wrong EXPN reply: %+v", reply)
+	}
+	if entry, _ := file.Lookup("joe@example.com"); entry.Quota != 1<<30 {
+		t.Errorf("Wrong quota: %d", entry.Quota)
+	}
+
+	// the file is read again once changed
+	ioutil.WriteFile(path, []byte("jane@example.com\n"), 0644)
+	os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	if entry, _ := file.Lookup("jane@example.com"); entry == nil || entry.Address != "jane@example.com" {
+		t.Errorf("Directory not reloaded: %+v", entry)
+	}
+	if entry, _ := file.Lookup("joe@example.com"); entry != nil {
+		t.Errorf("Mailbox removed still found: %+v", entry)
+	}
+	ioutil.WriteFile(path, []byte("jane@example.com - lots\n"), 0644)
+	os.Chtimes(path, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute))
+	if reply := s.LookupRecipient(file, "jane@example.com"); reply.Code != 451 {
+		t.Errorf("Wrong reply with a broken file: %+v", reply)
+	}
+
+	for _, test := range []struct {
+		value string
+		quota int64
+	}{{"100", 100}, {"2k", 2048}, {"1M", 1 << 20}, {"", -1}, {"G", -1}, {"-1", -1}} {
+		if quota, err := ParseQuota(test.value); (err != nil && test.quota != -1) || (err == nil && quota != test.quota) {
+			t.Errorf("Wrong quota for %q: %d %v", test.value, quota, err)
+		}
+	}
+
+	// the quota of the directory applies to the mailboxes
+	mailboxes := DirectoryMailboxes(MapDirectory{"joe@example.com": &DirectoryEntry{Quota: 100}}, func(address string) string {
+		return filepath.Join(dir, address)
+	})
+	if mailbox, _ := mailboxes("joe@example.com"); mailbox == nil || mailbox.Path != filepath.Join(dir, "joe@example.com") || mailbox.Quota != 100 {
+		t.Errorf("Wrong mailbox: %+v", mailbox)
+	}
+	if mailbox, _ := mailboxes("jane@example.com"); mailbox != nil {
+		t.Errorf("Wrong mailbox: %+v", mailbox)
+	}
+}
+
+// FakeDirectory counts its lookups, and fails for down@.
+type FakeDirectory struct {
+	MapDirectory
+	Lookups int
+}
+
+func (d *FakeDirectory) Lookup(address string) (*DirectoryEntry, error) {
+	d.Lookups++
+	if address == "down@example.com" {
+		return nil, errors.New("directory unavailable")
+	}
+	return d.MapDirectory.Lookup(address)
+}
+
+func TestDirectoryCache(t *testing.T) {
+	fake := &FakeDirectory{MapDirectory: MapDirectory{"joe@example.com": &DirectoryEntry{}}}
+	cache := &DirectoryCache{Directory: fake, NegativeTTL: 50 * time.Millisecond}
+
+	for i := 0; i < 3; i++ {
+		if entry, _ := cache.Lookup("joe@example.com"); entry == nil {
+			t.Error("Mailbox not found")
+		}
+		if entry, _ := cache.Lookup("jane@example.com"); entry != nil {
+			t.Error("Unknown mailbox found")
+		}
+		if _, err := cache.Lookup("down@example.com"); err == nil {
+			t.Error("Failure not returned")
+		}
+	}
+	if fake.Lookups != 5 {
+		t.Errorf("Wrong lookups: %d", fake.Lookups)
+	}
+
+	// unknown addresses are looked up again sooner
+	time.Sleep(60 * time.Millisecond)
+	fake.MapDirectory["jane@example.com"] = &DirectoryEntry{}
+	if entry, _ := cache.Lookup("jane@example.com"); entry == nil {
+		t.Error("New mailbox not found")
+	}
+	cache.Lookup("joe@example.com")
+	if fake.Lookups != 6 {
+		t.Errorf("Wrong lookups: %d", fake.Lookups)
+	}
+}
+
+// fakeSQLDriver answers the queries of an SQLDirectory from a table of
+// address, canonical address and quota.
+type fakeSQLDriver struct {
+	Table [][]driver.Value
+}
+
+func (d *fakeSQLDriver) Open(name string) (driver.Conn, error) {
+	return &fakeSQLConn{d}, nil
+}
+
+type fakeSQLConn struct {
+	driver *fakeSQLDriver
+}
+
+func (c *fakeSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSQLStmt{c.driver}, nil
+}
+
+func (c *fakeSQLConn) Close() error {
+	return nil
+}
+
+func (c *fakeSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported")
+}
+
+type fakeSQLStmt struct {
+	driver *fakeSQLDriver
+}
+
+func (s *fakeSQLStmt) Close() error {
+	return nil
+}
+
+func (s *fakeSQLStmt) NumInput() int {
+	return 1
+}
+
+func (s *fakeSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *fakeSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &fakeSQLRows{}
+	for _, row := range s.driver.Table {
+		if row[0] == args[0] {
+			rows.rows = append(rows.rows, row[1:])
+		}
+	}
+	return rows, nil
+}
+
+type fakeSQLRows struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeSQLRows) Columns() []string {
+	return []string{"address", "quota"}
+}
+
+func (r *fakeSQLRows) Close() error {
+	return nil
+}
+
+func (r *fakeSQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestSQLDirectory(t *testing.T) {
+	sql.Register("fakedirectory", &fakeSQLDriver{Table: [][]driver.Value{
+		{"joe@example.com", "joe@example.com", int64(1024)},
+		{"postmaster@example.com", "joe@example.com", nil},
+	}})
+	db, err := sql.Open("fakedirectory", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dir := &SQLDirectory{DB: db, Query: "SELECT address, quota FROM mailboxes WHERE address = ?"}
+	if entry, err := dir.Lookup("joe@example.com"); err != nil || entry == nil || entry.Quota != 1024 {
+		t.Errorf("Wrong entry: %+v %v", entry, err)
+	}
+	if entry, err := dir.Lookup("postmaster@example.com"); err != nil || entry == nil || entry.Address != "joe@example.com" || entry.Quota != 0 {
+		t.Errorf("Wrong entry: %+v %v", entry, err)
+	}
+	if entry, err := dir.Lookup("jane@example.com"); err != nil || entry != nil {
+		t.Errorf("Wrong entry: %+v %v", entry, err)
+	}
+}
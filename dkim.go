@@ -0,0 +1,464 @@
+package smtpserver
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc6376
+// https://tools.ietf.org/html/rfc8463
+
+const (
+	DKIMPass      = "pass"
+	DKIMFail      = "fail"
+	DKIMNeutral   = "neutral"
+	DKIMPolicy    = "policy"
+	DKIMTempError = "temperror"
+	DKIMPermError = "permerror"
+)
+
+// DKIMVerification is the outcome of the verification of a signature.
+type DKIMVerification struct {
+	Result     string
+	Domain     string // d=
+	Selector   string // s=
+	Identifier string // i=
+	Algorithm  string // a=
+	Signature  string // b=, for Authentication-Results header.b
+	Err        error
+}
+
+// DKIMVerifier verifies the DKIM signatures of the received messages. It
+// is meant to be registered as a DATA filter:
+//
+//	s.AddFilter("DATA", verifier.Filter(&s.Smtp))
+type DKIMVerifier struct {
+	Resolver      Resolver // default DefaultResolver
+	MinKeyBits    int      // smallest RSA key accepted (default 1024)
+	MaxSignatures int      // signatures verified per message (default 5)
+}
+
+// TagList is a parsed tag=value list, as used by DKIM, DMARC and ARC.
+type TagList map[string]string
+
+// ParseTagList parses a tag=value list. The values are trimmed, folding
+// whitespace included.
+func ParseTagList(s string) (TagList, error) {
+	tags := make(TagList)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		kv := strings.SplitN(spec, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed tag %q", strings.TrimSpace(spec))
+		}
+		name := strings.TrimSpace(kv[0])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(kv[1])
+	}
+	return tags, nil
+}
+
+// StripWSP removes all the whitespace of a value, e.g. of base64 data.
+func StripWSP(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+var wspRe = regexp.MustCompile("[ \t]+")
+
+// CanonicalizeHeader canonicalizes a raw header field with the "simple" or
+// "relaxed" algorithm. The result is CRLF terminated.
+func CanonicalizeHeader(raw string, canon string) string {
+	if canon != "relaxed" {
+		return raw
+	}
+
+	i := strings.Index(raw, ":")
+	if i < 0 {
+		return raw
+	}
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+	value := raw[i+1:]
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = wspRe.ReplaceAllString(value, " ")
+	value = strings.Trim(value, " ")
+	return name + ":" + value + "\r\n"
+}
+
+// CanonicalizeBody canonicalizes a body with the "simple" or "relaxed"
+// algorithm.
+func CanonicalizeBody(body string, canon string) string {
+	body = ToCRLF(body)
+
+	if canon == "relaxed" {
+		lines := strings.Split(body, "\r\n")
+		for i, line := range lines {
+			line = wspRe.ReplaceAllString(line, " ")
+			lines[i] = strings.TrimRight(line, " ")
+		}
+		body = strings.Join(lines, "\r\n")
+	}
+
+	// ignore all empty lines at the end of the body
+	body = strings.TrimRight(body, "\r\n")
+	if body == "" {
+		if canon == "relaxed" {
+			return ""
+		}
+		return "\r\n"
+	}
+	return body + "\r\n"
+}
+
+// ParseCanonicalization parses a c= tag into its header and body
+// algorithms.
+func ParseCanonicalization(c string) (string, string, error) {
+	if c == "" {
+		return "simple", "simple", nil
+	}
+	parts := strings.SplitN(c, "/", 2)
+	header, body := parts[0], "simple"
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+	for _, algo := range []string{header, body} {
+		if algo != "simple" && algo != "relaxed" {
+			return "", "", fmt.Errorf("unknown canonicalization %q", c)
+		}
+	}
+	return header, body, nil
+}
+
+// SelectHeaders returns the header fields to sign or verify for the names
+// of a h= tag. Repeated names select the instances from the bottom up;
+// missing instances are skipped.
+func SelectHeaders(m *Message, names []string) []*MessageHeader {
+	used := make(map[string]int)
+	var selected []*MessageHeader
+	for _, name := range names {
+		key := strings.ToLower(strings.TrimSpace(name))
+		instances := m.GetAll(key)
+		n := used[key]
+		used[key] = n + 1
+		if n < len(instances) {
+			selected = append(selected, instances[len(instances)-1-n])
+		}
+	}
+	return selected
+}
+
+var signatureBRe = regexp.MustCompile("([;:][ \t\r\n]*b[ \t\r\n]*=)[^;]*")
+
+// StripSignature empties the b= tag of a raw signature header field.
+func StripSignature(raw string) string {
+	return signatureBRe.ReplaceAllString(raw, "$1")
+}
+
+// HeaderHash computes the hash of the signed header fields, the signature
+// header field with an empty b= tag coming last without its CRLF.
+func HeaderHash(headers []*MessageHeader, signature string, canon string) []byte {
+	h := sha256.New()
+	for _, header := range headers {
+		h.Write([]byte(CanonicalizeHeader(header.Raw, canon)))
+	}
+	h.Write([]byte(strings.TrimSuffix(CanonicalizeHeader(signature, canon), "\r\n")))
+	return h.Sum(nil)
+}
+
+// BodyHash computes the base64 hash of a canonicalized body, limited to
+// length bytes if length is not negative.
+func BodyHash(body string, canon string, length int64) (string, error) {
+	body = CanonicalizeBody(body, canon)
+	if length >= 0 {
+		if length > int64(len(body)) {
+			return "", fmt.Errorf("body length %d shorter than l=%d", len(body), length)
+		}
+		body = body[:length]
+	}
+	sum := sha256.Sum256([]byte(body))
+	return base64.StdEncoding.EncodeToString(sum[:]), nil
+}
+
+// DKIMPublicKey is a key published in a DKIM key record.
+type DKIMPublicKey struct {
+	Type   string // "rsa" or "ed25519"
+	RSA    *rsa.PublicKey
+	Ed     ed25519.PublicKey
+	Strict bool // t=s, i= must be in d=
+	Flags  []string
+}
+
+// LookupDKIMKey fetches the key of a selector. temporary tells whether an
+// error is a DNS failure worth retrying.
+func LookupDKIMKey(resolver Resolver, selector string, domain string) (key *DKIMPublicKey, temporary bool, err error) {
+	txts, err := resolver.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, IsNotFound(err) == false, err
+	}
+	if len(txts) == 0 {
+		return nil, false, fmt.Errorf("no key for %s._domainkey.%s", selector, domain)
+	}
+
+	tags, err := ParseTagList(strings.Join(txts, ""))
+	if err != nil {
+		return nil, false, err
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, false, fmt.Errorf("unsupported key version %q", v)
+	}
+	if h, ok := tags["h"]; ok && strings.Contains(h, "sha256") == false {
+		return nil, false, fmt.Errorf("key doesn't allow sha256")
+	}
+	if s, ok := tags["s"]; ok && s != "*" && strings.Contains(s, "email") == false {
+		return nil, false, fmt.Errorf("key not for email")
+	}
+
+	p, ok := tags["p"]
+	if ok == false {
+		return nil, false, fmt.Errorf("key without p= tag")
+	}
+	p = StripWSP(p)
+	if p == "" {
+		return nil, false, fmt.Errorf("key revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, false, fmt.Errorf("malformed key: %v", err)
+	}
+
+	key = &DKIMPublicKey{Type: "rsa"}
+	if k, ok := tags["k"]; ok {
+		key.Type = k
+	}
+	if t, ok := tags["t"]; ok {
+		for _, flag := range strings.Split(t, ":") {
+			flag = strings.TrimSpace(flag)
+			key.Flags = append(key.Flags, flag)
+			if flag == "s" {
+				key.Strict = true
+			}
+		}
+	}
+
+	switch key.Type {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			if pub, err = x509.ParsePKCS1PublicKey(data); err != nil {
+				return nil, false, fmt.Errorf("malformed RSA key: %v", err)
+			}
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if ok == false {
+			return nil, false, fmt.Errorf("not an RSA key")
+		}
+		key.RSA = rsaKey
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, false, fmt.Errorf("malformed ed25519 key")
+		}
+		key.Ed = ed25519.PublicKey(data)
+	default:
+		return nil, false, fmt.Errorf("unsupported key type %q", key.Type)
+	}
+	return key, false, nil
+}
+
+// VerifyHash checks a signature of a SHA-256 hash.
+func (k *DKIMPublicKey) VerifyHash(algorithm string, hash []byte, signature []byte) error {
+	switch algorithm {
+	case "rsa-sha256":
+		if k.RSA == nil {
+			return fmt.Errorf("key type doesn't match %s", algorithm)
+		}
+		return rsa.VerifyPKCS1v15(k.RSA, crypto.SHA256, hash, signature)
+	case "ed25519-sha256":
+		if k.Ed == nil {
+			return fmt.Errorf("key type doesn't match %s", algorithm)
+		}
+		if ed25519.Verify(k.Ed, hash, signature) == false {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", algorithm)
+}
+
+// Verify verifies all the DKIM signatures of a message.
+func (v *DKIMVerifier) Verify(data string) []*DKIMVerification {
+	m := ParseMessage(data)
+
+	max := v.MaxSignatures
+	if max == 0 {
+		max = 5
+	}
+
+	var results []*DKIMVerification
+	for _, header := range m.GetAll("DKIM-Signature") {
+		if len(results) >= max {
+			break
+		}
+		results = append(results, v.verifySignature(m, header))
+	}
+	return results
+}
+
+func (v *DKIMVerifier) verifySignature(m *Message, header *MessageHeader) *DKIMVerification {
+	result := &DKIMVerification{}
+	permerror := func(format string, args ...interface{}) *DKIMVerification {
+		result.Result = DKIMPermError
+		result.Err = fmt.Errorf(format, args...)
+		return result
+	}
+
+	tags, err := ParseTagList(header.Value())
+	if err != nil {
+		return permerror("%v", err)
+	}
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; ok == false {
+			return permerror("missing %s= tag", required)
+		}
+	}
+
+	result.Domain = strings.ToLower(tags["d"])
+	result.Selector = tags["s"]
+	result.Algorithm = tags["a"]
+	result.Signature = StripWSP(tags["b"])
+	result.Identifier = tags["i"]
+	if result.Identifier == "" {
+		result.Identifier = "@" + result.Domain
+	}
+
+	if tags["v"] != "1" {
+		return permerror("unsupported version %q", tags["v"])
+	}
+	if result.Algorithm != "rsa-sha256" && result.Algorithm != "ed25519-sha256" {
+		return permerror("unsupported algorithm %q", result.Algorithm)
+	}
+	if q, ok := tags["q"]; ok && strings.Contains(q, "dns/txt") == false {
+		return permerror("unsupported query method %q", q)
+	}
+
+	at := strings.LastIndex(result.Identifier, "@")
+	idomain := strings.ToLower(result.Identifier[at+1:])
+	if at < 0 || (idomain != result.Domain && strings.HasSuffix(idomain, "."+result.Domain) == false) {
+		return permerror("i= not within d=")
+	}
+
+	names := strings.Split(tags["h"], ":")
+	signsFrom := false
+	for _, name := range names {
+		if strings.EqualFold(strings.TrimSpace(name), "from") {
+			signsFrom = true
+		}
+	}
+	if signsFrom == false {
+		return permerror("From field not signed")
+	}
+
+	headerCanon, bodyCanon, err := ParseCanonicalization(tags["c"])
+	if err != nil {
+		return permerror("%v", err)
+	}
+
+	length := int64(-1)
+	if l, ok := tags["l"]; ok {
+		if length, err = strconv.ParseInt(l, 10, 64); err != nil || length < 0 {
+			return permerror("malformed l= tag")
+		}
+	}
+
+	if x, ok := tags["x"]; ok {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permerror("malformed x= tag")
+		}
+		if t, ok := tags["t"]; ok {
+			if timestamp, err := strconv.ParseInt(t, 10, 64); err == nil && expires < timestamp {
+				return permerror("x= before t=")
+			}
+		}
+		if time.Now().Unix() > expires {
+			return permerror("signature expired")
+		}
+	}
+
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	key, temporary, err := LookupDKIMKey(resolver, result.Selector, result.Domain)
+	if err != nil {
+		if temporary {
+			result.Result = DKIMTempError
+			result.Err = err
+			return result
+		}
+		return permerror("%v", err)
+	}
+	if key.Strict && idomain != result.Domain {
+		return permerror("i= must equal d= for this key")
+	}
+	minBits := v.MinKeyBits
+	if minBits == 0 {
+		minBits = 1024
+	}
+	if key.RSA != nil && key.RSA.N.BitLen() < minBits {
+		result.Result = DKIMPolicy
+		result.Err = fmt.Errorf("key too short")
+		return result
+	}
+
+	bodyHash, err := BodyHash(m.Body, bodyCanon, length)
+	if err != nil {
+		result.Result = DKIMFail
+		result.Err = err
+		return result
+	}
+	if bodyHash != StripWSP(tags["bh"]) {
+		result.Result = DKIMFail
+		result.Err = fmt.Errorf("body hash did not verify")
+		return result
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(result.Signature)
+	if err != nil {
+		return permerror("malformed b= tag")
+	}
+	hash := HeaderHash(SelectHeaders(m, names), StripSignature(header.Raw), headerCanon)
+	if err := key.VerifyHash(result.Algorithm, hash, signature); err != nil {
+		result.Result = DKIMFail
+		result.Err = err
+		return result
+	}
+
+	result.Result = DKIMPass
+	return result
+}
+
+// Filter returns a DATA filter verifying the signatures of the message.
+// The results are kept in DKIMResults for the callbacks.
+func (v *DKIMVerifier) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		s.DKIMResults = v.Verify(args[0])
+		return nil
+	}
+}
@@ -0,0 +1,131 @@
+package smtpserver
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// https://tools.ietf.org/html/rfc8463#appendix-A
+const dkimTestMessage = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+func TestDKIMVerify(t *testing.T) {
+	resolver := &FakeResolver{TXT: map[string][]string{
+		"brisbane._domainkey.football.example.com": []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="},
+	}}
+	verifier := &DKIMVerifier{Resolver: resolver}
+
+	results := verifier.Verify(dkimTestMessage)
+	if len(results) != 1 || results[0].Result != DKIMPass {
+		t.Fatalf("Wrong results: %+v", results[0])
+	}
+	if results[0].Domain != "football.example.com" || results[0].Selector != "brisbane" {
+		t.Errorf("Wrong signature identity: %+v", results[0])
+	}
+
+	tampered := verifier.Verify(dkimTestMessage[:len(dkimTestMessage)-7] + "Jim.\r\n")
+	if tampered[0].Result != DKIMFail {
+		t.Errorf("Tampered body verified: %+v", tampered[0])
+	}
+
+	missing := (&DKIMVerifier{Resolver: &FakeResolver{}}).Verify(dkimTestMessage)
+	if missing[0].Result != DKIMPermError {
+		t.Errorf("Signature verified without key: %+v", missing[0])
+	}
+}
+
+func TestDKIMCanonicalization(t *testing.T) {
+	if c := CanonicalizeHeader("SUBJect \t: A  folded\r\n\tvalue \r\n", "relaxed"); c != "subject:A folded value\r\n" {
+		t.Errorf("Wrong relaxed header: %q", c)
+	}
+	if c := CanonicalizeBody(" C \r\nD \t E\r\n\r\n\r\n", "relaxed"); c != " C\r\nD E\r\n" {
+		t.Errorf("Wrong relaxed body: %q", c)
+	}
+	if c := CanonicalizeBody(" C \r\nD \t E\r\n\r\n\r\n", "simple"); c != " C \r\nD \t E\r\n" {
+		t.Errorf("Wrong simple body: %q", c)
+	}
+	if c := CanonicalizeBody("", "simple"); c != "\r\n" {
+		t.Errorf("Wrong simple empty body: %q", c)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	os.MkdirAll(filepath.Join(dir, "example.com"), 0755)
+	pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	ioutil.WriteFile(filepath.Join(dir, "example.com", "rsa.pem"), pkcs1, 0600)
+
+	os.MkdirAll(filepath.Join(dir, "example.net"), 0755)
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	ioutil.WriteFile(filepath.Join(dir, "example.net", "ed.pem"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)
+
+	rsaPub, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	resolver := &FakeResolver{TXT: map[string][]string{
+		"rsa._domainkey.example.com": []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub)},
+		"ed._domainkey.example.net":  []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)},
+	}}
+
+	keys := &FileDKIMKeyStore{Dir: dir}
+	for _, canon := range []string{"relaxed/relaxed", "simple/simple"} {
+		signer := &DKIMSigner{Keys: keys, Canonicalization: canon, Oversign: []string{"Subject"}}
+
+		for _, domain := range []string{"example.com", "example.net"} {
+			key, err := keys.Key(domain)
+			if err != nil || key == nil {
+				t.Fatal("Key not loaded: ", err)
+			}
+
+			message := "From: Joe <joe@" + domain + ">\r\nTo: suzie@example.org\r\nSubject:  Hello\r\n\r\nHi.  \r\n\r\n"
+			signed, err := signer.Sign(message, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			results := (&DKIMVerifier{Resolver: resolver}).Verify(signed)
+			if len(results) != 1 || results[0].Result != DKIMPass {
+				t.Errorf("Signature of %s (%s) not verified: %+v", domain, canon, results[0])
+			}
+
+			added := "Subject: Spam\r\n" + signed
+			if results := (&DKIMVerifier{Resolver: resolver}).Verify(added); results[0].Result != DKIMFail {
+				t.Errorf("Oversigned field added without breaking the signature: %+v", results[0])
+			}
+		}
+	}
+
+	if key, _ := keys.Key("example.org"); key != nil {
+		t.Error("Key found for unsigned domain")
+	}
+}
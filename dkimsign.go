@@ -0,0 +1,265 @@
+package smtpserver
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DKIMKey is a private key used to sign the messages of a domain.
+type DKIMKey struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+}
+
+// Algorithm returns the a= tag of the signatures made with the key.
+func (k *DKIMKey) Algorithm() string {
+	if _, ok := k.Signer.(ed25519.PrivateKey); ok {
+		return "ed25519-sha256"
+	}
+	return "rsa-sha256"
+}
+
+// DKIMKeyStore gives the key to sign the messages of a domain with.
+type DKIMKeyStore interface {
+	// Key returns nil if the domain isn't signed.
+	Key(domain string) (*DKIMKey, error)
+}
+
+// FileDKIMKeyStore reads PEM keys from <Dir>/<domain>/<selector>.pem. When
+// a domain has several selectors, the first one in lexical order is used.
+// Keys are cached once loaded.
+type FileDKIMKeyStore struct {
+	Dir string
+
+	mu   sync.Mutex
+	keys map[string]*DKIMKey
+}
+
+func (f *FileDKIMKeyStore) Key(domain string) (*DKIMKey, error) {
+	domain = strings.ToLower(domain)
+	if domain == "" || strings.ContainsAny(domain, "/\\") || strings.HasPrefix(domain, ".") {
+		return nil, nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key, ok := f.keys[domain]; ok {
+		return key, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(f.Dir, domain, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(paths)
+
+	signer, err := LoadPrivateKey(paths[0])
+	if err != nil {
+		return nil, err
+	}
+	key := &DKIMKey{
+		Domain:   domain,
+		Selector: strings.TrimSuffix(filepath.Base(paths[0]), ".pem"),
+		Signer:   signer,
+	}
+
+	if f.keys == nil {
+		f.keys = make(map[string]*DKIMKey)
+	}
+	f.keys[domain] = key
+	return key, nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA (PKCS#1 or PKCS#8) or ed25519
+// (PKCS#8) private key.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("%s: unsupported key type", path)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+}
+
+var DefaultDKIMHeaders = []string{
+	"From", "Sender", "Reply-To", "Subject", "Date", "Message-ID", "To", "Cc",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+	"In-Reply-To", "References",
+}
+
+// DKIMSigner signs the messages of authenticated or trusted sessions with
+// the key of their From domain. It is meant to be registered as a DATA
+// filter:
+//
+//	s.AddFilter("DATA", signer.Filter(&s.Smtp))
+type DKIMSigner struct {
+	Keys             DKIMKeyStore
+	Headers          []string           // signed header fields (default DefaultDKIMHeaders)
+	Oversign         []string           // header fields signed once more than present
+	Canonicalization string             // default "relaxed/relaxed"
+	Expiration       time.Duration      // x= tag, none if zero
+	Trusted          func(s *Smtp) bool // sessions signed without being authenticated
+}
+
+// SignedHeaders returns the h= tag names for a message: each header field
+// present once per instance, plus once for the oversigned ones.
+func (d *DKIMSigner) SignedHeaders(m *Message) []string {
+	headers := d.Headers
+	if headers == nil {
+		headers = DefaultDKIMHeaders
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{"From"}, headers...) {
+		key := strings.ToLower(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		n := len(m.GetAll(name))
+		for _, o := range d.Oversign {
+			if strings.EqualFold(o, name) {
+				n++
+			}
+		}
+		for i := 0; i < n; i++ {
+			names = append(names, key)
+		}
+	}
+	return names
+}
+
+// Sign returns the message with a DKIM-Signature header field prepended.
+func (d *DKIMSigner) Sign(data string, key *DKIMKey) (string, error) {
+	m := ParseMessage(data)
+
+	canon := d.Canonicalization
+	if canon == "" {
+		canon = "relaxed/relaxed"
+	}
+	headerCanon, bodyCanon, err := ParseCanonicalization(canon)
+	if err != nil {
+		return "", err
+	}
+
+	bodyHash, err := BodyHash(m.Body, bodyCanon, -1)
+	if err != nil {
+		return "", err
+	}
+
+	names := d.SignedHeaders(m)
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + key.Algorithm(),
+		"c=" + headerCanon + "/" + bodyCanon,
+		"d=" + key.Domain,
+		"s=" + key.Selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+	}
+	if d.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(d.Expiration).Unix(), 10))
+	}
+	tags = append(tags, "h="+strings.Join(names, ":"), "bh="+bodyHash)
+
+	unsigned := "DKIM-Signature: " + strings.Join(tags, ";\r\n\t") + ";\r\n\tb="
+	hash := HeaderHash(SelectHeaders(m, names), unsigned, headerCanon)
+
+	signature, err := SignHash(key.Signer, hash)
+	if err != nil {
+		return "", err
+	}
+
+	raw := unsigned + FoldBase64(base64.StdEncoding.EncodeToString(signature)) + "\r\n"
+	m.Headers = append([]*MessageHeader{&MessageHeader{Name: "DKIM-Signature", Raw: raw}}, m.Headers...)
+	return m.String(), nil
+}
+
+// SignHash signs a SHA-256 hash as DKIM expects it for the key type.
+func SignHash(signer crypto.Signer, hash []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, hash, crypto.Hash(0))
+	}
+	return signer.Sign(rand.Reader, hash, crypto.SHA256)
+}
+
+// FoldBase64 folds base64 data into lines of at most 72 characters.
+func FoldBase64(s string) string {
+	var lines []string
+	for len(s) > 72 {
+		lines = append(lines, s[:72])
+		s = s[72:]
+	}
+	lines = append(lines, s)
+	return strings.Join(lines, "\r\n\t")
+}
+
+// Filter returns a DATA filter signing the messages of authenticated or
+// trusted sessions. Messages without a key for their From domain are left
+// untouched; signing errors reject the message temporarily.
+func (d *DKIMSigner) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		if s.Authenticated == false && (d.Trusted == nil || d.Trusted(s) == false) {
+			return nil
+		}
+
+		domain, err := FromDomain(ParseMessage(args[0]))
+		if err != nil {
+			return nil
+		}
+		key, err := d.Keys.Key(domain)
+		if err != nil {
+			return &Reply{0, 451, "4.3.0 Temporary failure while signing the message"}
+		}
+		if key == nil {
+			return nil
+		}
+
+		signed, err := d.Sign(args[0], key)
+		if err != nil {
+			return &Reply{0, 451, "4.3.0 Temporary failure while signing the message"}
+		}
+		args[0] = signed
+		return nil
+	}
+}
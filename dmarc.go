@@ -0,0 +1,372 @@
+package smtpserver
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc7489
+
+const (
+	DMARCPass      = "pass"
+	DMARCFail      = "fail"
+	DMARCNone      = "none"
+	DMARCTempError = "temperror"
+	DMARCPermError = "permerror"
+)
+
+// DMARCRecord is a parsed DMARC policy record.
+type DMARCRecord struct {
+	Domain          string   // where the record was found
+	Policy          string   // p=
+	SubdomainPolicy string   // sp=
+	Percent         int      // pct=
+	DKIMAlignment   string   // adkim=, "r" or "s"
+	SPFAlignment    string   // aspf=, "r" or "s"
+	ReportURIs      []string // rua=
+	FailureURIs     []string // ruf=
+}
+
+// DMARCCheck is the outcome of the evaluation of a message.
+type DMARCCheck struct {
+	Result      string
+	FromDomain  string
+	Record      *DMARCRecord
+	Policy      string // the policy which applies to the From domain
+	Disposition string // "none", "quarantine" or "reject" once pct= is applied
+	DKIMAligned bool
+	SPFAligned  bool
+	Err         error
+}
+
+// DMARCReportRecord is what an aggregate report needs to know about a
+// message.
+type DMARCReportRecord struct {
+	Time        time.Time
+	SourceIP    net.IP
+	HeaderFrom  string
+	Record      *DMARCRecord
+	Disposition string
+	DKIMAligned bool
+	SPFAligned  bool
+	DKIM        []*DKIMVerification
+	SPF         *SPFCheck
+}
+
+// DMARCReportStore collects the evaluations for aggregate reports.
+type DMARCReportStore interface {
+	Add(record *DMARCReportRecord) error
+}
+
+// MemoryDMARCReportStore keeps the report records in memory, by policy
+// domain.
+type MemoryDMARCReportStore struct {
+	mu      sync.Mutex
+	records map[string][]*DMARCReportRecord
+}
+
+func (m *MemoryDMARCReportStore) Add(record *DMARCReportRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.records == nil {
+		m.records = make(map[string][]*DMARCReportRecord)
+	}
+	m.records[record.Record.Domain] = append(m.records[record.Record.Domain], record)
+	return nil
+}
+
+// Flush returns and forgets the records of a policy domain.
+func (m *MemoryDMARCReportStore) Flush(domain string) []*DMARCReportRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	records := m.records[domain]
+	delete(m.records, domain)
+	return records
+}
+
+// Domains returns the policy domains having records.
+func (m *MemoryDMARCReportStore) Domains() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var domains []string
+	for domain := range m.records {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// DMARC applies the DMARC policies of the From domains. It uses the SPF and
+// DKIM results of the session, so it is meant to be registered as a DATA
+// filter after the DKIM verifier, SPF being registered as a MAIL filter:
+//
+//	s.AddFilter("DATA", verifier.Filter(&s.Smtp))
+//	s.AddFilter("DATA", dmarc.Filter(&s.Smtp))
+type DMARC struct {
+	Resolver         Resolver          // default DefaultResolver
+	PublicSuffixList *PublicSuffixList // default DefaultPublicSuffixList
+	Reports          DMARCReportStore  // optional
+	Enforce          bool              // reject messages whose disposition is "reject", hold those to quarantine
+	Random           func() int        // in [0, 100), for pct=
+	ErrorLog         *log.Logger       // report store errors (default the standard logger)
+}
+
+// ParseDMARCRecord parses the text of a DMARC record.
+func ParseDMARCRecord(txt string) (*DMARCRecord, error) {
+	if strings.HasPrefix(strings.TrimSpace(txt), "v=DMARC1") == false {
+		return nil, fmt.Errorf("not a DMARC record")
+	}
+	tags, err := ParseTagList(txt)
+	if err != nil {
+		return nil, err
+	}
+	if tags["v"] != "DMARC1" {
+		return nil, fmt.Errorf("not a DMARC record")
+	}
+
+	record := &DMARCRecord{Percent: 100, DKIMAlignment: "r", SPFAlignment: "r"}
+
+	if rua, ok := tags["rua"]; ok {
+		record.ReportURIs = splitURIs(rua)
+	}
+	if ruf, ok := tags["ruf"]; ok {
+		record.FailureURIs = splitURIs(ruf)
+	}
+
+	p, ok := tags["p"]
+	switch {
+	case ok && IsDMARCPolicy(p):
+		record.Policy = p
+	case len(record.ReportURIs) > 0:
+		// a record with a valid rua= but no valid p= counts as p=none
+		record.Policy = "none"
+	default:
+		return nil, fmt.Errorf("invalid policy %q", p)
+	}
+
+	record.SubdomainPolicy = record.Policy
+	if sp, ok := tags["sp"]; ok && IsDMARCPolicy(sp) {
+		record.SubdomainPolicy = sp
+	}
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			record.Percent = n
+		}
+	}
+	if tags["adkim"] == "s" {
+		record.DKIMAlignment = "s"
+	}
+	if tags["aspf"] == "s" {
+		record.SPFAlignment = "s"
+	}
+	return record, nil
+}
+
+func IsDMARCPolicy(p string) bool {
+	return p == "none" || p == "quarantine" || p == "reject"
+}
+
+func splitURIs(s string) []string {
+	var uris []string
+	for _, uri := range strings.Split(s, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+func (d *DMARC) psl() *PublicSuffixList {
+	if d.PublicSuffixList == nil {
+		return DefaultPublicSuffixList
+	}
+	return d.PublicSuffixList
+}
+
+// LookupRecord finds the record of a domain, falling back to its
+// organizational domain. It returns nil if there is none.
+func (d *DMARC) LookupRecord(domain string) (*DMARCRecord, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+
+	domains := []string{domain}
+	if org := d.psl().OrganizationalDomain(domain); org != domain {
+		domains = append(domains, org)
+	}
+
+	for _, name := range domains {
+		txts, err := resolver.LookupTXT("_dmarc." + name)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		var records []*DMARCRecord
+		for _, txt := range txts {
+			if record, err := ParseDMARCRecord(txt); err == nil {
+				record.Domain = name
+				records = append(records, record)
+			}
+		}
+		// several records are ignored as no record
+		if len(records) == 1 {
+			return records[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// Aligned tells whether two domains are aligned in the given mode.
+func (d *DMARC) Aligned(a string, b string, mode string) bool {
+	a = strings.TrimSuffix(strings.ToLower(a), ".")
+	b = strings.TrimSuffix(strings.ToLower(b), ".")
+	if mode == "s" {
+		return a == b
+	}
+	return d.psl().OrganizationalDomain(a) == d.psl().OrganizationalDomain(b)
+}
+
+// FromDomain extracts the domain of the RFC5322.From address of a message.
+func FromDomain(m *Message) (string, error) {
+	headers := m.GetAll("From")
+	if len(headers) != 1 {
+		return "", fmt.Errorf("%d From fields", len(headers))
+	}
+	addrs, err := mail.ParseAddressList(headers[0].Value())
+	if err != nil {
+		return "", err
+	}
+
+	domain := ""
+	for _, addr := range addrs {
+		at := strings.LastIndex(addr.Address, "@")
+		if at < 0 {
+			return "", fmt.Errorf("From address without domain")
+		}
+		d := strings.ToLower(addr.Address[at+1:])
+		if domain != "" && d != domain {
+			return "", fmt.Errorf("From addresses of several domains")
+		}
+		domain = d
+	}
+	return domain, nil
+}
+
+// Check evaluates a message against the policy of its From domain.
+func (d *DMARC) Check(data string, spf *SPFCheck, dkim []*DKIMVerification) *DMARCCheck {
+	check := &DMARCCheck{Result: DMARCNone, Disposition: "none"}
+
+	domain, err := FromDomain(ParseMessage(data))
+	if err != nil {
+		check.Result = DMARCPermError
+		check.Err = err
+		return check
+	}
+	check.FromDomain = domain
+
+	record, err := d.LookupRecord(domain)
+	if err != nil {
+		check.Result = DMARCTempError
+		check.Err = err
+		return check
+	}
+	if record == nil {
+		return check
+	}
+	check.Record = record
+
+	for _, result := range dkim {
+		if result.Result == DKIMPass && d.Aligned(result.Domain, domain, record.DKIMAlignment) {
+			check.DKIMAligned = true
+			break
+		}
+	}
+	if spf != nil && spf.Result == SPFPass && d.Aligned(spf.Domain, domain, record.SPFAlignment) {
+		check.SPFAligned = true
+	}
+
+	check.Policy = record.Policy
+	if record.Domain != domain {
+		check.Policy = record.SubdomainPolicy
+	}
+
+	if check.DKIMAligned || check.SPFAligned {
+		check.Result = DMARCPass
+		return check
+	}
+	check.Result = DMARCFail
+	check.Disposition = check.Policy
+
+	// messages out of the sample get the next less strict policy
+	if record.Percent < 100 {
+		random := d.Random
+		if random == nil {
+			random = func() int { return rand.Intn(100) }
+		}
+		if random() >= record.Percent {
+			switch check.Policy {
+			case "reject":
+				check.Disposition = "quarantine"
+			case "quarantine":
+				check.Disposition = "none"
+			}
+		}
+	}
+	return check
+}
+
+// Filter returns a DATA filter applying the policies. The outcome is kept
+// in DMARC for the callbacks; with Enforce, messages to quarantine are
+// held through Quarantine.
+func (d *DMARC) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		check := d.Check(args[0], s.SPFMailFrom, s.DKIMResults)
+		s.DMARC = check
+
+		if d.Reports != nil && check.Record != nil {
+			err := d.Reports.Add(&DMARCReportRecord{
+				Time:        time.Now(),
+				SourceIP:    s.GetRemoteIP(),
+				HeaderFrom:  check.FromDomain,
+				Record:      check.Record,
+				Disposition: check.Disposition,
+				DKIMAligned: check.DKIMAligned,
+				SPFAligned:  check.SPFAligned,
+				DKIM:        s.DKIMResults,
+				SPF:         s.SPFMailFrom,
+			})
+			if err != nil {
+				d.logf("dmarc: report of %s not recorded: %v", check.FromDomain, err)
+			}
+		}
+
+		if d.Enforce && check.Disposition == "reject" {
+			return &Reply{0, 550, fmt.Sprintf("5.7.1 Message rejected by DMARC policy of %s", check.FromDomain)}
+		}
+		if d.Enforce && check.Disposition == "quarantine" {
+			s.Quarantine = "DMARC policy of " + check.FromDomain
+		}
+		return nil
+	}
+}
+
+func (d *DMARC) logf(format string, args ...interface{}) {
+	if d.ErrorLog != nil {
+		d.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
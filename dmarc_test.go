@@ -0,0 +1,101 @@
+package smtpserver
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":         "example.com",
+		"mail.example.com":    "example.com",
+		"a.b.example.co.uk":   "example.co.uk",
+		"example.unknowntld":  "example.unknowntld",
+		"co.uk":               "co.uk",
+		"foo.bar.ck":          "foo.bar.ck",
+		"a.www.ck":            "www.ck",
+		"x.city.kawasaki.jp":  "city.kawasaki.jp",
+		"Mail.Example.COM.":   "example.com",
+		"a.github.io":         "a.github.io",
+		"b.github.io":         "b.github.io",
+		"joe.blogspot.com":    "joe.blogspot.com",
+		"mail.example.gov.br": "example.gov.br",
+	}
+	for domain, expected := range tests {
+		if org := DefaultPublicSuffixList.OrganizationalDomain(domain); org != expected {
+			t.Errorf("Wrong organizational domain of %s: %s", domain, org)
+		}
+	}
+}
+
+func TestDMARCCheck(t *testing.T) {
+	resolver := &FakeResolver{TXT: map[string][]string{
+		"_dmarc.example.com": []string{"v=DMARC1; p=reject; sp=quarantine; pct=50; rua=mailto:dmarc@example.com"},
+		"_dmarc.example.net": []string{"v=DMARC1; p=none; adkim=s"},
+	}}
+	dmarc := &DMARC{Resolver: resolver, Random: func() int { return 10 }}
+	message := "From: Joe <joe@example.com>\r\nSubject: test\r\n\r\nbody\r\n"
+
+	check := dmarc.Check(message, &SPFCheck{Result: SPFPass, Domain: "bounces.example.com"}, nil)
+	if check.Result != DMARCPass || check.SPFAligned != true {
+		t.Errorf("Aligned SPF failed: %+v", check)
+	}
+
+	check = dmarc.Check(message, &SPFCheck{Result: SPFPass, Domain: "example.org"}, []*DKIMVerification{&DKIMVerification{Result: DKIMFail, Domain: "example.com"}})
+	if check.Result != DMARCFail || check.Disposition != "reject" {
+		t.Errorf("Unaligned message passed: %+v", check)
+	}
+
+	dmarc.Random = func() int { return 60 }
+	check = dmarc.Check(message, nil, nil)
+	if check.Disposition != "quarantine" {
+		t.Errorf("pct= not applied: %+v", check)
+	}
+
+	check = dmarc.Check("From: joe@sub.example.com\r\n\r\n", nil, nil)
+	if check.Policy != "quarantine" || check.Record.Domain != "example.com" {
+		t.Errorf("Subdomain policy not applied: %+v", check)
+	}
+
+	check = dmarc.Check("From: joe@sub.example.net\r\n\r\n", nil, []*DKIMVerification{&DKIMVerification{Result: DKIMPass, Domain: "example.net"}})
+	if check.Result != DMARCFail {
+		t.Errorf("Strict DKIM alignment not applied: %+v", check)
+	}
+
+	if check = dmarc.Check("From: joe@example.org\r\n\r\n", nil, nil); check.Result != DMARCNone {
+		t.Errorf("Domain without policy checked: %+v", check)
+	}
+}
+
+// failingReportStore can't record reports.
+type failingReportStore struct{}
+
+func (failingReportStore) Add(record *DMARCReportRecord) error {
+	return errors.New("disk full")
+}
+
+func TestDMARCFilter(t *testing.T) {
+	resolver := &FakeResolver{TXT: map[string][]string{
+		"_dmarc.example.com": []string{"v=DMARC1; p=quarantine"},
+		"_dmarc.example.net": []string{"v=DMARC1; p=reject"},
+	}}
+	var logged bytes.Buffer
+	dmarc := &DMARC{Resolver: resolver, Enforce: true, Reports: failingReportStore{}, ErrorLog: log.New(&logged, "", 0)}
+	s := &Smtp{}
+	s.Init(&Option{})
+	filter := dmarc.Filter(s)
+
+	// quarantined messages are held when queued
+	if reply := filter("From: joe@example.com\r\n\r\nbody\r\n"); reply != nil || s.Quarantine != "DMARC policy of example.com" {
+		t.Errorf("Message not quarantined: %+v %q", reply, s.Quarantine)
+	}
+	if reply := filter("From: joe@example.net\r\n\r\nbody\r\n"); reply == nil || reply.Code != 550 {
+		t.Errorf("Message not rejected: %+v", reply)
+	}
+	if strings.Contains(logged.String(), "report of example.com not recorded: disk full") == false {
+		t.Errorf("Report error not logged: %q", logged.String())
+	}
+}
@@ -0,0 +1,253 @@
+package smtpserver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSBLZone is a DNS blocklist. Address zones (DNSBL) are queried with the
+// client address, domain zones (RHSBL) with the HELO name or the sender
+// domain.
+type DNSBLZone struct {
+	Zone   string
+	Domain bool     // RHSBL zone
+	Weight float64  // added to the score when listed (default 1)
+	Codes  []string // return codes that count, any 127.0.0.0/8 code but 127.255.255.0/24 if empty
+}
+
+// DNSBLResult holds the zones listing an address or a domain.
+type DNSBLResult struct {
+	Score  float64
+	Listed []string
+	Codes  map[string][]string
+}
+
+// DNSBL checks the clients against blocklists. The client is rejected when
+// the weights of the zones listing it add up to Threshold.
+type DNSBL struct {
+	Zones     []*DNSBLZone
+	Threshold float64       // default 1
+	Resolver  Resolver      // default DefaultResolver
+	CacheTTL  time.Duration // default 10m
+
+	mu    sync.Mutex
+	cache map[string]*dnsblCacheEntry
+	swept time.Time
+}
+
+type dnsblCacheEntry struct {
+	Addrs   []string
+	Err     error
+	Expires time.Time
+}
+
+// ReverseIP returns the name under which an address is listed: reversed
+// octets for IPv4, reversed nibbles for IPv6.
+func ReverseIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0x0f), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+func (d *DNSBL) CheckIP(ip net.IP) (*DNSBLResult, error) {
+	name := ReverseIP(ip)
+	if name == "" {
+		return &DNSBLResult{Codes: map[string][]string{}}, nil
+	}
+	return d.check(name, false)
+}
+
+func (d *DNSBL) CheckDomain(domain string) (*DNSBLResult, error) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return &DNSBLResult{Codes: map[string][]string{}}, nil
+	}
+	return d.check(domain, true)
+}
+
+// check queries all the zones of a kind. The first lookup error is returned
+// along with the result of the other zones.
+func (d *DNSBL) check(name string, domain bool) (*DNSBLResult, error) {
+	result := &DNSBLResult{Codes: make(map[string][]string)}
+	var firstErr error
+
+	for _, zone := range d.Zones {
+		if zone.Domain != domain {
+			continue
+		}
+
+		addrs, err := d.lookup(name + "." + zone.Zone)
+		if err != nil {
+			if IsNotFound(err) == false && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		var codes []string
+		refused := ""
+		for _, addr := range addrs {
+			if DNSBLErrorCode(addr) {
+				refused = addr
+				break
+			}
+			if zone.Matches(addr) {
+				codes = append(codes, addr)
+			}
+		}
+		if refused != "" {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s refused the query of %s (%s)", zone.Zone, name, refused)
+			}
+			continue
+		}
+		if len(codes) == 0 {
+			continue
+		}
+
+		weight := zone.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		result.Score += weight
+		result.Listed = append(result.Listed, zone.Zone)
+		result.Codes[zone.Zone] = codes
+	}
+
+	return result, firstErr
+}
+
+// DNSBLErrorCode tells whether an answer is in 127.255.255.0/24, where
+// zones such as Spamhaus report refused or rate limited queries.
+func DNSBLErrorCode(addr string) bool {
+	ip := net.ParseIP(addr).To4()
+	return ip != nil && ip[0] == 127 && ip[1] == 255 && ip[2] == 255
+}
+
+// Matches tells whether an answer counts as a listing. Error answers never
+// do.
+func (z *DNSBLZone) Matches(addr string) bool {
+	if DNSBLErrorCode(addr) {
+		return false
+	}
+	if len(z.Codes) == 0 {
+		ip := net.ParseIP(addr)
+		return ip != nil && ip.To4() != nil && ip.To4()[0] == 127
+	}
+	for _, code := range z.Codes {
+		if code == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DNSBL) lookup(name string) ([]string, error) {
+	ttl := d.CacheTTL
+	if ttl == 0 {
+		ttl = 10 * time.Minute
+	}
+	now := time.Now()
+
+	d.mu.Lock()
+	if d.cache == nil {
+		d.cache = make(map[string]*dnsblCacheEntry)
+	}
+	if entry, ok := d.cache[name]; ok && now.Before(entry.Expires) {
+		d.mu.Unlock()
+		return entry.Addrs, entry.Err
+	}
+	d.mu.Unlock()
+
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+	addrs, err := resolver.LookupHost(name)
+
+	// temporary failures and error answers aren't cached
+	refused := false
+	for _, addr := range addrs {
+		refused = refused || DNSBLErrorCode(addr)
+	}
+	if (err == nil && refused == false) || IsNotFound(err) {
+		d.mu.Lock()
+		if now.Sub(d.swept) >= sweepInterval {
+			d.swept = now
+			for k, entry := range d.cache {
+				if now.After(entry.Expires) {
+					delete(d.cache, k)
+				}
+			}
+		}
+		d.cache[name] = &dnsblCacheEntry{Addrs: addrs, Err: err, Expires: now.Add(ttl)}
+		d.mu.Unlock()
+	}
+
+	return addrs, err
+}
+
+func (d *DNSBL) threshold() float64 {
+	if d.Threshold == 0 {
+		return 1
+	}
+	return d.Threshold
+}
+
+// ConnectFilter returns a filter of the "banner" event rejecting listed
+// client addresses. Lookup errors let the client through.
+func (d *DNSBL) ConnectFilter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		ip := s.GetRemoteIP()
+		if ip == nil {
+			return nil
+		}
+		result, _ := d.CheckIP(ip)
+		if result.Score >= d.threshold() {
+			return &Reply{0, 554, fmt.Sprintf("5.7.1 Service unavailable; Client host [%s] blocked using %s", ip, strings.Join(result.Listed, ", "))}
+		}
+		return nil
+	}
+}
+
+// HeloFilter returns a filter of the "HELO" and "EHLO" events rejecting
+// listed HELO names.
+func (d *DNSBL) HeloFilter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		result, _ := d.CheckDomain(args[0])
+		if result.Score >= d.threshold() {
+			return &Reply{0, 550, fmt.Sprintf("5.7.1 Helo command rejected: %s blocked using %s", args[0], strings.Join(result.Listed, ", "))}
+		}
+		return nil
+	}
+}
+
+// SenderFilter returns a filter of the "MAIL" event rejecting listed sender
+// domains.
+func (d *DNSBL) SenderFilter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		i := strings.LastIndex(args[0], "@")
+		if i < 0 {
+			return nil
+		}
+		domain := args[0][i+1:]
+		result, _ := d.CheckDomain(domain)
+		if result.Score >= d.threshold() {
+			return &Reply{0, 550, fmt.Sprintf("5.7.1 Sender address rejected: %s blocked using %s", domain, strings.Join(result.Listed, ", "))}
+		}
+		return nil
+	}
+}
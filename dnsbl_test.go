@@ -0,0 +1,144 @@
+package smtpserver
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReverseIP(t *testing.T) {
+	if r := ReverseIP(net.ParseIP("192.0.2.99")); r != "99.2.0.192" {
+		t.Error("Wrong reversed IPv4: " + r)
+	}
+	if r := ReverseIP(net.ParseIP("2001:db8::1")); r != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Error("Wrong reversed IPv6: " + r)
+	}
+}
+
+func TestDNSBL(t *testing.T) {
+	resolver := &FakeResolver{Hosts: map[string][]string{
+		"2.0.0.127.zen.example":       []string{"127.0.0.2"},
+		"2.0.0.127.weak.example":      []string{"127.0.0.10"},
+		"2.0.0.127.codes.example":     []string{"127.0.0.4"},
+		"spammer.example.dbl.example": []string{"127.0.1.2"},
+	}}
+	dnsbl := &DNSBL{
+		Resolver:  resolver,
+		Threshold: 1.5,
+		Zones: []*DNSBLZone{
+			&DNSBLZone{Zone: "zen.example"},
+			&DNSBLZone{Zone: "weak.example", Weight: 0.5},
+			&DNSBLZone{Zone: "codes.example", Codes: []string{"127.0.0.2"}},
+			&DNSBLZone{Zone: "dbl.example", Domain: true},
+		},
+	}
+
+	result, err := dnsbl.CheckIP(net.ParseIP("127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Score != 1.5 || len(result.Listed) != 2 {
+		t.Errorf("Wrong result: %+v", result)
+	}
+
+	queries := resolver.Queries
+	dnsbl.CheckIP(net.ParseIP("127.0.0.2"))
+	if resolver.Queries != queries {
+		t.Error("Results not cached")
+	}
+
+	if result, _ := dnsbl.CheckIP(net.ParseIP("192.0.2.1")); result.Score != 0 {
+		t.Errorf("Unlisted address listed: %+v", result)
+	}
+
+	if result, _ := dnsbl.CheckDomain("Spammer.example"); result.Score != 1 || result.Listed[0] != "dbl.example" {
+		t.Errorf("Wrong domain result: %+v", result)
+	}
+
+	// expired answers are swept once in a while
+	dnsbl.CacheTTL = time.Millisecond
+	dnsbl.cache = nil
+	dnsbl.CheckIP(net.ParseIP("192.0.2.2"))
+	time.Sleep(5 * time.Millisecond)
+	dnsbl.CheckIP(net.ParseIP("192.0.2.3"))
+	if len(dnsbl.cache) != 6 {
+		t.Errorf("Cache swept at each miss: %d", len(dnsbl.cache))
+	}
+	time.Sleep(5 * time.Millisecond)
+	dnsbl.swept = time.Time{}
+	dnsbl.CheckIP(net.ParseIP("192.0.2.4"))
+	if len(dnsbl.cache) != 3 {
+		t.Errorf("Cache not swept: %d", len(dnsbl.cache))
+	}
+}
+
+func TestDNSBLErrorCodes(t *testing.T) {
+	resolver := &FakeResolver{Hosts: map[string][]string{
+		"2.0.0.127.zen.example":   []string{"127.255.255.254"},
+		"2.0.0.127.codes.example": []string{"127.255.255.252"},
+	}}
+	dnsbl := &DNSBL{
+		Resolver: resolver,
+		Zones: []*DNSBLZone{
+			&DNSBLZone{Zone: "zen.example"},
+			&DNSBLZone{Zone: "codes.example", Codes: []string{"127.255.255.252"}},
+		},
+	}
+
+	// a refused query is a lookup error, not a listing
+	result, err := dnsbl.CheckIP(net.ParseIP("127.0.0.2"))
+	if err == nil || result.Score != 0 || len(result.Listed) != 0 {
+		t.Errorf("Error answer counted as a listing: %+v %v", result, err)
+	}
+	queries := resolver.Queries
+	dnsbl.CheckIP(net.ParseIP("127.0.0.2"))
+	if resolver.Queries == queries {
+		t.Error("Error answer cached")
+	}
+}
+
+func TestBannerRefusal(t *testing.T) {
+	for _, test := range []struct {
+		filter   *Reply
+		callback *Reply
+		reply    string
+		close    bool
+	}{
+		{nil, &Reply{1, -1, ""}, "220 ", false},
+		// a failing callback doesn't close the session, unless it replies 421 or 5xx
+		{nil, &Reply{0, -1, ""}, "", false},
+		{nil, &Reply{0, 220, "Welcome anyway"}, "220 Welcome anyway\r\n", false},
+		{nil, &Reply{0, 421, "Go away"}, "421 Go away\r\n", true},
+		{nil, &Reply{0, 554, "Go away"}, "554 Go away\r\n", true},
+		// a filter refusing the client does
+		{&Reply{0, -1, ""}, nil, "", true},
+		{&Reply{0, 554, "5.7.1 Listed"}, nil, "554 5.7.1 Listed\r\n", true},
+	} {
+		server, client := net.Pipe()
+		replies := make(chan string, 1)
+		go func() {
+			line, _ := bufio.NewReader(client).ReadString('\n')
+			replies <- line
+		}()
+
+		s := &Smtp{}
+		s.Init(&Option{Socket: server})
+		s.BannerString = "mx.example.com Service ready"
+		if test.filter != nil {
+			s.AddFilter("banner", func(args ...string) *Reply { return test.filter })
+		}
+		if test.callback != nil {
+			s.SetCallback("banner", func(args ...string) *Reply { return test.callback })
+		}
+		if close := s.Banner(); close != test.close {
+			t.Errorf("Wrong close for %+v %+v: %v", test.filter, test.callback, close)
+		}
+		server.Close()
+		if reply := <-replies; strings.HasPrefix(reply, test.reply) == false || (test.reply == "" && reply != "") {
+			t.Errorf("Wrong reply for %+v %+v: %q", test.filter, test.callback, reply)
+		}
+		client.Close()
+	}
+}
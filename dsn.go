@@ -0,0 +1,375 @@
+package smtpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+// https://tools.ietf.org/html/rfc3461
+// https://tools.ietf.org/html/rfc3464
+
+// Actions of the recipients of a delivery status notification.
+const (
+	DSNFailed    = "failed"
+	DSNDelayed   = "delayed"
+	DSNDelivered = "delivered"
+	DSNRelayed   = "relayed"
+)
+
+// DSNParams are the DSN parameters of a transaction.
+type DSNParams struct {
+	Ret    string              // FULL or HDRS
+	EnvID  string              // envelope identifier, decoded
+	Notify map[string][]string // NOTIFY of the recipients
+	ORcpt  map[string]string   // ORCPT of the recipients, decoded
+}
+
+// Dsn is the DSN extension. The parameters of the transaction are kept in
+// DSNParams, and queued with the message by Enqueue.
+type Dsn struct {
+	ExtensionBase
+}
+
+func (d *Dsn) Init(parent *Esmtp) Extension {
+	d.Parent = parent
+	return d
+}
+
+func (d *Dsn) Keyword() string {
+	return "DSN"
+}
+
+func (d *Dsn) Option() []*SubOption {
+	return []*SubOption{
+		&SubOption{"MAIL", "RET", d.OptionMail},
+		&SubOption{"MAIL", "ENVID", d.OptionMail},
+		&SubOption{"RCPT", "NOTIFY", d.OptionRcpt},
+		&SubOption{"RCPT", "ORCPT", d.OptionRcpt},
+	}
+}
+
+func (d *Dsn) params() *DSNParams {
+	if d.Parent.DSNParams == nil {
+		d.Parent.DSNParams = &DSNParams{Notify: map[string][]string{}, ORcpt: map[string]string{}}
+	}
+	return d.Parent.DSNParams
+}
+
+func (d *Dsn) OptionMail(verb string, address string, key string, value string) {
+	switch strings.ToUpper(key) {
+	case "RET":
+		ret := strings.ToUpper(value)
+		if ret != "FULL" && ret != "HDRS" {
+			d.Parent.DSNParams = nil
+			d.Parent.RejectOption(501, "5.5.4 Invalid RET parameter")
+			return
+		}
+		d.params().Ret = ret
+	case "ENVID":
+		envid, err := DecodeXtext(value)
+		if err != nil {
+			d.Parent.DSNParams = nil
+			d.Parent.RejectOption(501, "5.5.4 Invalid ENVID parameter")
+			return
+		}
+		d.params().EnvID = envid
+	}
+}
+
+func (d *Dsn) OptionRcpt(verb string, address string, key string, value string) {
+	switch strings.ToUpper(key) {
+	case "NOTIFY":
+		notify, ok := parseNotify(value)
+		if ok == false {
+			delete(d.params().ORcpt, address)
+			d.Parent.RejectOption(501, "5.5.4 Invalid NOTIFY parameter")
+			return
+		}
+		d.params().Notify[address] = notify
+	case "ORCPT":
+		orcpt, err := DecodeXtext(value)
+		if err != nil {
+			delete(d.params().Notify, address)
+			d.Parent.RejectOption(501, "5.5.4 Invalid ORCPT parameter")
+			return
+		}
+		d.params().ORcpt[address] = orcpt
+	}
+}
+
+// parseNotify parses a NOTIFY value: NEVER alone, or any of SUCCESS,
+// FAILURE and DELAY, each at most once.
+func parseNotify(value string) ([]string, bool) {
+	notify := strings.Split(strings.ToUpper(value), ",")
+	seen := map[string]bool{}
+	for _, n := range notify {
+		switch n {
+		case "NEVER":
+			if len(notify) > 1 {
+				return nil, false
+			}
+		case "SUCCESS", "FAILURE", "DELAY":
+			if seen[n] {
+				return nil, false
+			}
+			seen[n] = true
+		default:
+			return nil, false
+		}
+	}
+	return notify, true
+}
+
+// EncodeXtext encodes a value as an xtext, escaping "+", "=" and the
+// characters outside of printable US-ASCII.
+func EncodeXtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '+' || c == '=' || c <= ' ' || c > '~' {
+			fmt.Fprintf(&b, "+%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// DecodeXtext decodes the +XX escapes of an xtext. As the values end up in
+// the headers of the notifications, anything decoding to other than
+// printable US-ASCII is an error.
+func DecodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '+' {
+			if i+2 >= len(s) {
+				return "", fmt.Errorf("truncated xtext escape in %q", s)
+			}
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid xtext escape in %q", s)
+			}
+			c = byte(n)
+			i += 2
+		}
+		if c < ' ' || c > '~' {
+			return "", fmt.Errorf("invalid character in xtext %q", s)
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// DSN builds the delivery status notifications sent to the senders of the
+// messages.
+type DSN struct {
+	Hostname    string // name of the reporting MTA
+	From        string // default MAILER-DAEMON@Hostname
+	ReturnLimit int    // larger messages are returned as headers only (default 50KB)
+}
+
+// DSNAction returns the action to report for a recipient.
+func DSNAction(rcpt *queue.Recipient) string {
+	switch {
+	case rcpt.Status == queue.Failed:
+		return DSNFailed
+	case rcpt.Status == queue.Delivered && rcpt.Relayed:
+		return DSNRelayed
+	case rcpt.Status == queue.Delivered:
+		return DSNDelivered
+	}
+	return DSNDelayed
+}
+
+// DSNRequested tells whether a recipient asked for the notification of an
+// action. Without NOTIFY, only failures are notified.
+func DSNRequested(rcpt *queue.Recipient, action string) bool {
+	if len(rcpt.Notify) == 0 {
+		return action == DSNFailed
+	}
+	for _, notify := range rcpt.Notify {
+		switch {
+		case notify == "FAILURE" && action == DSNFailed,
+			notify == "DELAY" && action == DSNDelayed,
+			notify == "SUCCESS" && (action == DSNDelivered || action == DSNRelayed):
+			return true
+		}
+	}
+	return false
+}
+
+var dsnStatusRe = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// DSNStatus returns the status code of a diagnostic, e.g. 5.1.1 for
+// "550 5.1.1 User unknown", or the class of its reply code.
+func DSNStatus(diagnostic string) string {
+	fields := strings.Fields(diagnostic)
+	if len(fields) > 1 && dsnStatusRe.MatchString(fields[1]) {
+		return fields[1]
+	}
+	if len(fields) > 0 && len(fields[0]) == 3 && strings.IndexByte("245", fields[0][0]) >= 0 {
+		return fields[0][:1] + ".0.0"
+	}
+	return "4.0.0"
+}
+
+func (g *DSN) returnLimit() int {
+	if g.ReturnLimit == 0 {
+		return 50 * 1024
+	}
+	return g.ReturnLimit
+}
+
+// Report builds the notification of the recipients of a message that
+// asked for it, or returns nil if none is due. A message from the null
+// reverse path, such as a notification, is never reported on.
+func (g *DSN) Report(env *queue.Envelope, recipients []*queue.Recipient, message []byte) []byte {
+	if env.From == "" {
+		return nil
+	}
+	var reported []*queue.Recipient
+	action := ""
+	for _, rcpt := range recipients {
+		a := DSNAction(rcpt)
+		if DSNRequested(rcpt, a) == false {
+			continue
+		}
+		reported = append(reported, rcpt)
+		if action == "" || a == DSNFailed || (a == DSNDelayed && action != DSNFailed) {
+			action = a
+		}
+	}
+	if len(reported) == 0 {
+		return nil
+	}
+
+	var random [8]byte
+	rand.Read(random[:])
+	id := hex.EncodeToString(random[:])
+	boundary := env.ID + "." + id + "/" + g.Hostname
+	from := g.From
+	if from == "" {
+		from = "MAILER-DAEMON@" + g.Hostname
+	}
+
+	subject := "Successful Mail Delivery Report"
+	text := "Your message was successfully delivered to the destination(s)\r\n" +
+		"listed below."
+	switch action {
+	case DSNFailed:
+		subject = "Undelivered Mail Returned to Sender"
+		text = "I'm sorry to have to inform you that your message could not\r\n" +
+			"be delivered to one or more recipients. It's attached below."
+	case DSNDelayed:
+		subject = "Delayed Mail (still being retried)"
+		text = "Your message could not be delivered yet to one or more recipients.\r\n" +
+			"The mail system will continue delivery attempts; you don't have to\r\n" +
+			"resend it."
+	}
+
+	var b strings.Builder
+	b.WriteString("From: Mail Delivery System <" + from + ">\r\n")
+	b.WriteString("To: <" + env.From + ">\r\n")
+	b.WriteString("Subject: " + subject + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("Message-ID: <" + id + "@" + g.Hostname + ">\r\n")
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: multipart/report; report-type=delivery-status;\r\n")
+	b.WriteString("\tboundary=\"" + boundary + "\"\r\n")
+	b.WriteString("\r\n")
+	b.WriteString("This is a MIME-encapsulated message.\r\n")
+
+	// human readable part
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	b.WriteString("Content-Description: Notification\r\n")
+	b.WriteString("Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	b.WriteString("This is the mail system at host " + g.Hostname + ".\r\n\r\n")
+	b.WriteString(text + "\r\n\r\n")
+	for _, rcpt := range reported {
+		b.WriteString("<" + rcpt.Address + ">: ")
+		if rcpt.RemoteMTA != "" && DSNAction(rcpt) != DSNDelayed {
+			b.WriteString("host " + rcpt.RemoteMTA + " said: ")
+		}
+		b.WriteString(rcpt.Diagnostic + "\r\n")
+	}
+
+	// machine readable part
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	b.WriteString("Content-Description: Delivery report\r\n")
+	b.WriteString("Content-Type: message/delivery-status\r\n\r\n")
+	b.WriteString("Reporting-MTA: dns; " + g.Hostname + "\r\n")
+	if env.EnvID != "" {
+		b.WriteString("Original-Envelope-Id: " + env.EnvID + "\r\n")
+	}
+	b.WriteString("Arrival-Date: " + env.Created.Format(time.RFC1123Z) + "\r\n")
+	for _, rcpt := range reported {
+		b.WriteString("\r\n")
+		b.WriteString("Final-Recipient: rfc822; " + rcpt.Address + "\r\n")
+		if rcpt.ORcpt != "" {
+			orcpt := rcpt.ORcpt
+			if i := strings.Index(orcpt, ";"); i >= 0 {
+				orcpt = orcpt[:i] + "; " + strings.TrimSpace(orcpt[i+1:])
+			}
+			b.WriteString("Original-Recipient: " + orcpt + "\r\n")
+		}
+		b.WriteString("Action: " + DSNAction(rcpt) + "\r\n")
+		status := DSNStatus(rcpt.Diagnostic)
+		if rcpt.Diagnostic == "" && rcpt.Status == queue.Delivered {
+			status = "2.0.0"
+		}
+		b.WriteString("Status: " + status + "\r\n")
+		if rcpt.RemoteMTA != "" {
+			b.WriteString("Remote-MTA: dns; " + rcpt.RemoteMTA + "\r\n")
+			b.WriteString("Diagnostic-Code: smtp; " + rcpt.Diagnostic + "\r\n")
+		}
+	}
+
+	// the message, or its header with RET=HDRS, for successes and delays
+	// unless RET=FULL, and above the return limit
+	data := ToCRLF(string(message))
+	full := env.Ret == "FULL" || (env.Ret == "" && action == DSNFailed)
+	if len(data) > g.returnLimit() {
+		full = false
+	}
+	b.WriteString("\r\n--" + boundary + "\r\n")
+	if full {
+		b.WriteString("Content-Description: Undelivered Message\r\n")
+		b.WriteString("Content-Type: message/rfc822\r\n\r\n")
+	} else {
+		if i := strings.Index(data, "\r\n\r\n"); i >= 0 {
+			data = data[:i+2]
+		}
+		b.WriteString("Content-Description: Undelivered Message Headers\r\n")
+		b.WriteString("Content-Type: text/rfc822-headers\r\n\r\n")
+	}
+	b.WriteString(data)
+	if strings.HasSuffix(data, "\r\n") == false {
+		b.WriteString("\r\n")
+	}
+	b.WriteString("\r\n--" + boundary + "--\r\n")
+	return []byte(b.String())
+}
+
+// Notify queues the notification of the recipients of a message, from the
+// null reverse path. The recipients are marked as notified.
+func (g *DSN) Notify(q *queue.Queue, env *queue.Envelope, recipients []*queue.Recipient, message []byte) error {
+	if report := g.Report(env, recipients, message); report != nil {
+		_, err := q.Enqueue(&queue.Envelope{Recipients: queue.Recipients([]string{env.From})}, report)
+		if err != nil {
+			return fmt.Errorf("queueing the notification: %v", err)
+		}
+	}
+	for _, rcpt := range recipients {
+		rcpt.Notified = true
+	}
+	return nil
+}
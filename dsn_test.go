@@ -0,0 +1,367 @@
+package smtpserver
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+func TestDSNParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Esmtp{}
+	e.Init(&Option{})
+	e.Register(&Dsn{})
+	e.SetExtendMode(true)
+	e.ReversePath = "from@example.net"
+	if e.HandleOptions("MAIL", "from@example.net", []string{"RET=HDRS", "ENVID=QQ+2B314"}) == false ||
+		e.HandleOptions("RCPT", "a@example.org", []string{"NOTIFY=SUCCESS,DELAY", "ORCPT=rfc822;A+2Bb@example.org"}) == false {
+		t.Fatal("DSN options refused")
+	}
+	e.ForwardPath = []string{"a@example.org", "b@example.org"}
+
+	reply := e.Enqueue(q, "Subject: Hi\r\n\r\nHello.\r\n")
+	entry, err := q.Get(strings.TrimPrefix(reply.Message, "2.0.0 Ok: queued as "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Ret != "HDRS" || entry.EnvID != "QQ+314" ||
+		strings.Join(entry.Recipients[0].Notify, ",") != "SUCCESS,DELAY" || entry.Recipients[0].ORcpt != "rfc822;A+b@example.org" ||
+		entry.Recipients[1].Notify != nil {
+		t.Errorf("Wrong DSN parameters: %+v %+v %+v", entry.Envelope, entry.Recipients[0], entry.Recipients[1])
+	}
+}
+
+func TestDSNParamsInjection(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	replies := make(chan string, 2)
+	go func() {
+		reader := bufio.NewReader(client)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			replies <- line
+		}
+	}()
+
+	e := &Esmtp{}
+	e.Init(&Option{Socket: server})
+	e.Register(&Dsn{})
+	e.SetExtendMode(true)
+	if e.HandleOptions("MAIL", "from@example.net", []string{"ENVID=QQ314+0D+0ASubject:+20forged"}) {
+		t.Error("ENVID with a line break accepted")
+	}
+	if reply := <-replies; reply != "501 5.5.4 Invalid ENVID parameter\r\n" || e.DSNParams != nil {
+		t.Errorf("Wrong reply: %q %+v", reply, e.DSNParams)
+	}
+	if e.HandleOptions("RCPT", "a@example.org", []string{"NOTIFY=SUCCESS", "ORCPT=rfc822;a@example.org+00"}) {
+		t.Error("ORCPT with a NUL accepted")
+	}
+	if reply := <-replies; reply != "501 5.5.4 Invalid ORCPT parameter\r\n" || len(e.DSNParams.Notify) != 0 {
+		t.Errorf("Wrong reply: %q %+v", reply, e.DSNParams)
+	}
+
+	if e.HandleOptions("MAIL", "from@example.net", []string{"RET=FOO"}) {
+		t.Error("RET=FOO accepted")
+	}
+	if reply := <-replies; reply != "501 5.5.4 Invalid RET parameter\r\n" || e.DSNParams != nil {
+		t.Errorf("Wrong reply: %q %+v", reply, e.DSNParams)
+	}
+	for _, bad := range []string{"NEVER,SUCCESS", "SUCCESS,SUCCESS", "ALWAYS", ""} {
+		if e.HandleOptions("RCPT", "a@example.org", []string{"ORCPT=rfc822;a@example.org", "NOTIFY=" + bad}) {
+			t.Errorf("NOTIFY=%s accepted", bad)
+		}
+		if reply := <-replies; reply != "501 5.5.4 Invalid NOTIFY parameter\r\n" || len(e.DSNParams.ORcpt) != 0 || len(e.DSNParams.Notify) != 0 {
+			t.Errorf("Wrong reply: %q %+v", reply, e.DSNParams)
+		}
+	}
+	if e.HandleOptions("RCPT", "a@example.org", []string{"NOTIFY=never"}) == false || strings.Join(e.DSNParams.Notify["a@example.org"], ",") != "NEVER" {
+		t.Errorf("NOTIFY=never refused: %+v", e.DSNParams)
+	}
+
+	if xtext := EncodeXtext("QQ 3+1=4\xe9"); xtext != "QQ+203+2B1+3D4+E9" {
+		t.Errorf("Wrong xtext: %q", xtext)
+	}
+	for _, bad := range []string{"a+0D", "a+7F", "a+", "a+G1", "a\nb"} {
+		if _, err := DecodeXtext(bad); err == nil {
+			t.Errorf("Invalid xtext %q accepted", bad)
+		}
+	}
+}
+
+func TestDSNReport(t *testing.T) {
+	g := &DSN{Hostname: "mx.example.com"}
+	env := &queue.Envelope{
+		ID:      "ABC",
+		From:    "from@example.net",
+		EnvID:   "QQ314",
+		Created: time.Now(),
+		Recipients: []*queue.Recipient{
+			&queue.Recipient{Address: "a@example.org", Status: queue.Failed, Diagnostic: "550 5.1.1 User unknown", RemoteMTA: "mx.example.org"},
+			&queue.Recipient{Address: "b@example.org", Status: queue.Delivered, Diagnostic: "250 2.0.0 Ok", RemoteMTA: "mx.example.org", Relayed: true},
+			&queue.Recipient{Address: "c@example.org", Status: queue.Delivered, Notify: []string{"SUCCESS"}, ORcpt: "rfc822;C@example.org"},
+			&queue.Recipient{Address: "d@example.org", Status: queue.Failed, Notify: []string{"NEVER"}},
+		},
+	}
+	message := []byte("Subject: Hi\r\n\r\nHello.\r\n")
+
+	report := string(g.Report(env, env.Recipients, message))
+	for _, expected := range []string{
+		"From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\r\n",
+		"To: <from@example.net>\r\n",
+		"Subject: Undelivered Mail Returned to Sender\r\n",
+		"Content-Type: multipart/report; report-type=delivery-status;",
+		"<a@example.org>: host mx.example.org said: 550 5.1.1 User unknown\r\n",
+		"Reporting-MTA: dns; mx.example.com\r\nOriginal-Envelope-Id: QQ314\r\n",
+		"Final-Recipient: rfc822; a@example.org\r\nAction: failed\r\nStatus: 5.1.1\r\nRemote-MTA: dns; mx.example.org\r\nDiagnostic-Code: smtp; 550 5.1.1 User unknown\r\n",
+		"Final-Recipient: rfc822; c@example.org\r\nOriginal-Recipient: rfc822; C@example.org\r\nAction: delivered\r\nStatus: 2.0.0\r\n",
+		"Content-Type: message/rfc822\r\n\r\nSubject: Hi\r\n\r\nHello.\r\n",
+	} {
+		if strings.Contains(report, expected) == false {
+			t.Errorf("Report without %q:\n%s", expected, report)
+		}
+	}
+	// successes are reported on request only, NEVER reports nothing
+	if strings.Contains(report, "b@example.org") || strings.Contains(report, "d@example.org") {
+		t.Errorf("Unrequested notifications:\n%s", report)
+	}
+
+	// RET=HDRS returns the header only
+	env.Ret = "HDRS"
+	report = string(g.Report(env, env.Recipients[:1], message))
+	if strings.Contains(report, "Content-Type: text/rfc822-headers\r\n\r\nSubject: Hi\r\n\r\n--") == false {
+		t.Errorf("Message returned with RET=HDRS:\n%s", report)
+	}
+
+	if g.Report(env, env.Recipients[1:2], message) != nil {
+		t.Error("Report without requested notifications")
+	}
+	env.From = ""
+	if g.Report(env, env.Recipients, message) != nil {
+		t.Error("Report of a notification")
+	}
+
+	for diagnostic, status := range map[string]string{
+		"550 5.1.1 User unknown":                 "5.1.1",
+		"451 Try again later":                    "4.0.0",
+		"451 4.4.7 Message expired in the queue": "4.4.7",
+		"":                                       "4.0.0",
+	} {
+		if DSNStatus(diagnostic) != status {
+			t.Errorf("Wrong status for %q: %s", diagnostic, DSNStatus(diagnostic))
+		}
+	}
+}
+
+func TestDeliveryDSN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := &FakeLocalAgent{Mailboxes: map[string][]string{"joe@local.example": nil, "broken@local.example": nil}}
+	d := &Delivery{
+		Queue:        q,
+		Hostname:     "mx.example.com",
+		Transports:   TransportMap{"*": &Transport{Kind: TransportLocal}},
+		Local:        local,
+		DSN:          &DSN{Hostname: "mx.example.com"},
+		DelayWarning: time.Nanosecond,
+	}
+
+	recipients := queue.Recipients([]string{"joe@local.example", "nobody@local.example", "broken@local.example"})
+	recipients[2].Notify = []string{"FAILURE", "DELAY"}
+	id, err := q.Enqueue(&queue.Envelope{From: "from@example.net", Recipients: recipients}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := func() []*queue.Entry {
+		var entries []*queue.Entry
+		list, _ := q.List(queue.Incoming)
+		for _, e := range list {
+			if e.ID != id {
+				entries = append(entries, e)
+			}
+		}
+		return entries
+	}
+	if err := d.Deliver(id); err != nil {
+		t.Fatal(err)
+	}
+
+	// a bounce for nobody@, a delay warning for broken@ once
+	bounces := reports()
+	if len(bounces) != 2 {
+		t.Fatalf("Wrong notifications: %+v", bounces)
+	}
+	for _, bounce := range bounces {
+		if bounce.From != "" || len(bounce.Recipients) != 1 || bounce.Recipients[0].Address != "from@example.net" {
+			t.Errorf("Wrong notification envelope: %+v", bounce.Envelope)
+		}
+	}
+	entry, _ := q.Get(id)
+	if entry.Recipients[1].Notified == false || entry.Delayed == false {
+		t.Errorf("Notifications not recorded: %+v", entry.Envelope)
+	}
+
+	// notifications are bounced to nobody
+	for _, bounce := range bounces {
+		if err := d.Deliver(bounce.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reports()) != 0 {
+		t.Errorf("Notification of a notification: %+v", reports())
+	}
+}
+
+func TestDeliveryDSNRelay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dsn := range []bool{false, true} {
+		mta := StartTestMTA()
+		if dsn {
+			mta = StartTestMTA("DSN")
+		}
+		resolver := &FakeResolver{Hosts: map[string][]string{"example.org": []string{"127.0.0.1"}}}
+		d := &Delivery{Queue: q, Resolver: resolver, Hostname: "mx.example.com", Port: mta.Port(), Timeout: time.Second}
+
+		recipients := queue.Recipients([]string{"a@example.org", "b@example.org", "temp@example.org"})
+		recipients[0].Notify = []string{"SUCCESS", "FAILURE"}
+		recipients[0].ORcpt = "rfc822;a+b@example.org"
+		id, err := q.Enqueue(&queue.Envelope{From: "from@example.net", Recipients: recipients, Ret: "HDRS", EnvID: "QQ 314"}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Deliver(id); err != nil {
+			t.Fatal(err)
+		}
+		mta.Listener.Close()
+
+		entry, err := q.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the next hop reports on the recipients if it speaks DSN
+		if entry.Recipients[0].Status != queue.Delivered || entry.Recipients[0].Relayed == dsn {
+			t.Errorf("Wrong outcome with DSN %v: %+v", dsn, entry.Recipients[0])
+		}
+		mta.mu.Lock()
+		params := mta.Params
+		mta.mu.Unlock()
+		if len(params) != 1 {
+			t.Fatalf("Wrong messages: %+v", params)
+		}
+		if dsn == false {
+			if params[0] != nil {
+				t.Errorf("DSN parameters sent without DSN: %+v", params[0])
+			}
+			continue
+		}
+		if params[0] == nil || params[0].Ret != "HDRS" || params[0].EnvID != "QQ 314" ||
+			strings.Join(params[0].Notify["a@example.org"], ",") != "SUCCESS,FAILURE" || params[0].ORcpt["a@example.org"] != "rfc822;a+b@example.org" ||
+			params[0].Notify["b@example.org"] != nil || params[0].ORcpt["b@example.org"] != "" {
+			t.Errorf("Wrong DSN parameters: %+v", params[0])
+		}
+	}
+}
+
+// failingAgent refuses the recipients, after running Hook.
+type failingAgent struct {
+	Hook func()
+}
+
+func (a *failingAgent) Deliver(from string, recipients []string, message []byte) []error {
+	a.Hook()
+	results := make([]error, len(recipients))
+	for i := range results {
+		results[i] = &ClientReply{550, []string{"5.1.1 No such mailbox"}}
+	}
+	return results
+}
+
+func TestDeliveryDSNSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the messages can't be written while the delivery runs
+	data := filepath.Join(dir, "data")
+	broken := &failingAgent{Hook: func() {
+		os.Rename(data, data+".off")
+		ioutil.WriteFile(data, nil, 0600)
+	}}
+	d := &Delivery{
+		Queue:      q,
+		Hostname:   "mx.example.com",
+		Transports: TransportMap{"*": &Transport{Kind: TransportLocal}},
+		Local:      broken,
+		DSN:        &DSN{Hostname: "mx.example.com"},
+	}
+	id, err := q.Enqueue(&queue.Envelope{From: "from@example.net", Recipients: queue.Recipients([]string{"nobody@local.example"})}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(id); err == nil {
+		t.Error("Lost notification not reported")
+	}
+	os.Remove(data)
+	os.Rename(data+".off", data)
+
+	// the message is kept until its bounce is queued
+	entry, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.State != queue.Deferred || entry.Recipients[0].Status != queue.Failed || entry.Recipients[0].Notified {
+		t.Errorf("Wrong entry: %+v %+v", entry.Envelope, entry.Recipients[0])
+	}
+	broken.Hook = func() {}
+	if err := d.Deliver(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Get(id); err != queue.ErrNotFound {
+		t.Errorf("Message not completed: %v", err)
+	}
+	if list, _ := q.List(queue.Incoming); len(list) != 1 || list[0].From != "" {
+		t.Errorf("Wrong notifications: %+v", list)
+	}
+}
@@ -0,0 +1,57 @@
+package smtpserver
+
+import (
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+// Enqueue spools the message of a DATA event in q with the envelope of the
+// session, and replies with its queue ID. It is meant to be called from
+// the DATA callback:
+//
+//	s.SetCallback("DATA", func(args ...string) *Reply {
+//		return s.Enqueue(q, args...)
+//	})
+//
+// With LMTP, the DATA event of each recipient queues the message for that
+// recipient alone. A message held by a filter (Quarantine) is queued on
+// hold. The DSN parameters of the transaction are queued with it.
+func (s *Smtp) Enqueue(q *queue.Queue, args ...string) *Reply {
+	recipients := s.GetRecipients()
+	if len(args) > 1 {
+		recipients = args[1:]
+	}
+	if s.CountRecipients() == 0 || len(recipients) == 0 {
+		return &Reply{0, 554, "5.5.1 Error: no valid recipients"}
+	}
+
+	env := s.envelope(recipients)
+	id, err := q.Enqueue(env, []byte(args[0]))
+	if err != nil {
+		return &Reply{0, 451, "4.3.0 Error: queue file write error"}
+	}
+	return &Reply{1, 250, "2.0.0 Ok: queued as " + id}
+}
+
+// envelope returns the envelope of the message of the session for the
+// given recipients, with the DSN parameters of the transaction.
+func (s *Smtp) envelope(recipients []string) *queue.Envelope {
+	env := &queue.Envelope{
+		From:       s.senderAddress(),
+		Recipients: queue.Recipients(recipients),
+		Helo:       s.HeloName,
+		AuthUser:   s.AuthUser,
+		HoldReason: s.Quarantine,
+	}
+	if ip := s.GetRemoteIP(); ip != nil {
+		env.ClientIP = ip.String()
+	}
+	if s.DSNParams != nil {
+		env.Ret = s.DSNParams.Ret
+		env.EnvID = s.DSNParams.EnvID
+		for _, rcpt := range env.Recipients {
+			rcpt.Notify = s.DSNParams.Notify[rcpt.Address]
+			rcpt.ORcpt = s.DSNParams.ORcpt[rcpt.Address]
+		}
+	}
+	return env
+}
@@ -0,0 +1,53 @@
+package smtpserver
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+func TestEnqueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.HeloName = "client.example.net"
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"a@example.org", "b@example.org"}
+
+	reply := s.Enqueue(q, "Subject: Hi\r\n\r\nHello.\r\n")
+	if reply.Success == 0 || reply.Code != 250 || strings.HasPrefix(reply.Message, "2.0.0 Ok: queued as ") == false {
+		t.Fatalf("Wrong reply: %+v", reply)
+	}
+	entry, err := q.Get(strings.TrimPrefix(reply.Message, "2.0.0 Ok: queued as "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.From != "from@example.net" || len(entry.Recipients) != 2 || entry.Helo != "client.example.net" || entry.State != queue.Incoming {
+		t.Errorf("Wrong entry: %+v", entry)
+	}
+
+	// LMTP queues per recipient; quarantined messages are held
+	s.Quarantine = "suspicious"
+	reply = s.Enqueue(q, "Subject: Hi\r\n\r\nHello.\r\n", "b@example.org")
+	entry, _ = q.Get(strings.TrimPrefix(reply.Message, "2.0.0 Ok: queued as "))
+	if entry == nil || len(entry.Recipients) != 1 || entry.State != queue.Hold {
+		t.Errorf("Wrong entry: %+v", entry)
+	}
+
+	s.ForwardPath = []string{"1"}
+	if reply := s.Enqueue(q, "x"); reply.Code != 554 {
+		t.Errorf("Message without recipients queued: %+v", reply)
+	}
+}
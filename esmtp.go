@@ -13,6 +13,8 @@ type Esmtp struct {
 	Xoption    map[string]map[string]func(verb string, address string, key string, value string)
 	Xreply     map[string][]func(string, *Reply) (int, string)
 	Options    EsmtpOption
+
+	optionReply *Reply
 }
 
 type SubOption struct {
@@ -120,6 +122,8 @@ func (e *Esmtp) Ehlo(obj interface{}, args ...string) (close bool) {
 			e.ReversePath = "1"
 			e.ForwardPath = []string{}
 			e.StepMaildataPath(false)
+			e.HeloName = hostname
+			e.HeloVerb = "EHLO"
 		},
 		SuccessReply: &Reply{Code: 250, Message: response},
 	})
@@ -149,9 +153,15 @@ func (e *Esmtp) HandleOptions(verb string, address string, options []string) boo
 		if len(opts) == 2 {
 			value = opts[1]
 		}
-		handler, ok := e.Xoption[verb][key]
+		handler, ok := e.Xoption[verb][strings.ToUpper(key)]
 		if ok {
+			e.optionReply = nil
 			handler(verb, address, key, value)
+			if reply := e.optionReply; reply != nil {
+				e.optionReply = nil
+				e.Reply(reply.Code, reply.Message)
+				return false
+			}
 		} else {
 			e.Reply(555, fmt.Sprintf("Unsupported option: %s", key))
 			return false
@@ -161,6 +171,12 @@ func (e *Esmtp) HandleOptions(verb string, address string, options []string) boo
 	return true
 }
 
+// RejectOption is called by an option handler to refuse the command with
+// a reply.
+func (e *Esmtp) RejectOption(code int, message string) {
+	e.optionReply = &Reply{0, code, message}
+}
+
 func (e *Esmtp) HandleReply(verb string, reply *Reply) {
 	if _, ok := e.Xreply[verb]; e.ExtendMode && ok {
 		for _, handler := range e.Xreply[verb] {
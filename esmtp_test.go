@@ -15,7 +15,7 @@ func TestEsmtpMain(t *testing.T) {
 
 	server, err := tcptest.Start(esmtpd, 30*time.Second)
 	if err != nil {
-		t.Error("Failed to start smtpserver: %s", err)
+		t.Error("Failed to start smtpserver: ", err)
 	}
 
 	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
@@ -70,7 +70,7 @@ func Test8bitmimeInvalid(t *testing.T) {
 
 	server, err := tcptest.Start(esmtpd, 30*time.Second)
 	if err != nil {
-		t.Error("Failed to start smtpserver: %s", err)
+		t.Error("Failed to start smtpserver: ", err)
 	}
 
 	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
@@ -158,7 +158,7 @@ func TestPipelining(t *testing.T) {
 
 	server, err := tcptest.Start(esmtpd, 30*time.Second)
 	if err != nil {
-		t.Error("Failed to start smtpserver: %s", err)
+		t.Error("Failed to start smtpserver: ", err)
 	}
 
 	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
@@ -0,0 +1,384 @@
+package smtpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GreylistEntry is the state of a triplet, or of a client once it has been
+// allow-listed.
+type GreylistEntry struct {
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Passed    int
+}
+
+// GreylistStore persists the greylisting entries.
+type GreylistStore interface {
+	Get(key string) (*GreylistEntry, error)
+	Put(key string, entry *GreylistEntry) error
+	Expire(before time.Time) error
+}
+
+// Greylist temporarily rejects unknown (client network, sender, recipient)
+// triplets. It is meant to be registered as a RCPT filter, and as the last
+// DATA filter to count the messages of the clients to auto-allow-list:
+//
+//	s.AddFilter("RCPT", greylist.Filter(&s.Smtp))
+//	s.AddFilter("DATA", greylist.DataFilter(&s.Smtp))
+type Greylist struct {
+	Store         GreylistStore
+	Delay         time.Duration // before a retry is accepted (default 5m)
+	RetryWindow   time.Duration // after which an unconfirmed triplet is forgotten (default 24h)
+	Expiry        time.Duration // after which an unused passed triplet is forgotten (default 35 days)
+	AutoAllowList int           // accepted messages after which the client is allow-listed
+	AllowList     []*net.IPNet
+
+	mu         sync.Mutex
+	lastExpire time.Time
+}
+
+func (g *Greylist) TripletKey(ip net.IP, sender string, recipient string) string {
+	return NetworkKey(ip) + " " + strings.ToLower(sender) + " " + strings.ToLower(recipient)
+}
+
+func (g *Greylist) ClientKey(ip net.IP) string {
+	return NetworkKey(ip)
+}
+
+// Check tells whether the triplet is accepted, and records it.
+func (g *Greylist) Check(ip net.IP, sender string, recipient string) (bool, error) {
+	if ip == nil {
+		return true, nil
+	}
+	for _, network := range g.AllowList {
+		if network.Contains(ip) {
+			return true, nil
+		}
+	}
+
+	now := time.Now()
+	if err := g.expire(now); err != nil {
+		return true, err
+	}
+
+	client, err := g.Store.Get(g.ClientKey(ip))
+	if err != nil {
+		return true, err
+	}
+	if g.AutoAllowList > 0 && client != nil && client.Passed >= g.AutoAllowList {
+		client.LastSeen = now
+		return true, g.Store.Put(g.ClientKey(ip), client)
+	}
+
+	key := g.TripletKey(ip, sender, recipient)
+	entry, err := g.Store.Get(key)
+	if err != nil {
+		return true, err
+	}
+
+	if entry == nil || (entry.Passed == 0 && now.Sub(entry.FirstSeen) > g.retryWindow()) {
+		return false, g.Store.Put(key, &GreylistEntry{FirstSeen: now, LastSeen: now})
+	}
+
+	if entry.Passed == 0 && now.Sub(entry.FirstSeen) < g.delay() {
+		entry.LastSeen = now
+		return false, g.Store.Put(key, entry)
+	}
+
+	entry.Passed++
+	entry.LastSeen = now
+	return true, g.Store.Put(key, entry)
+}
+
+// Delivered records a message accepted from a client, which is
+// allow-listed after AutoAllowList of them.
+func (g *Greylist) Delivered(ip net.IP) error {
+	if ip == nil || g.AutoAllowList == 0 {
+		return nil
+	}
+	client, err := g.Store.Get(g.ClientKey(ip))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if client == nil {
+		client = &GreylistEntry{FirstSeen: now}
+	}
+	client.Passed++
+	client.LastSeen = now
+	return g.Store.Put(g.ClientKey(ip), client)
+}
+
+// Filter returns a RCPT filter greylisting the recipients of the session.
+// Store errors let the recipient through.
+func (g *Greylist) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		ok, _ := g.Check(s.GetRemoteIP(), s.GetSender(), args[0])
+		if ok == false {
+			return &Reply{0, 451, "4.7.1 Greylisted, please try again later"}
+		}
+		return nil
+	}
+}
+
+// DataFilter returns a DATA filter recording the messages of the session
+// with Delivered, once each with LMTP. Store errors are ignored.
+func (g *Greylist) DataFilter(s *Smtp) func(...string) *Reply {
+	counted := -1
+	return func(args ...string) *Reply {
+		if s.MessageCount != counted {
+			counted = s.MessageCount
+			g.Delivered(s.GetRemoteIP())
+		}
+		return nil
+	}
+}
+
+func (g *Greylist) delay() time.Duration {
+	if g.Delay == 0 {
+		return 5 * time.Minute
+	}
+	return g.Delay
+}
+
+func (g *Greylist) retryWindow() time.Duration {
+	if g.RetryWindow == 0 {
+		return 24 * time.Hour
+	}
+	return g.RetryWindow
+}
+
+func (g *Greylist) expiry() time.Duration {
+	if g.Expiry == 0 {
+		return 35 * 24 * time.Hour
+	}
+	return g.Expiry
+}
+
+// expire purges the store at most once an hour.
+func (g *Greylist) expire(now time.Time) error {
+	g.mu.Lock()
+	if now.Sub(g.lastExpire) < time.Hour {
+		g.mu.Unlock()
+		return nil
+	}
+	g.lastExpire = now
+	g.mu.Unlock()
+
+	before := now.Add(-g.expiry())
+	if g.retryWindow() > g.expiry() {
+		before = now.Add(-g.retryWindow())
+	}
+	return g.Store.Expire(before)
+}
+
+// MemoryGreylistStore keeps the entries in memory.
+type MemoryGreylistStore struct {
+	mu      sync.Mutex
+	entries map[string]GreylistEntry
+}
+
+func (m *MemoryGreylistStore) Get(key string) (*GreylistEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.entries[key]; ok {
+		return &entry, nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryGreylistStore) Put(key string, entry *GreylistEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entries == nil {
+		m.entries = make(map[string]GreylistEntry)
+	}
+	m.entries[key] = *entry
+	return nil
+}
+
+func (m *MemoryGreylistStore) Expire(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, entry := range m.entries {
+		if entry.LastSeen.Before(before) {
+			delete(m.entries, key)
+		}
+	}
+	return nil
+}
+
+// FileGreylistStore keeps the entries in memory and logs each change to
+// a file, one JSON record per line. The log is compacted on Expire, and
+// once it holds more than twice as many records as there are entries.
+type FileGreylistStore struct {
+	MemoryGreylistStore
+	Path string
+
+	logMu   sync.Mutex
+	log     *os.File
+	records int
+}
+
+type greylistRecord struct {
+	Key   string
+	Entry GreylistEntry
+}
+
+// Load reads the entries logged in Path, if any. A record cut short by a
+// crash is ignored.
+func (f *FileGreylistStore) Load() error {
+	file, err := os.Open(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := make(map[string]GreylistEntry)
+	records := 0
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				// drop the partial record, so that the next one is appended
+				// on its own line
+				if err := os.Truncate(f.Path, offset); err != nil {
+					return err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var record greylistRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%s: %v", f.Path, err)
+		}
+		entries[record.Key] = record.Entry
+		records++
+		offset += int64(len(line))
+	}
+
+	f.mu.Lock()
+	f.entries = entries
+	f.mu.Unlock()
+	f.logMu.Lock()
+	f.records = records
+	f.logMu.Unlock()
+	return nil
+}
+
+func (f *FileGreylistStore) Put(key string, entry *GreylistEntry) error {
+	f.MemoryGreylistStore.Put(key, entry)
+	line, err := json.Marshal(&greylistRecord{key, *entry})
+	if err != nil {
+		return err
+	}
+
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.log == nil {
+		if f.log, err = os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			return err
+		}
+	}
+	if _, err := f.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	f.records++
+
+	f.mu.Lock()
+	live := len(f.entries)
+	f.mu.Unlock()
+	if f.records > 1000 && f.records > 2*live {
+		return f.compact()
+	}
+	return nil
+}
+
+func (f *FileGreylistStore) Expire(before time.Time) error {
+	f.MemoryGreylistStore.Expire(before)
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	return f.compact()
+}
+
+// Close closes the log.
+func (f *FileGreylistStore) Close() error {
+	f.logMu.Lock()
+	defer f.logMu.Unlock()
+	if f.log == nil {
+		return nil
+	}
+	err := f.log.Close()
+	f.log = nil
+	return err
+}
+
+// compact replaces the log atomically with a record per entry. logMu is
+// held.
+func (f *FileGreylistStore) compact() error {
+	var buf bytes.Buffer
+	f.mu.Lock()
+	for key, entry := range f.entries {
+		line, err := json.Marshal(&greylistRecord{key, entry})
+		if err != nil {
+			f.mu.Unlock()
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	records := len(f.entries)
+	f.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.Path), ".greylist")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), f.Path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if f.log != nil {
+		f.log.Close()
+	}
+	f.log, err = os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.records = records
+	return err
+}
@@ -0,0 +1,148 @@
+package smtpserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGreylist(t *testing.T) {
+	greylist := &Greylist{Store: &MemoryGreylistStore{}, Delay: 50 * time.Millisecond, AutoAllowList: 1}
+	ip := net.ParseIP("192.0.2.1")
+
+	if ok, _ := greylist.Check(ip, "from@example.net", "to@example.com"); ok != false {
+		t.Error("Unknown triplet accepted")
+	}
+	if ok, _ := greylist.Check(ip, "from@example.net", "to@example.com"); ok != false {
+		t.Error("Early retry accepted")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if ok, _ := greylist.Check(net.ParseIP("192.0.2.2"), "FROM@example.net", "to@example.com"); ok != true {
+		t.Error("Retry from the same network refused")
+	}
+
+	// passed triplets don't allow-list the client, delivered messages do
+	if ok, _ := greylist.Check(ip, "other@example.net", "other@example.com"); ok != false {
+		t.Error("Client allow-listed without a message")
+	}
+	greylist.Delivered(ip)
+	if ok, _ := greylist.Check(ip, "other@example.net", "another@example.com"); ok != true {
+		t.Error("Allow-listed client greylisted")
+	}
+}
+
+func TestGreylistSession(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	greylist := &Greylist{Store: &MemoryGreylistStore{}, Delay: 50 * time.Millisecond, AutoAllowList: 2}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				s := &Smtp{}
+				s.Init(&Option{Socket: conn})
+				s.AddFilter("RCPT", greylist.Filter(s))
+				s.AddFilter("DATA", greylist.DataFilter(s))
+				s.Process()
+				conn.Close()
+			}()
+		}
+	}()
+
+	session := func(commands []string, expected []string) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		for i, command := range commands {
+			fmt.Fprintf(conn, "%s\r\n", command)
+			if reply, _ := reader.ReadString('\n'); strings.HasPrefix(reply, expected[i]) == false {
+				t.Errorf("Wrong reply to %q: %q", command, reply)
+			}
+		}
+	}
+
+	session([]string{"HELO client.example.net", "MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>"}, []string{"250 ", "250 ", "451 4.7.1"})
+	time.Sleep(100 * time.Millisecond)
+	// retries passing without a message don't count
+	session([]string{"HELO client.example.net", "MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "RSET",
+		"MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "RCPT TO:<c@example.com>"},
+		[]string{"250 ", "250 ", "250 ", "250 ", "250 ", "250 ", "451 4.7.1"})
+	session([]string{"HELO client.example.net",
+		"MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "DATA", "Subject: Hi\r\n\r\nHello.\r\n.",
+		"MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "DATA", "Subject: Hi\r\n\r\nHello again.\r\n.",
+		"MAIL FROM:<a@example.net>", "RCPT TO:<c@example.com>"},
+		[]string{"250 ", "250 ", "250 ", "354 ", "250 ", "250 ", "250 ", "354 ", "250 ", "250 ", "250 "})
+}
+
+func TestFileGreylistStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "greylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "greylist.log")
+	store := &FileGreylistStore{Path: path}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := store.Put("key", &GreylistEntry{FirstSeen: now, LastSeen: now, Passed: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// the last record of a key wins; a record cut short is ignored
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"Key":"other","Ent`)
+	file.Close()
+	loaded := &FileGreylistStore{Path: path}
+	if err := loaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := loaded.Get("key"); entry == nil || entry.Passed != 2 {
+		t.Errorf("Wrong loaded entry: %+v", entry)
+	}
+	loaded.Put("other", &GreylistEntry{FirstSeen: now, LastSeen: now.Add(time.Hour)})
+	reloaded := &FileGreylistStore{Path: path}
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := reloaded.Get("other"); entry == nil {
+		t.Error("Entry appended after a partial record lost")
+	}
+
+	// the log is compacted once mostly made of stale records
+	for i := 0; i < 2000; i++ {
+		loaded.Put("key", &GreylistEntry{FirstSeen: now, LastSeen: now, Passed: i})
+	}
+	if data, _ := ioutil.ReadFile(path); bytes.Count(data, []byte("\n")) > 1002 {
+		t.Errorf("Log not compacted: %d records", bytes.Count(data, []byte("\n")))
+	}
+
+	loaded.Expire(now.Add(time.Minute))
+	loaded.Close()
+	if entry, _ := loaded.Get("key"); entry != nil {
+		t.Error("Entry not expired")
+	}
+	if data, _ := ioutil.ReadFile(path); bytes.Count(data, []byte("\n")) != 1 {
+		t.Errorf("Wrong log after expiry: %q", data)
+	}
+}
@@ -0,0 +1,89 @@
+package smtpserver
+
+import (
+	"time"
+)
+
+// Handoff hands messages off to another server: the LMTP service of a
+// mail store such as Dovecot or Cyrus, or an SMTP server. It is a
+// LocalAgent, so that a server relays the outcomes the store gives:
+//
+//	store := &Handoff{Target: "unix:/run/dovecot/lmtp", LMTP: true, Hostname: "mx.example.com"}
+//	s.SetCallback("DATA", func(args ...string) *Reply {
+//		return s.DeliverLocal(store, args...)
+//	})
+//
+// An LMTP store replies for each recipient; behind an Lmtp server, the
+// message is handed off once, and each recipient gets the reply of the
+// store. Behind an Esmtp server, the recipients the store refuses are
+// notified once the others are delivered (see DeliverLocal).
+type Handoff struct {
+	Target   string        // unix:/path, /path, inet:host:port or host:port (default port 24 with LMTP, else 25)
+	LMTP     bool          // speak LMTP rather than SMTP
+	Hostname string        // name given in LHLO or EHLO (default os.Hostname())
+	Timeout  time.Duration // timeout of the connection and commands (default 5m)
+}
+
+// Dial connects to the target and greets it.
+func (h *Handoff) Dial() (*Client, error) {
+	c, err := h.connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Hello(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect connects to the target, and reads its greeting.
+func (h *Handoff) connect() (*Client, error) {
+	port := "25"
+	if h.LMTP {
+		port = "24"
+	}
+	network, address := targetAddress(h.Target, port)
+	c, err := DialClient(network, address, clientHostname(h.Hostname), h.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.LMTP = h.LMTP
+	return c, nil
+}
+
+// Deliver sends a message to the target in a single transaction, and
+// returns the outcome of each recipient: nil once accepted, else the
+// reply of the target, or the error preventing the transaction.
+func (h *Handoff) Deliver(from string, recipients []string, message []byte) []error {
+	results := make([]error, len(recipients))
+	fail := func(err error) []error {
+		if _, ok := err.(*ClientReply); ok == false {
+			err = &ClientReply{451, []string{"4.4.1 Connection to " + h.Target + " failed: " + err.Error()}}
+		}
+		for i := range results {
+			results[i] = err
+		}
+		return results
+	}
+
+	c, err := h.Dial()
+	if err != nil {
+		return fail(err)
+	}
+	replies, err := c.Send(from, recipients, message)
+	if err != nil {
+		c.Close()
+		return fail(err)
+	}
+	c.Quit()
+	for i, reply := range replies {
+		switch {
+		case reply == nil:
+			results[i] = &ClientReply{451, []string{"4.4.2 No reply from " + h.Target}}
+		case reply.Positive() == false:
+			results[i] = reply
+		}
+	}
+	return results
+}
@@ -0,0 +1,83 @@
+package smtpserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+func TestHandoff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lmtp, deliveries := StartTestLMTP(filepath.Join(dir, "lmtp"))
+	defer lmtp.Close()
+	mta := StartTestMTA("PIPELINING")
+	defer mta.Listener.Close()
+
+	// the outcome of each recipient, as the store gives it, in a single
+	// LMTP session
+	store := &countingAgent{LocalAgent: &Handoff{Target: "unix:" + filepath.Join(dir, "lmtp"), LMTP: true, Hostname: "mx.example.com"}}
+	s := &Lmtp{}
+	s.Init(&Option{})
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"joe@example.com", "full@example.com"}
+	for i, expected := range []string{"250 2.0.0 Ok: delivered to mailbox", "452 4.2.2 Mailbox full"} {
+		if reply := s.DeliverLocal(store, "Subject: Hi\r\n\r\nHello.\r\n", s.ForwardPath[i]); fmt.Sprintf("%d %s", reply.Code, reply.Message) != expected {
+			t.Errorf("Wrong reply for %s: %+v", s.ForwardPath[i], reply)
+		}
+	}
+	if len(*deliveries) != 1 || (*deliveries)[0] != "joe@example.com" || store.Deliveries != 1 {
+		t.Errorf("Wrong LMTP deliveries: %v (%d sessions)", *deliveries, store.Deliveries)
+	}
+
+	// behind SMTP, the message is accepted and the failure notified
+	q, err := queue.Open(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Esmtp{}
+	e.Init(&Option{})
+	e.ReversePath = "from@example.net"
+	e.ForwardPath = []string{"jane@example.com", "full@example.com"}
+	e.BounceQueue = q
+	if reply := e.DeliverLocal(store, "Subject: Hi\r\n\r\nHello.\r\n"); reply.Code != 250 {
+		t.Errorf("Wrong reply: %+v", reply)
+	}
+	if entries, _ := q.List(); len(entries) != 1 || entries[0].Recipients[0].Address != "from@example.net" {
+		t.Errorf("Wrong notifications: %+v", entries)
+	}
+
+	// an SMTP server, in a single transaction
+	relay := &Handoff{Target: mta.Listener.Addr().String(), Hostname: "mx.example.com"}
+	results := relay.Deliver("from@example.net", []string{"a@example.org", "unknown@example.org", "temp@example.org"}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	for i, expected := range []string{"<nil>", "550 5.1.1 User unknown", "450 4.2.0 Mailbox busy"} {
+		if fmt.Sprint(results[i]) != expected {
+			t.Errorf("Wrong result %d: %v", i, results[i])
+		}
+	}
+	if _, messages := mta.Records(); len(messages) != 1 {
+		t.Errorf("Wrong messages: %q", messages)
+	}
+
+	// without Hostname, the name of the host is given
+	anonymous := &Handoff{Target: mta.Listener.Addr().String()}
+	if results := anonymous.Deliver("from@example.net", []string{"a@example.org"}, []byte("Subject: Hi\r\n\r\nHello.\r\n")); results[0] != nil {
+		t.Errorf("Wrong result: %v", results[0])
+	}
+	host, _ := os.Hostname()
+	if hellos, _ := mta.Records(); len(hellos) != 2 || hellos[1] != host {
+		t.Errorf("Wrong EHLO: %q", hellos)
+	}
+
+	down := &Handoff{Target: "unix:" + filepath.Join(dir, "down"), LMTP: true}
+	if results := down.Deliver("", []string{"joe@example.com"}, nil); results[0] == nil || results[0].(*ClientReply).Code != 451 {
+		t.Errorf("Wrong result: %v", results[0])
+	}
+}
@@ -0,0 +1,70 @@
+package smtpserver
+
+// Limits protects a session from misbehaving clients. Each limit is the
+// number allowed: the recipient, message, error or command beyond it is
+// refused, and the connection closed but for recipients. A zero value
+// disables the corresponding limit.
+type Limits struct {
+	MaxRecipients int // recipients per transaction
+	MaxMessages   int // transactions per connection
+	MaxErrors     int // unknown or invalid commands per connection
+	MaxCommands   int // commands per connection
+	MaxNoops      int // NOOP and RSET commands per connection
+}
+
+func (s *Smtp) CountRecipients() int {
+	if len(s.ForwardPath) == 1 && s.ForwardPath[0] == "1" {
+		return 0
+	}
+	return len(s.ForwardPath)
+}
+
+func IsCommandError(code int) bool {
+	switch code {
+	case 500, 501, 503, 504, 555:
+		return true
+	}
+	return false
+}
+
+func (s *Smtp) CheckCommandLimits(verb string) (ok bool, close bool) {
+	s.CommandCount++
+	if s.Limits.MaxCommands > 0 && s.CommandCount > s.Limits.MaxCommands {
+		if s.MakeLimitEvent("toomanycommands", "4.7.0 Too many commands, closing transmission channel") {
+			return false, true
+		}
+	}
+
+	if verb == "NOOP" || verb == "RSET" {
+		s.NoopCount++
+		if s.Limits.MaxNoops > 0 && s.NoopCount > s.Limits.MaxNoops {
+			if s.MakeLimitEvent("toomanynoops", "4.7.0 Too many NOOP/RSET commands, closing transmission channel") {
+				return false, true
+			}
+		}
+	}
+
+	return true, false
+}
+
+func (s *Smtp) CheckErrorLimit(verb string, close bool) bool {
+	if close || IsCommandError(s.LastReplyCode) == false {
+		return close
+	}
+
+	s.ErrorCount++
+	if s.Limits.MaxErrors > 0 && s.ErrorCount > s.Limits.MaxErrors {
+		return s.MakeLimitEvent("toomanyerrors", "4.7.0 Too many errors, closing transmission channel")
+	}
+	return false
+}
+
+// MakeLimitEvent tells the callbacks that a limit has been reached. The
+// connection is closed with a 421 unless a callback returns a failure.
+func (s *Smtp) MakeLimitEvent(name string, msg string) bool {
+	return s.MakeEvent(&Event{
+		Name:         name,
+		SuccessReply: &Reply{Code: 421, Message: msg},
+		FailureReply: &Reply{},
+	}) > 0
+}
@@ -17,6 +17,8 @@ func (l *Lmtp) Init(options *Option) *Lmtp {
 	// Required by RFC
 	l.Register(&Pipelining{})
 
+	l.DataFinisher = l.DataFinished
+
 	return l
 }
 
@@ -25,7 +27,7 @@ func (l *Lmtp) GetProtoname() string {
 }
 
 func (l *Lmtp) Lhlo(obj interface{}, args ...string) (close bool) {
-	if len(args) == 0 || args[0] != "" {
+	if len(args) == 0 || args[0] == "" {
 		l.Reply(501, "Syntax error in parameters or arguments")
 		return
 	}
@@ -33,7 +35,7 @@ func (l *Lmtp) Lhlo(obj interface{}, args ...string) (close bool) {
 	hostname := args[0]
 	response := l.GetHostname() + " Service ready"
 
-	l.ExtendMode = true
+	l.SetExtendMode(true)
 
 	l.MakeEvent(&Event{
 		Name:      "LHLO",
@@ -43,6 +45,8 @@ func (l *Lmtp) Lhlo(obj interface{}, args ...string) (close bool) {
 			l.ReversePath = "1"
 			l.ForwardPath = []string{}
 			l.MaildataPath = false
+			l.HeloName = hostname
+			l.HeloVerb = "LHLO"
 		},
 		SuccessReply: &Reply{Code: 250, Message: response},
 	})
@@ -54,6 +58,7 @@ func (l *Lmtp) DataFinished(more_data string) bool {
 	recipients := l.ForwardPath
 
 	for _, forward_path := range recipients {
+		l.ReplyTimeout = l.Options.GetTimeouts().DataTermination
 		l.MakeEvent(&Event{
 			Name:         "DATA",
 			Arguments:    []string{l.DataBuf, forward_path},
@@ -61,6 +66,7 @@ func (l *Lmtp) DataFinished(more_data string) bool {
 			FailureReply: &Reply{Code: 550, Message: fmt.Sprintf("%s Failed", forward_path)},
 		})
 	}
+	l.MessageCount++
 
 	// reinitiate the connection
 	l.ReversePath = "1"
@@ -0,0 +1,157 @@
+package smtpserver
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+// DeliverLocal delivers the message of a DATA event with a local delivery
+// agent, such as a Maildir, and replies with the outcome. It is meant to be
+// called from the DATA callback:
+//
+//	s.SetCallback("DATA", func(args ...string) *Reply {
+//		return s.DeliverLocal(maildir, args...)
+//	})
+//
+// The message is given to the agent once for all the recipients of the
+// transaction. With LMTP, the DATA event of each recipient gets the outcome
+// of that recipient. SMTP has a single reply for all the recipients: once
+// one is delivered, the message is accepted, and the failures of the others
+// are notified to the sender through BounceQueue, so that the client
+// doesn't deliver it again. If none is delivered, the reply is the first
+// temporary failure, else the first permanent one.
+func (s *Smtp) DeliverLocal(agent LocalAgent, args ...string) *Reply {
+	recipients := s.GetRecipients()
+	if s.CountRecipients() == 0 || len(recipients) == 0 {
+		return &Reply{0, 554, "5.5.1 Error: no valid recipients"}
+	}
+	delivered := &Reply{1, 250, "2.0.0 Ok: delivered to mailbox"}
+	if len(args) > 1 {
+		if reply := localReply(s.deliverLocal(agent, args[0], args[1:])[args[1]]); reply != nil {
+			return reply
+		}
+		return delivered
+	}
+
+	results := s.deliverLocal(agent, args[0], recipients)
+	var temporary, permanent *Reply
+	var failed []*queue.Recipient
+	for _, rcpt := range s.envelope(recipients).Recipients {
+		reply := localReply(results[rcpt.Address])
+		switch {
+		case reply == nil:
+			continue
+		case reply.Code < 500 && temporary == nil:
+			temporary = reply
+		case reply.Code >= 500 && permanent == nil:
+			permanent = reply
+		}
+		rcpt.Status = queue.Failed
+		rcpt.Diagnostic = fmt.Sprintf("%d %s", reply.Code, reply.Message)
+		failed = append(failed, rcpt)
+	}
+	if len(failed) == 0 {
+		return delivered
+	}
+	if len(failed) < len(recipients) && s.BounceQueue != nil {
+		env := s.envelope(recipients)
+		env.Created = time.Now()
+		dsn := &DSN{Hostname: s.GetHostname()}
+		if err := dsn.Notify(s.BounceQueue, env, failed, []byte(args[0])); err == nil {
+			return delivered
+		}
+	}
+	if temporary != nil {
+		return temporary
+	}
+	return permanent
+}
+
+// deliverLocal delivers a message with an agent to the recipients of the
+// transaction and the given ones, once per message: the DATA events of the
+// recipients of an LMTP transaction get the outcomes of the first one.
+func (s *Smtp) deliverLocal(agent LocalAgent, data string, recipients []string) map[string]error {
+	if s.localResults == nil || s.localMessage != s.MessageCount || s.localData != data {
+		s.localResults, s.localMessage, s.localData = map[string]error{}, s.MessageCount, data
+	}
+
+	var addresses []string
+	pending := map[string]bool{}
+	for _, rcpt := range append(append([]string{}, s.GetRecipients()...), recipients...) {
+		if _, done := s.localResults[rcpt]; done == false && pending[rcpt] == false {
+			pending[rcpt] = true
+			addresses = append(addresses, rcpt)
+		}
+	}
+	if len(addresses) == 0 {
+		return s.localResults
+	}
+	for i, err := range agent.Deliver(s.senderAddress(), addresses, []byte(data)) {
+		s.localResults[addresses[i]] = err
+	}
+	return s.localResults
+}
+
+// AgentMap routes the local recipients to delivery agents, so that each
+// can have its own mailbox format. Keys are as in a TransportMap. It is a
+// LocalAgent:
+//
+//	AgentMap{
+//		"legacy.example.com": &Mbox{Lookup: mboxes},
+//		"*":                  &Maildir{Lookup: maildirs},
+//	}
+type AgentMap map[string]LocalAgent
+
+// Deliver delivers a message with the agent of each recipient, once per
+// agent, and returns the outcome of each recipient.
+func (m AgentMap) Deliver(from string, recipients []string, message []byte) []error {
+	results := make([]error, len(recipients))
+	var keys []string
+	indexes := map[string][]int{}
+	for i, rcpt := range recipients {
+		key := m.lookup(rcpt)
+		if key == "" {
+			results[i] = &ClientReply{550, []string{"5.1.1 <" + rcpt + ">: Recipient address rejected: User unknown"}}
+			continue
+		}
+		if _, ok := indexes[key]; ok == false {
+			keys = append(keys, key)
+		}
+		indexes[key] = append(indexes[key], i)
+	}
+	for _, key := range keys {
+		var addresses []string
+		for _, i := range indexes[key] {
+			addresses = append(addresses, recipients[i])
+		}
+		for n, err := range m[key].Deliver(from, addresses, message) {
+			results[indexes[key][n]] = err
+		}
+	}
+	return results
+}
+
+// lookup returns the key of the agent of an address, or "" if there is
+// none.
+func (m AgentMap) lookup(address string) string {
+	for _, key := range lookupKeys(address) {
+		if agent, ok := m[key]; ok && agent != nil {
+			return key
+		}
+	}
+	return ""
+}
+
+// localReply is the reply to a failure of a local delivery agent: the
+// reply it gives, else a temporary failure.
+func localReply(err error) *Reply {
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case *ClientReply:
+		return &Reply{0, err.Code, err.Message()}
+	}
+	return &Reply{0, 451, "4.3.0 " + err.Error()}
+}
@@ -0,0 +1,105 @@
+package smtpserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+func TestAgentMap(t *testing.T) {
+	local := &FakeLocalAgent{Mailboxes: map[string][]string{"joe@example.com": nil, "jane@sub.example.com": nil}}
+	other := &FakeLocalAgent{Mailboxes: map[string][]string{"joe@example.org": nil}}
+
+	// agent maps nest, though they can't be map keys
+	agents := AgentMap{
+		"example.org": other,
+		"*":           AgentMap{"example.com": local, ".example.com": local},
+	}
+	results := agents.Deliver("", []string{"joe@example.com", "joe@example.org", "jane@sub.example.com", "joe@example.net"}, []byte("Subject: Hi\r\n\r\n"))
+	for i, expected := range []string{"<nil>", "<nil>", "<nil>", "550 5.1.1 <joe@example.net>: Recipient address rejected: User unknown"} {
+		if fmt.Sprint(results[i]) != expected {
+			t.Errorf("Wrong result %d: %v", i, results[i])
+		}
+	}
+	if len(local.Mailboxes["joe@example.com"]) != 1 || len(local.Mailboxes["jane@sub.example.com"]) != 1 || len(other.Mailboxes["joe@example.org"]) != 1 {
+		t.Errorf("Wrong deliveries: %v %v", local.Mailboxes, other.Mailboxes)
+	}
+}
+
+// countingAgent counts the deliveries of its agent.
+type countingAgent struct {
+	LocalAgent
+	Deliveries int
+}
+
+func (a *countingAgent) Deliver(from string, recipients []string, message []byte) []error {
+	a.Deliveries++
+	return a.LocalAgent.Deliver(from, recipients, message)
+}
+
+func TestDeliverLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := "Subject: Hi\r\n\r\nHello.\r\n"
+
+	// with SMTP, the message is accepted once delivered to a recipient, and
+	// the failures are notified
+	local := &countingAgent{LocalAgent: &FakeLocalAgent{Mailboxes: map[string][]string{"joe@example.com": nil}}}
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"joe@example.com", "nobody@example.com"}
+	s.BounceQueue = q
+	if reply := s.DeliverLocal(local, message); fmt.Sprintf("%d %s", reply.Code, reply.Message) != "250 2.0.0 Ok: delivered to mailbox" {
+		t.Errorf("Wrong reply: %+v", reply)
+	}
+	entries, _ := q.List()
+	if len(entries) != 1 || entries[0].From != "" || entries[0].Recipients[0].Address != "from@example.net" {
+		t.Fatalf("Wrong notifications: %+v", entries)
+	}
+	r, _ := q.Message(entries[0].ID)
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if strings.Contains(string(data), "Final-Recipient: rfc822; nobody@example.com\r\nAction: failed\r\nStatus: 5.1.1\r\n") == false {
+		t.Errorf("Wrong notification: %s", data)
+	}
+
+	// without recipient delivered, or anywhere to notify, the failure is replied
+	s.MessageCount++
+	s.ForwardPath = []string{"nobody@example.com"}
+	if reply := s.DeliverLocal(local, message); reply.Code != 550 {
+		t.Errorf("Wrong reply: %+v", reply)
+	}
+	s.MessageCount++
+	s.ForwardPath = []string{"joe@example.com", "nobody@example.com"}
+	s.BounceQueue = nil
+	if reply := s.DeliverLocal(local, message); reply.Code != 550 {
+		t.Errorf("Wrong reply: %+v", reply)
+	}
+
+	// with LMTP, the recipients are delivered at once
+	local.Deliveries = 0
+	l := &Lmtp{}
+	l.Init(&Option{})
+	l.ReversePath = "from@example.net"
+	l.ForwardPath = []string{"joe@example.com", "nobody@example.com"}
+	for i, expected := range []int{250, 550} {
+		if reply := l.DeliverLocal(local, message, l.ForwardPath[i]); reply.Code != expected {
+			t.Errorf("Wrong reply for %s: %+v", l.ForwardPath[i], reply)
+		}
+	}
+	if local.Deliveries != 1 {
+		t.Errorf("Wrong deliveries: %d", local.Deliveries)
+	}
+}
@@ -0,0 +1,233 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// http://cr.yp.to/proto/maildir.html
+// http://www.courier-mta.org/imap/README.maildirquota.html
+
+// Mailbox is where the mail of a recipient is delivered.
+type Mailbox struct {
+	Path        string // the Maildir, or the mbox file
+	Folder      string // Maildir++ folder, e.g. "Lists.golang"; "" for the INBOX
+	Quota       int64  // size limit of the Maildir in bytes; 0 for no limit
+	MaxMessages int    // message limit of the Maildir; 0 for no limit
+}
+
+// MailboxLookup returns the mailbox of a recipient, or nil if it has
+// none. An error is a temporary failure.
+type MailboxLookup func(address string) (*Mailbox, error)
+
+// Maildir delivers messages into Maildir mailboxes. It is a LocalAgent, for
+// the DATA callback with DeliverLocal or for the local transport of a
+// Delivery:
+//
+//	maildir := &Maildir{Lookup: func(address string) (*Mailbox, error) {
+//		return &Mailbox{Path: "/var/mail/" + address + "/Maildir"}, nil
+//	}}
+//
+// The quotas are kept in the maildirsize file of Maildir++.
+type Maildir struct {
+	Lookup   MailboxLookup
+	Hostname string // in the file names (default os.Hostname)
+}
+
+var maildirCounter int64
+
+// Deliver delivers a message to each recipient, with Return-Path and
+// Delivered-To headers, and returns the outcome of each.
+func (m *Maildir) Deliver(from string, recipients []string, message []byte) []error {
+	results := make([]error, len(recipients))
+	for i, rcpt := range recipients {
+		mailbox, err := m.Lookup(rcpt)
+		switch {
+		case err != nil:
+			results[i] = err
+		case mailbox == nil:
+			results[i] = &ClientReply{550, []string{"5.1.1 <" + rcpt + ">: Recipient address rejected: User unknown"}}
+		default:
+			results[i] = m.DeliverTo(mailbox, from, rcpt, message)
+		}
+	}
+	return results
+}
+
+// DeliverTo delivers a message to a mailbox: the message is written in
+// tmp/, then moved to new/ once on disk. A mailbox over quota gives a
+// 452 4.2.2 reply.
+func (m *Maildir) DeliverTo(mailbox *Mailbox, from string, rcpt string, message []byte) error {
+	dir := mailbox.Path
+	if mailbox.Folder != "" {
+		if strings.ContainsAny(mailbox.Folder, "/") || strings.HasPrefix(mailbox.Folder, ".") {
+			return fmt.Errorf("invalid folder %q", mailbox.Folder)
+		}
+		dir = filepath.Join(mailbox.Path, "."+mailbox.Folder)
+	}
+	if err := createMaildir(mailbox.Path); err != nil {
+		return err
+	}
+	if dir != mailbox.Path {
+		if err := createMaildir(dir); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "maildirfolder"), nil, 0600); err != nil {
+			return err
+		}
+	}
+
+	data := "Return-Path: <" + from + ">\nDelivered-To: " + rcpt + "\n" +
+		strings.Replace(string(message), "\r\n", "\n", -1)
+	if mailbox.Quota > 0 || mailbox.MaxMessages > 0 {
+		size, count, err := maildirSize(mailbox)
+		if err != nil {
+			return err
+		}
+		if (mailbox.Quota > 0 && size+int64(len(data)) > mailbox.Quota) ||
+			(mailbox.MaxMessages > 0 && count+1 > mailbox.MaxMessages) {
+			return &ClientReply{452, []string{"4.2.2 Mailbox full"}}
+		}
+	}
+
+	name := m.uniqueName()
+	tmp := filepath.Join(dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name+",S="+strconv.Itoa(len(data)))); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if mailbox.Quota > 0 || mailbox.MaxMessages > 0 {
+		f, err := os.OpenFile(filepath.Join(mailbox.Path, "maildirsize"), os.O_WRONLY|os.O_APPEND, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d 1\n", len(data))
+			f.Close()
+		}
+	}
+	return nil
+}
+
+// uniqueName returns a file name of the Maildir spec: time, process,
+// delivery counter and host.
+func (m *Maildir) uniqueName() string {
+	host := m.Hostname
+	if host == "" {
+		host, _ = os.Hostname()
+	}
+	host = strings.Replace(host, "/", `\057`, -1)
+	host = strings.Replace(host, ":", `\072`, -1)
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&maildirCounter, 1), host)
+}
+
+func createMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maildirSize returns the size and message count of a Maildir from its
+// maildirsize file, computed again when missing, too large, or for another
+// quota.
+func maildirSize(mailbox *Mailbox) (int64, int, error) {
+	quota := []string{}
+	if mailbox.Quota > 0 {
+		quota = append(quota, strconv.FormatInt(mailbox.Quota, 10)+"S")
+	}
+	if mailbox.MaxMessages > 0 {
+		quota = append(quota, strconv.Itoa(mailbox.MaxMessages)+"C")
+	}
+	definition := strings.Join(quota, ",")
+	path := filepath.Join(mailbox.Path, "maildirsize")
+
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		var size int64
+		count := 0
+		valid := false
+		scanner := bufio.NewScanner(f)
+		for n := 0; scanner.Scan(); n++ {
+			if n == 0 {
+				valid = scanner.Text() == definition
+				continue
+			}
+			var s int64
+			var c int
+			if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &s, &c); err != nil {
+				valid = false
+				break
+			}
+			size += s
+			count += c
+		}
+		if info, err := f.Stat(); valid && err == nil && info.Size() <= 5120 {
+			return size, count, nil
+		}
+	}
+
+	// count the messages of the INBOX and the folders
+	var size int64
+	count := 0
+	dirs := []string{mailbox.Path}
+	folders, _ := ioutil.ReadDir(mailbox.Path)
+	for _, folder := range folders {
+		if folder.IsDir() && strings.HasPrefix(folder.Name(), ".") && folder.Name() != "." && folder.Name() != ".." {
+			dirs = append(dirs, filepath.Join(mailbox.Path, folder.Name()))
+		}
+	}
+	for _, dir := range dirs {
+		for _, sub := range []string{"new", "cur"} {
+			files, _ := ioutil.ReadDir(filepath.Join(dir, sub))
+			for _, file := range files {
+				s := file.Size()
+				if i := strings.Index(file.Name(), ",S="); i >= 0 {
+					fields := strings.FieldsFunc(file.Name()[i+3:], func(r rune) bool { return r < '0' || r > '9' })
+					if len(fields) > 0 {
+						s, _ = strconv.ParseInt(fields[0], 10, 64)
+					}
+				}
+				size += s
+				count++
+			}
+		}
+	}
+
+	tmp := path + "." + strconv.Itoa(os.Getpid())
+	content := fmt.Sprintf("%s\n%d %d\n", definition, size, count)
+	if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+		return 0, 0, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return 0, 0, err
+	}
+	return size, count, nil
+}
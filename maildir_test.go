@@ -0,0 +1,81 @@
+package smtpserver
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	maildir := &Maildir{
+		Hostname: "mx.example.com",
+		Lookup: func(address string) (*Mailbox, error) {
+			switch address {
+			case "joe@example.com":
+				return &Mailbox{Path: filepath.Join(dir, "joe")}, nil
+			case "joe+lists@example.com":
+				return &Mailbox{Path: filepath.Join(dir, "joe"), Folder: "Lists"}, nil
+			case "small@example.com":
+				return &Mailbox{Path: filepath.Join(dir, "small"), Quota: 100}, nil
+			case "down@example.com":
+				return nil, errors.New("directory unavailable")
+			}
+			return nil, nil
+		},
+	}
+
+	s := &Lmtp{}
+	s.Init(&Option{})
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"joe@example.com", "joe+lists@example.com", "small@example.com", "nobody@example.com", "down@example.com"}
+	message := "Subject: Hi\r\n\r\nHello.\r\n"
+	for i, expected := range []string{
+		"250 2.0.0 Ok: delivered to mailbox",
+		"250 2.0.0 Ok: delivered to mailbox",
+		"250 2.0.0 Ok: delivered to mailbox",
+		"550 5.1.1 <nobody@example.com>: Recipient address rejected: User unknown",
+		"451 4.3.0 directory unavailable",
+	} {
+		rcpt := s.ForwardPath[i]
+		if reply := s.DeliverLocal(maildir, message, rcpt); fmt.Sprintf("%d %s", reply.Code, reply.Message) != expected {
+			t.Errorf("Wrong reply for %s: %+v", rcpt, reply)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "joe", "new", "*"))
+	if len(files) != 1 || strings.HasSuffix(files[0], ".mx.example.com,S=82") == false {
+		t.Fatalf("Wrong INBOX: %v", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	if string(data) != "Return-Path: <from@example.net>\nDelivered-To: joe@example.com\nSubject: Hi\n\nHello.\n" {
+		t.Errorf("Wrong message: %q", data)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "joe", ".Lists", "new", "*")); len(files) != 1 {
+		t.Errorf("Wrong folder: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "joe", ".Lists", "maildirfolder")); err != nil {
+		t.Error(err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "joe", "tmp", "*")); len(files) != 0 {
+		t.Errorf("Files left in tmp: %v", files)
+	}
+
+	// the second message goes over quota
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "small", "maildirsize")); string(data) != "100S\n0 0\n84 1\n" {
+		t.Errorf("Wrong maildirsize: %q", data)
+	}
+	results := maildir.Deliver("from@example.net", []string{"small@example.com"}, []byte(message))
+	if len(results) != 1 || results[0] == nil || results[0].Error() != "452 4.2.2 Mailbox full" {
+		t.Errorf("Wrong quota results: %v", results)
+	}
+}
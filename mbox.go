@@ -0,0 +1,127 @@
+package smtpserver
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// http://www.qmail.org/man/man5/mbox.html
+
+// Mbox delivers messages by appending them to mbox files, in the mboxrd
+// format. The files are locked with a dotlock and fcntl, as other mail
+// programs do. It is a LocalAgent, as Maildir; a Mailbox gives the file
+// of a recipient, and its quota as the size limit of the file.
+type Mbox struct {
+	Lookup      MailboxLookup
+	LockTimeout time.Duration // how long to wait for a locked mailbox (default 30s)
+}
+
+// Deliver delivers a message to each recipient, with Return-Path and
+// Delivered-To headers, and returns the outcome of each.
+func (m *Mbox) Deliver(from string, recipients []string, message []byte) []error {
+	results := make([]error, len(recipients))
+	for i, rcpt := range recipients {
+		mailbox, err := m.Lookup(rcpt)
+		switch {
+		case err != nil:
+			results[i] = err
+		case mailbox == nil:
+			results[i] = &ClientReply{550, []string{"5.1.1 <" + rcpt + ">: Recipient address rejected: User unknown"}}
+		default:
+			results[i] = m.DeliverTo(mailbox, from, rcpt, message)
+		}
+	}
+	return results
+}
+
+var mboxFromRe = regexp.MustCompile(`(?m)^(>*From )`)
+
+// MboxEntry returns a message as appended to an mbox file: the From_ line,
+// the lines starting with From_ quoted with >, and an empty line.
+func MboxEntry(from string, date time.Time, message []byte) string {
+	sender := from
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	data := strings.Replace(string(message), "\r\n", "\n", -1)
+	if data != "" && strings.HasSuffix(data, "\n") == false {
+		data += "\n"
+	}
+	return "From " + sender + " " + date.UTC().Format(time.ANSIC) + "\n" +
+		mboxFromRe.ReplaceAllString(data, ">$1") + "\n"
+}
+
+// DeliverTo appends a message to a mailbox, locked. The file is truncated
+// back to its size if the message can't be written whole. A mailbox over
+// quota gives a 452 4.2.2 reply, a mailbox locked for too long 450 4.2.0.
+func (m *Mbox) DeliverTo(mailbox *Mailbox, from string, rcpt string, message []byte) error {
+	data := MboxEntry(from, time.Now(), []byte("Return-Path: <"+from+">\r\nDelivered-To: "+rcpt+"\r\n"+string(message)))
+
+	f, err := os.OpenFile(mailbox.Path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	timeout := m.LockTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	unlock, err := dotlock(mailbox.Path, deadline)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := fcntlLock(f, deadline); err != nil {
+		return err
+	}
+	defer fcntlUnlock(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if mailbox.Quota > 0 && size+int64(len(data)) > mailbox.Quota {
+		return &ClientReply{452, []string{"4.2.2 Mailbox full"}}
+	}
+
+	if _, err := f.WriteString(data); err != nil {
+		f.Truncate(size)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Truncate(size)
+		return err
+	}
+	return nil
+}
+
+// dotlock creates the path.lock file, removing a lock left for more than
+// 5 minutes, and returns the function removing it.
+func dotlock(path string, deadline time.Time) (func(), error) {
+	lock := path + ".lock"
+	for {
+		f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if os.IsExist(err) == false {
+			return nil, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > 5*time.Minute {
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, &ClientReply{450, []string{"4.2.0 Mailbox locked"}}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
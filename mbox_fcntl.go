@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+
+package smtpserver
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// fcntlLock takes the write lock of a file, waiting until the deadline.
+func fcntlLock(f *os.File, deadline time.Time) error {
+	lock := &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+	for {
+		err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, lock)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EAGAIN && err != syscall.EACCES {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return &ClientReply{450, []string{"4.2.0 Mailbox locked"}}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func fcntlUnlock(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{Type: syscall.F_UNLCK, Whence: 0})
+}
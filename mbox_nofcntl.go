@@ -0,0 +1,18 @@
+//go:build windows || plan9
+
+package smtpserver
+
+import (
+	"os"
+	"time"
+)
+
+// fcntlLock does nothing without fcntl: the dotlock alone protects the
+// mailboxes.
+func fcntlLock(f *os.File, deadline time.Time) error {
+	return nil
+}
+
+func fcntlUnlock(f *os.File) error {
+	return nil
+}
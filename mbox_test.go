@@ -0,0 +1,66 @@
+package smtpserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mboxes := func(address string) (*Mailbox, error) {
+		if strings.HasPrefix(address, "nobody@") {
+			return nil, nil
+		}
+		return &Mailbox{Path: filepath.Join(dir, strings.SplitN(address, "@", 2)[0]), Quota: 400}, nil
+	}
+	maildirs := func(address string) (*Mailbox, error) {
+		return &Mailbox{Path: filepath.Join(dir, "Maildir")}, nil
+	}
+	agents := AgentMap{
+		"legacy.example.com": &Mbox{Lookup: mboxes, LockTimeout: 200 * time.Millisecond},
+		"*":                  &Maildir{Lookup: maildirs},
+	}
+
+	message := []byte("Subject: Hi\r\n\r\nFrom here\r\n>From there\r\nFrom")
+	results := agents.Deliver("", []string{"joe@legacy.example.com", "jane@example.com", "nobody@legacy.example.com", "joe@legacy.example.com"}, message)
+	for i, expected := range []string{"", "", "550 5.1.1 <nobody@legacy.example.com>: Recipient address rejected: User unknown", ""} {
+		if (results[i] == nil && expected != "") || (results[i] != nil && results[i].Error() != expected) {
+			t.Errorf("Wrong result %d: %v", i, results[i])
+		}
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "joe"))
+	if strings.Count(string(data), "\nFrom MAILER-DAEMON ") != 1 || strings.HasPrefix(string(data), "From MAILER-DAEMON ") == false {
+		t.Fatalf("Wrong mbox: %q", data)
+	}
+	if strings.HasSuffix(string(data), "Return-Path: <>\nDelivered-To: joe@legacy.example.com\nSubject: Hi\n\n>From here\n>>From there\nFrom\n\n") == false {
+		t.Errorf("Wrong entry: %q", data)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "Maildir", "new", "*")); len(files) != 1 {
+		t.Errorf("Wrong Maildir: %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "joe.lock")); os.IsNotExist(err) == false {
+		t.Error("Lock left")
+	}
+
+	// over quota, and locked by another program
+	if results := agents.Deliver("from@example.net", []string{"joe@legacy.example.com"}, message); results[0] == nil || results[0].Error() != "452 4.2.2 Mailbox full" {
+		t.Errorf("Wrong quota result: %v", results[0])
+	}
+	ioutil.WriteFile(filepath.Join(dir, "jane.lock"), nil, 0600)
+	if results := agents.Deliver("from@example.net", []string{"jane@legacy.example.com"}, message); results[0] == nil || results[0].Error() != "450 4.2.0 Mailbox locked" {
+		t.Errorf("Wrong lock result: %v", results[0])
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "jane")); len(data) != 0 {
+		t.Errorf("Locked mailbox written: %q", data)
+	}
+}
@@ -0,0 +1,130 @@
+package smtpserver
+
+import (
+	"strings"
+)
+
+// MessageHeader is a header field as received, folding included. Raw is
+// terminated by CRLF.
+type MessageHeader struct {
+	Name string
+	Raw  string
+}
+
+// Message is a received message split into its header fields and body.
+type Message struct {
+	Headers []*MessageHeader
+	Body    string
+}
+
+// ParseMessage splits the data of a message. Bare LFs are turned into CRLFs.
+func ParseMessage(data string) *Message {
+	data = ToCRLF(data)
+
+	m := &Message{}
+	rest := data
+	for rest != "" {
+		if strings.HasPrefix(rest, "\r\n") {
+			m.Body = rest[2:]
+			return m
+		}
+
+		// a field ends at the first CRLF not followed by WSP
+		end := 0
+		for {
+			i := strings.Index(rest[end:], "\r\n")
+			if i < 0 {
+				end = len(rest)
+				break
+			}
+			end += i + 2
+			if end >= len(rest) || (rest[end] != ' ' && rest[end] != '\t') {
+				break
+			}
+		}
+
+		raw := rest[:end]
+		if strings.HasSuffix(raw, "\r\n") == false {
+			raw += "\r\n"
+		}
+		name := raw
+		if i := strings.Index(raw, ":"); i >= 0 {
+			name = raw[:i]
+		}
+		m.Headers = append(m.Headers, &MessageHeader{Name: strings.TrimSpace(name), Raw: raw})
+		rest = rest[end:]
+	}
+	return m
+}
+
+// ToCRLF turns the bare LFs of data into CRLFs.
+func ToCRLF(data string) string {
+	if strings.Contains(data, "\n") == false {
+		return data
+	}
+	var b strings.Builder
+	for i := 0; i < len(data); i++ {
+		if data[i] == '\n' && (i == 0 || data[i-1] != '\r') {
+			b.WriteByte('\r')
+		}
+		b.WriteByte(data[i])
+	}
+	return b.String()
+}
+
+func (m *Message) String() string {
+	var b strings.Builder
+	for _, h := range m.Headers {
+		b.WriteString(h.Raw)
+	}
+	b.WriteString("\r\n")
+	b.WriteString(m.Body)
+	return b.String()
+}
+
+// Value returns the unfolded value of a header field.
+func (h *MessageHeader) Value() string {
+	value := h.Raw
+	if i := strings.Index(value, ":"); i >= 0 {
+		value = value[i+1:]
+	}
+	value = strings.Replace(value, "\r\n", "", -1)
+	return strings.TrimSpace(value)
+}
+
+// Get returns the first header field of that name, or nil.
+func (m *Message) Get(name string) *MessageHeader {
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h
+		}
+	}
+	return nil
+}
+
+// GetAll returns the header fields of that name, from top to bottom.
+func (m *Message) GetAll(name string) []*MessageHeader {
+	var headers []*MessageHeader
+	for _, h := range m.Headers {
+		if strings.EqualFold(h.Name, name) {
+			headers = append(headers, h)
+		}
+	}
+	return headers
+}
+
+// Prepend adds a header field on top of the others. value may be folded
+// with CRLF followed by WSP.
+func (m *Message) Prepend(name string, value string) {
+	m.Headers = append([]*MessageHeader{&MessageHeader{Name: name, Raw: name + ": " + value + "\r\n"}}, m.Headers...)
+}
+
+// Remove deletes a header field.
+func (m *Message) Remove(header *MessageHeader) {
+	for i, h := range m.Headers {
+		if h == header {
+			m.Headers = append(m.Headers[:i], m.Headers[i+1:]...)
+			return
+		}
+	}
+}
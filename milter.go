@@ -0,0 +1,696 @@
+package smtpserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sendmail milter protocol, version 6 (libmilter/mfdef.h)
+
+const MilterVersion = 6
+
+// Actions a milter may negotiate (SMFIF_*).
+const (
+	MilterAddHeaders    uint32 = 0x01
+	MilterChangeBody    uint32 = 0x02
+	MilterAddRcpt       uint32 = 0x04
+	MilterDeleteRcpt    uint32 = 0x08
+	MilterChangeHeaders uint32 = 0x10
+	MilterQuarantine    uint32 = 0x20
+	MilterChangeFrom    uint32 = 0x40
+	MilterAddRcptParams uint32 = 0x80
+
+	milterActions = MilterAddHeaders | MilterChangeBody | MilterAddRcpt | MilterDeleteRcpt |
+		MilterChangeHeaders | MilterQuarantine | MilterChangeFrom | MilterAddRcptParams
+)
+
+// Protocol steps a milter may skip or not reply to (SMFIP_*).
+const (
+	MilterNoConnect          uint32 = 0x01
+	MilterNoHelo             uint32 = 0x02
+	MilterNoMail             uint32 = 0x04
+	MilterNoRcpt             uint32 = 0x08
+	MilterNoBody             uint32 = 0x10
+	MilterNoHeaders          uint32 = 0x20
+	MilterNoEOH              uint32 = 0x40
+	MilterNRHeader           uint32 = 0x80
+	MilterNoUnknown          uint32 = 0x100
+	MilterNoData             uint32 = 0x200
+	MilterSkip               uint32 = 0x400
+	MilterNRConnect          uint32 = 0x1000
+	MilterNRHelo             uint32 = 0x2000
+	MilterNRMail             uint32 = 0x4000
+	MilterNRRcpt             uint32 = 0x8000
+	MilterNRData             uint32 = 0x10000
+	MilterNRUnknown          uint32 = 0x20000
+	MilterNREOH              uint32 = 0x40000
+	MilterNRBody             uint32 = 0x80000
+	MilterHeaderLeadingSpace uint32 = 0x100000
+
+	milterProtocol = MilterNoConnect | MilterNoHelo | MilterNoMail | MilterNoRcpt | MilterNoBody |
+		MilterNoHeaders | MilterNoEOH | MilterNRHeader | MilterNoUnknown | MilterNoData | MilterSkip |
+		MilterNRConnect | MilterNRHelo | MilterNRMail | MilterNRRcpt | MilterNRData | MilterNRUnknown |
+		MilterNREOH | MilterNRBody | MilterHeaderLeadingSpace
+)
+
+// milterChunkSize is the largest body chunk sent at once.
+const milterChunkSize = 65535
+
+// Milter is a content filter speaking the milter protocol, e.g. rspamd,
+// opendkim or clamav-milter. Each session gets its own connection:
+//
+//	session := milter.Attach(&s.Smtp)
+//	defer session.Close()
+//	s.Process()
+type Milter struct {
+	Network    string        // "tcp" or "unix"
+	Address    string        // e.g. "127.0.0.1:11332" or "/run/milter.sock"
+	Timeout    time.Duration // connection and reply timeout (default 10s)
+	FailClosed bool          // tempfail when the milter is unavailable instead of going on without it
+}
+
+// MilterSession is the conversation of an SMTP session with a milter.
+type MilterSession struct {
+	Milter *Milter
+	Smtp   *Smtp
+
+	conn     net.Conn
+	actions  uint32
+	protocol uint32
+
+	unavailable    bool
+	skipConnection bool // the milter accepted the connection
+	skipMessage    bool // the milter accepted the message
+	discard        bool
+	inMessage      bool
+
+	// LMTP makes one DATA event per recipient
+	eomDone   bool
+	eomData   string
+	eomResult string
+	eomReply  *Reply
+}
+
+// Attach registers the filters sending the events of a session to the
+// milter. The connection is opened at the banner and Close has to be
+// called once the session is over.
+func (m *Milter) Attach(s *Smtp) *MilterSession {
+	ms := &MilterSession{Milter: m, Smtp: s}
+	s.AddFilter("banner", ms.Connect)
+	s.AddFilter("HELO", ms.Helo)
+	s.AddFilter("EHLO", ms.Helo)
+	s.AddFilter("LHLO", ms.Helo)
+	s.AddFilter("MAIL", ms.Mail)
+	s.AddFilter("RCPT", ms.Rcpt)
+	s.AddFilter("DATA-INIT", ms.Data)
+	s.AddFilter("DATA", ms.EndOfMessage)
+	s.AddFilter("RSET", ms.Abort)
+	s.AddFilter("QUIT", ms.Quit)
+	return ms
+}
+
+func (ms *MilterSession) timeout() time.Duration {
+	if ms.Milter.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return ms.Milter.Timeout
+}
+
+func (ms *MilterSession) send(cmd byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(packet, uint32(1+len(data)))
+	packet[4] = cmd
+	copy(packet[5:], data)
+
+	ms.conn.SetDeadline(time.Now().Add(ms.timeout()))
+	_, err := ms.conn.Write(packet)
+	return err
+}
+
+func (ms *MilterSession) receive() (byte, []byte, error) {
+	ms.conn.SetDeadline(time.Now().Add(ms.timeout()))
+
+	var header [4]byte
+	if _, err := io.ReadFull(ms.conn, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 || length > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid milter packet length %d", length)
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(ms.conn, packet); err != nil {
+		return 0, nil, err
+	}
+	return packet[0], packet[1:], nil
+}
+
+// exchange sends a command and waits for its reply, unless the milter
+// asked for none.
+func (ms *MilterSession) exchange(cmd byte, data []byte, noReply uint32) (byte, []byte, error) {
+	if err := ms.send(cmd, data); err != nil {
+		return 0, nil, err
+	}
+	if ms.protocol&noReply != 0 {
+		return 'c', nil, nil
+	}
+	for {
+		code, data, err := ms.receive()
+		if err != nil || code != 'p' {
+			return code, data, err
+		}
+		// progress, the milter needs more time
+	}
+}
+
+// macros sends the values of macros for the next command. Empty values
+// are left out.
+func (ms *MilterSession) macros(cmd byte, pairs ...string) error {
+	data := []byte{cmd}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			data = append(data, milterStrings(pairs[i], pairs[i+1])...)
+		}
+	}
+	if len(data) == 1 {
+		return nil
+	}
+	return ms.send('D', data)
+}
+
+func milterStrings(s ...string) []byte {
+	var data []byte
+	for _, str := range s {
+		data = append(data, str...)
+		data = append(data, 0)
+	}
+	return data
+}
+
+func splitMilterStrings(data []byte) []string {
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00")
+}
+
+func (ms *MilterSession) open() error {
+	conn, err := net.DialTimeout(ms.Milter.Network, ms.Milter.Address, ms.timeout())
+	if err != nil {
+		return err
+	}
+	ms.conn = conn
+
+	data := make([]byte, 12)
+	binary.BigEndian.PutUint32(data[0:], MilterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActions)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+	if err := ms.send('O', data); err != nil {
+		return err
+	}
+
+	code, data, err := ms.receive()
+	if err != nil {
+		return err
+	}
+	if code != 'O' || len(data) < 12 {
+		return fmt.Errorf("unexpected milter negotiation reply %q", code)
+	}
+	if version := binary.BigEndian.Uint32(data[0:]); version < 2 || version > MilterVersion {
+		return fmt.Errorf("unsupported milter version %d", version)
+	}
+	ms.actions = binary.BigEndian.Uint32(data[4:]) & milterActions
+	ms.protocol = binary.BigEndian.Uint32(data[8:]) & milterProtocol
+	return nil
+}
+
+// fail gives up the milter for the session.
+func (ms *MilterSession) fail(tempfail *Reply) *Reply {
+	if ms.conn != nil {
+		ms.conn.Close()
+		ms.conn = nil
+	}
+	ms.unavailable = true
+	if ms.Milter.FailClosed {
+		return tempfail
+	}
+	return nil
+}
+
+// active tells whether the events of the current stage are to be sent.
+// It returns a reply if the milter is unavailable and FailClosed set.
+func (ms *MilterSession) active(message bool, tempfail *Reply) (bool, *Reply) {
+	if ms.unavailable {
+		if ms.Milter.FailClosed {
+			return false, tempfail
+		}
+		return false, nil
+	}
+	if ms.skipConnection || (message && ms.skipMessage) {
+		return false, nil
+	}
+	if ms.conn == nil {
+		if err := ms.open(); err != nil {
+			return false, ms.fail(tempfail)
+		}
+	}
+	return true, nil
+}
+
+var milterTempfail = &Reply{0, 451, "4.7.1 Service unavailable - try again later"}
+
+// verdict turns the reply of a milter into the reply of the event.
+func (ms *MilterSession) verdict(code byte, data []byte, reject *Reply, tempfail *Reply) *Reply {
+	switch code {
+	case 'c':
+		return nil
+	case 'a':
+		if ms.inMessage {
+			ms.skipMessage = true
+		} else {
+			ms.skipConnection = true
+		}
+		return nil
+	case 'd':
+		if ms.inMessage {
+			ms.discard = true
+			ms.skipMessage = true
+		}
+		return nil
+	case 'r':
+		return reject
+	case 't':
+		return tempfail
+	case 'y':
+		if reply := ParseMilterReplyCode(splitMilterStrings(data)[0]); reply != nil {
+			return reply
+		}
+		return reject
+	}
+	return ms.fail(tempfail)
+}
+
+// ParseMilterReplyCode parses the SMTP reply of a SMFIR_REPLYCODE, which
+// may span several lines. It returns nil if it isn't a failure reply.
+func ParseMilterReplyCode(text string) *Reply {
+	var lines []string
+	code := 0
+	for _, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		if len(line) < 3 {
+			continue
+		}
+		n, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return nil
+		}
+		code = n
+		lines = append(lines, strings.TrimLeft(line[3:], " -"))
+	}
+	if code < 400 || code > 599 {
+		return nil
+	}
+	return &Reply{0, code, strings.Join(lines, "\n")}
+}
+
+// Connect sends the connection of the client, at the "banner" event.
+func (ms *MilterSession) Connect(args ...string) *Reply {
+	tempfail := &Reply{0, 421, "4.7.1 Service unavailable - try again later"}
+	reject := &Reply{0, 554, "5.7.1 Command rejected"}
+	ok, reply := ms.active(false, tempfail)
+	if ok == false || ms.protocol&MilterNoConnect != 0 {
+		return reply
+	}
+
+	s := ms.Smtp
+	ip := s.GetRemoteIP()
+	address, hostname := "", "unknown"
+	if ip != nil {
+		address = ip.String()
+		hostname = "[" + address + "]"
+	}
+	err := ms.macros('C',
+		"j", s.GetHostname(),
+		"{daemon_name}", s.GetAppname(),
+		"_", hostname,
+		"{client_addr}", address,
+	)
+	if err != nil {
+		return ms.fail(tempfail)
+	}
+
+	data := milterStrings(hostname)
+	if ip == nil {
+		data = append(data, 'U')
+	} else {
+		family := byte('4')
+		if ip.To4() == nil {
+			family = '6'
+		}
+		port := 0
+		if _, p, err := net.SplitHostPort(s.In.RemoteAddr().String()); err == nil {
+			port, _ = strconv.Atoi(p)
+		}
+		data = append(data, family, byte(port>>8), byte(port))
+		data = append(data, milterStrings(address)...)
+	}
+
+	code, data, err := ms.exchange('C', data, MilterNRConnect)
+	if err != nil {
+		return ms.fail(tempfail)
+	}
+	return ms.verdict(code, data, reject, tempfail)
+}
+
+// Helo sends the HELO, EHLO or LHLO name.
+func (ms *MilterSession) Helo(args ...string) *Reply {
+	reject := &Reply{0, 550, "5.7.1 Command rejected"}
+	ok, reply := ms.active(false, milterTempfail)
+	if ok == false || ms.protocol&MilterNoHelo != 0 {
+		return reply
+	}
+
+	code, data, err := ms.exchange('H', milterStrings(args[0]), MilterNRHelo)
+	if err != nil {
+		return ms.fail(milterTempfail)
+	}
+	return ms.verdict(code, data, reject, milterTempfail)
+}
+
+// Mail sends the sender of a new message.
+func (ms *MilterSession) Mail(args ...string) *Reply {
+	if ms.inMessage && ms.conn != nil {
+		// the previous message was accepted or refused before its end
+		if err := ms.send('A', nil); err != nil {
+			return ms.fail(milterTempfail)
+		}
+	}
+	ms.inMessage = false
+	ms.skipMessage = false
+	ms.discard = false
+	ms.eomDone = false
+
+	reject := &Reply{0, 550, "5.7.1 Command rejected"}
+	ok, reply := ms.active(true, milterTempfail)
+	if ok == false {
+		return reply
+	}
+	ms.inMessage = true
+	if ms.protocol&MilterNoMail != 0 {
+		return nil
+	}
+
+	s := ms.Smtp
+	err := ms.macros('M', "{mail_addr}", args[0], "{auth_authen}", s.AuthUser)
+	if err != nil {
+		return ms.fail(milterTempfail)
+	}
+	code, data, err := ms.exchange('M', milterStrings("<"+args[0]+">"), MilterNRMail)
+	if err != nil {
+		return ms.fail(milterTempfail)
+	}
+	return ms.verdict(code, data, reject, milterTempfail)
+}
+
+// Rcpt sends a recipient.
+func (ms *MilterSession) Rcpt(args ...string) *Reply {
+	reject := &Reply{0, 550, "5.7.1 Command rejected"}
+	ok, reply := ms.active(true, milterTempfail)
+	if ok == false || ms.protocol&MilterNoRcpt != 0 {
+		return reply
+	}
+
+	if err := ms.macros('R', "{rcpt_addr}", args[0]); err != nil {
+		return ms.fail(milterTempfail)
+	}
+	code, data, err := ms.exchange('R', milterStrings("<"+args[0]+">"), MilterNRRcpt)
+	if err != nil {
+		return ms.fail(milterTempfail)
+	}
+	return ms.verdict(code, data, reject, milterTempfail)
+}
+
+// Data sends the DATA command.
+func (ms *MilterSession) Data(args ...string) *Reply {
+	reject := &Reply{0, 550, "5.7.1 Command rejected"}
+	ok, reply := ms.active(true, milterTempfail)
+	if ok == false || ms.protocol&MilterNoData != 0 {
+		return reply
+	}
+
+	code, data, err := ms.exchange('T', nil, MilterNRData)
+	if err != nil {
+		return ms.fail(milterTempfail)
+	}
+	return ms.verdict(code, data, reject, milterTempfail)
+}
+
+// EndOfMessage sends the header fields and the body of the message, then
+// applies the modifications and the verdict of the milter.
+func (ms *MilterSession) EndOfMessage(args ...string) *Reply {
+	discarded := &Reply{0, 250, "2.0.0 Ok: message discarded"}
+	if ms.discard {
+		return discarded
+	}
+	if ms.eomDone && args[0] == ms.eomData {
+		args[0] = ms.eomResult
+		return ms.eomReply
+	}
+
+	data := args[0]
+	reply := ms.endOfMessage(args)
+	if ms.discard {
+		reply = discarded
+	}
+	ms.eomDone = true
+	ms.eomData = data
+	ms.eomResult = args[0]
+	ms.eomReply = reply
+	return reply
+}
+
+func (ms *MilterSession) endOfMessage(args []string) *Reply {
+	reject := &Reply{0, 550, "5.7.1 Command rejected"}
+	ok, reply := ms.active(true, milterTempfail)
+	if ok == false {
+		return reply
+	}
+
+	m := ParseMessage(args[0])
+	leadingSpace := ms.protocol&MilterHeaderLeadingSpace != 0
+
+	if ms.protocol&MilterNoHeaders == 0 {
+		for _, h := range m.Headers {
+			value := h.Raw[len(h.Name):]
+			value = strings.TrimPrefix(strings.TrimLeft(value, " \t"), ":")
+			value = strings.Replace(strings.TrimSuffix(value, "\r\n"), "\r\n", "\n", -1)
+			if leadingSpace == false {
+				value = strings.TrimLeft(value, " \t")
+			}
+			code, data, err := ms.exchange('L', milterStrings(h.Name, value), MilterNRHeader)
+			if err != nil {
+				return ms.fail(milterTempfail)
+			}
+			if code != 'c' {
+				return ms.verdict(code, data, reject, milterTempfail)
+			}
+		}
+	}
+
+	if ms.protocol&MilterNoEOH == 0 {
+		code, data, err := ms.exchange('N', nil, MilterNREOH)
+		if err != nil {
+			return ms.fail(milterTempfail)
+		}
+		if code != 'c' {
+			return ms.verdict(code, data, reject, milterTempfail)
+		}
+	}
+
+	if ms.protocol&MilterNoBody == 0 {
+		body := ToCRLF(m.Body)
+		for len(body) > 0 {
+			n := len(body)
+			if n > milterChunkSize {
+				n = milterChunkSize
+			}
+			code, data, err := ms.exchange('B', []byte(body[:n]), MilterNRBody)
+			if err != nil {
+				return ms.fail(milterTempfail)
+			}
+			body = body[n:]
+			if code == 's' {
+				break
+			}
+			if code != 'c' {
+				return ms.verdict(code, data, reject, milterTempfail)
+			}
+		}
+	}
+
+	if err := ms.send('E', nil); err != nil {
+		return ms.fail(milterTempfail)
+	}
+	ms.inMessage = false
+
+	var body *string
+	for {
+		code, data, err := ms.receive()
+		if err != nil {
+			return ms.fail(milterTempfail)
+		}
+		switch code {
+		case 'p':
+		case 'h', 'i', 'm', '+', '2', '-', 'e', 'b', 'q':
+			ms.modify(m, code, data, &body)
+		default:
+			// a discard still concerns the message
+			ms.inMessage = true
+			reply := ms.verdict(code, data, reject, milterTempfail)
+			ms.inMessage = false
+			if reply == nil && ms.discard == false {
+				if body != nil {
+					m.Body = *body
+				}
+				args[0] = m.String()
+			}
+			return reply
+		}
+	}
+}
+
+func milterAddress(s string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(s), "<"), ">")
+}
+
+// milterHeader builds a header field modified by the milter.
+func (ms *MilterSession) milterHeader(name string, value string) *MessageHeader {
+	value = ToCRLF(value)
+	if ms.protocol&MilterHeaderLeadingSpace == 0 {
+		value = " " + value
+	}
+	return &MessageHeader{Name: name, Raw: name + ":" + value + "\r\n"}
+}
+
+// modify applies a modification of the milter, if negotiated.
+func (ms *MilterSession) modify(m *Message, code byte, data []byte, body **string) {
+	s := ms.Smtp
+	allowed := func(action uint32) bool {
+		return ms.actions&action != 0
+	}
+
+	switch code {
+	case 'h':
+		fields := splitMilterStrings(data)
+		if allowed(MilterAddHeaders) && len(fields) >= 2 {
+			m.Headers = append(m.Headers, ms.milterHeader(fields[0], fields[1]))
+		}
+	case 'i', 'm':
+		if len(data) < 4 {
+			return
+		}
+		index := int(binary.BigEndian.Uint32(data))
+		fields := splitMilterStrings(data[4:])
+		if len(fields) < 2 {
+			return
+		}
+		if code == 'i' {
+			if allowed(MilterAddHeaders) == false {
+				return
+			}
+			if index > len(m.Headers) {
+				index = len(m.Headers)
+			}
+			headers := append([]*MessageHeader{}, m.Headers[:index]...)
+			headers = append(headers, ms.milterHeader(fields[0], fields[1]))
+			m.Headers = append(headers, m.Headers[index:]...)
+			return
+		}
+		if allowed(MilterChangeHeaders) == false {
+			return
+		}
+		// the index counts the fields of that name from 1
+		instances := m.GetAll(fields[0])
+		if index < 1 || index > len(instances) {
+			if fields[1] != "" && allowed(MilterAddHeaders) {
+				m.Headers = append(m.Headers, ms.milterHeader(fields[0], fields[1]))
+			}
+			return
+		}
+		if fields[1] == "" {
+			m.Remove(instances[index-1])
+			return
+		}
+		*instances[index-1] = *ms.milterHeader(fields[0], fields[1])
+	case '+', '2':
+		if allowed(MilterAddRcpt|MilterAddRcptParams) == false {
+			return
+		}
+		address := milterAddress(splitMilterStrings(data)[0])
+		for _, rcpt := range s.ForwardPath {
+			if strings.EqualFold(rcpt, address) {
+				return
+			}
+		}
+		s.ForwardPath = append(s.ForwardPath, address)
+	case '-':
+		if allowed(MilterDeleteRcpt) == false {
+			return
+		}
+		address := milterAddress(splitMilterStrings(data)[0])
+		var recipients []string
+		for _, rcpt := range s.ForwardPath {
+			if strings.EqualFold(rcpt, address) == false {
+				recipients = append(recipients, rcpt)
+			}
+		}
+		s.ForwardPath = recipients
+	case 'e':
+		if allowed(MilterChangeFrom) {
+			s.ReversePath = milterAddress(splitMilterStrings(data)[0])
+		}
+	case 'b':
+		if allowed(MilterChangeBody) {
+			if *body == nil {
+				*body = new(string)
+			}
+			**body += string(data)
+		}
+	case 'q':
+		if allowed(MilterQuarantine) {
+			s.Quarantine = splitMilterStrings(data)[0]
+		}
+	}
+}
+
+// Abort tells the milter the current message is given up, at RSET.
+func (ms *MilterSession) Abort(args ...string) *Reply {
+	if ms.conn != nil && ms.inMessage {
+		if ms.send('A', nil) != nil {
+			ms.fail(nil)
+		}
+	}
+	ms.inMessage = false
+	ms.skipMessage = false
+	ms.discard = false
+	return nil
+}
+
+// Quit ends the conversation with the milter, at QUIT.
+func (ms *MilterSession) Quit(args ...string) *Reply {
+	ms.Close()
+	return nil
+}
+
+// Close ends the conversation with the milter. It may be called several
+// times.
+func (ms *MilterSession) Close() error {
+	if ms.conn == nil {
+		return nil
+	}
+	ms.send('Q', nil)
+	err := ms.conn.Close()
+	ms.conn = nil
+	return err
+}
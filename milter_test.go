@@ -0,0 +1,373 @@
+package smtpserver
+
+import (
+	. "./testutil"
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/lestrrat/go-tcptest"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type MilterPacket struct {
+	Code byte
+	Data []byte
+}
+
+// FakeMilter is a milter answering the commands with Respond, continue by
+// default.
+type FakeMilter struct {
+	Listener net.Listener
+	Actions  uint32
+	Protocol uint32
+	Respond  func(code byte, data []byte) []MilterPacket
+
+	mu       sync.Mutex
+	Commands []MilterPacket
+}
+
+func StartFakeMilter(actions uint32, protocol uint32) *FakeMilter {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	f := &FakeMilter{Listener: listener, Actions: actions, Protocol: protocol}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *FakeMilter) Milter() *Milter {
+	return &Milter{Network: "tcp", Address: f.Listener.Addr().String(), Timeout: 5 * time.Second}
+}
+
+func (f *FakeMilter) Received(code byte) []MilterPacket {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var packets []MilterPacket
+	for _, p := range f.Commands {
+		if p.Code == code {
+			packets = append(packets, p)
+		}
+	}
+	return packets
+}
+
+func (f *FakeMilter) serve(conn net.Conn) {
+	defer conn.Close()
+	write := func(p MilterPacket) {
+		header := make([]byte, 5)
+		binary.BigEndian.PutUint32(header, uint32(1+len(p.Data)))
+		header[4] = p.Code
+		conn.Write(append(header, p.Data...))
+	}
+
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, packet); err != nil {
+			return
+		}
+		code, data := packet[0], packet[1:]
+		f.mu.Lock()
+		f.Commands = append(f.Commands, MilterPacket{code, data})
+		f.mu.Unlock()
+
+		switch code {
+		case 'O':
+			data := make([]byte, 12)
+			binary.BigEndian.PutUint32(data[0:], 6)
+			binary.BigEndian.PutUint32(data[4:], f.Actions)
+			binary.BigEndian.PutUint32(data[8:], f.Protocol)
+			write(MilterPacket{'O', data})
+			continue
+		case 'D', 'A':
+			continue
+		case 'Q':
+			return
+		}
+
+		var replies []MilterPacket
+		if f.Respond != nil {
+			replies = f.Respond(code, data)
+		}
+		if replies == nil {
+			replies = []MilterPacket{{'c', nil}}
+		}
+		for _, reply := range replies {
+			write(reply)
+		}
+	}
+}
+
+func TestMilterModifications(t *testing.T) {
+	fake := StartFakeMilter(milterActions, MilterNoData)
+	defer fake.Listener.Close()
+
+	index := func(n uint32, s ...string) []byte {
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, n)
+		return append(data, milterStrings(s...)...)
+	}
+	fake.Respond = func(code byte, data []byte) []MilterPacket {
+		if code != 'E' {
+			return nil
+		}
+		return []MilterPacket{
+			{'p', nil},
+			{'h', milterStrings("X-Spam-Score", "1.5")},
+			{'i', index(0, "X-Milter", "yes")},
+			{'m', index(1, "Subject", "[SPAM] Hello")},
+			{'m', index(1, "X-Mailer", "")},
+			{'+', milterStrings("<added@example.org>")},
+			{'-', milterStrings("<to@example.org>")},
+			{'b', []byte("Replaced.\r\n")},
+			{'q', milterStrings("suspicious")},
+			{'a', nil},
+		}
+	}
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	session := fake.Milter().Attach(s)
+	defer session.Close()
+
+	for _, step := range []struct {
+		name string
+		arg  string
+	}{
+		{"banner", ""},
+		{"EHLO", "client.example.net"},
+		{"MAIL", "from@example.net"},
+		{"RCPT", "to@example.org"},
+		{"DATA-INIT", ""},
+	} {
+		if reply := s.Callback(step.name, step.arg); reply.Success == 0 {
+			t.Errorf("%s refused: %+v", step.name, reply)
+		}
+	}
+	s.ForwardPath = []string{"to@example.org"}
+
+	message := "Subject: Hello\r\nX-Mailer:  folded\r\n\tvalue\r\n\r\nHello.\r\n"
+	args := []string{message}
+	if reply := session.EndOfMessage(args...); reply != nil {
+		t.Errorf("Message refused: %+v", reply)
+	}
+
+	expected := "X-Milter: yes\r\nSubject: [SPAM] Hello\r\nX-Spam-Score: 1.5\r\n\r\nReplaced.\r\n"
+	if args[0] != expected {
+		t.Error("Wrong message: " + args[0])
+	}
+	if len(s.ForwardPath) != 1 || s.ForwardPath[0] != "added@example.org" {
+		t.Errorf("Wrong recipients: %v", s.ForwardPath)
+	}
+	if s.Quarantine != "suspicious" {
+		t.Error("Message not quarantined")
+	}
+
+	// a second DATA event of the same message, as LMTP makes, replays the outcome
+	again := []string{message}
+	session.EndOfMessage(again...)
+	if again[0] != expected || len(fake.Received('E')) != 1 {
+		t.Error("End of message sent twice")
+	}
+
+	if p := fake.Received('C'); len(p) != 1 || string(p[0].Data) != "unknown\x00U" {
+		t.Errorf("Wrong connect: %q", p)
+	}
+	if p := fake.Received('H'); len(p) != 1 || string(p[0].Data) != "client.example.net\x00" {
+		t.Errorf("Wrong helo: %q", p)
+	}
+	if p := fake.Received('M'); len(p) != 1 || string(p[0].Data) != "<from@example.net>\x00" {
+		t.Errorf("Wrong sender: %q", p)
+	}
+	if p := fake.Received('T'); len(p) != 0 {
+		t.Error("DATA sent despite SMFIP_NODATA")
+	}
+	headers := fake.Received('L')
+	if len(headers) != 2 || string(headers[1].Data) != "X-Mailer\x00folded\n\tvalue\x00" {
+		t.Errorf("Wrong headers: %q", headers)
+	}
+	if p := fake.Received('B'); len(p) != 1 || string(p[0].Data) != "Hello.\r\n" {
+		t.Errorf("Wrong body: %q", p)
+	}
+}
+
+func TestMilterVerdicts(t *testing.T) {
+	fake := StartFakeMilter(0, 0)
+	defer fake.Listener.Close()
+
+	fake.Respond = func(code byte, data []byte) []MilterPacket {
+		switch {
+		case code == 'M' && strings.Contains(string(data), "busy"):
+			return []MilterPacket{{'t', nil}}
+		case code == 'R' && strings.Contains(string(data), "unknown"):
+			return []MilterPacket{{'y', milterStrings("550-5.1.1 No such user\r\n550 5.1.1 Go away")}}
+		case code == 'R' && strings.Contains(string(data), "spamtrap"):
+			return []MilterPacket{{'d', nil}}
+		}
+		return nil
+	}
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	session := fake.Milter().Attach(s)
+	defer session.Close()
+
+	if reply := session.Mail("busy@example.net"); reply == nil || reply.Code != 451 {
+		t.Errorf("Wrong MAIL reply: %+v", reply)
+	}
+
+	if reply := session.Mail("from@example.net"); reply != nil {
+		t.Errorf("Wrong MAIL reply: %+v", reply)
+	}
+	if len(fake.Received('A')) != 1 {
+		t.Error("Refused message not aborted")
+	}
+	if reply := session.Rcpt("unknown@example.org"); reply == nil || reply.Code != 550 || reply.Message != "5.1.1 No such user\n5.1.1 Go away" {
+		t.Errorf("Wrong RCPT reply: %+v", reply)
+	}
+	if reply := session.Rcpt("spamtrap@example.org"); reply != nil {
+		t.Errorf("Wrong RCPT reply: %+v", reply)
+	}
+	if reply := session.EndOfMessage("Subject: Hi\r\n\r\nHello.\r\n"); reply == nil || reply.Code != 250 {
+		t.Errorf("Discarded message not dropped: %+v", reply)
+	}
+	if len(fake.Received('L')) != 0 {
+		t.Error("Discarded message sent")
+	}
+}
+
+func TestMilterUnavailable(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	listener.Close()
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	milter := &Milter{Network: "tcp", Address: address, Timeout: time.Second}
+	if reply := milter.Attach(s).Connect(); reply != nil {
+		t.Errorf("Unavailable milter didn't fail open: %+v", reply)
+	}
+
+	milter.FailClosed = true
+	session := milter.Attach(s)
+	if reply := session.Connect(); reply == nil || reply.Code != 421 {
+		t.Errorf("Unavailable milter didn't fail closed: %+v", reply)
+	}
+	if reply := session.Rcpt("to@example.org"); reply == nil || reply.Code != 451 {
+		t.Errorf("Unavailable milter didn't fail closed: %+v", reply)
+	}
+}
+
+func TestMilterSession(t *testing.T) {
+	fake := StartFakeMilter(milterActions, 0)
+	defer fake.Listener.Close()
+	fake.Respond = func(code byte, data []byte) []MilterPacket {
+		if code == 'R' && strings.Contains(string(data), "unknown") {
+			return []MilterPacket{{'r', nil}}
+		}
+		if code == 'E' {
+			return []MilterPacket{{'h', milterStrings("X-Milter", "seen")}, {'c', nil}}
+		}
+		return nil
+	}
+
+	received := make(chan string, 1)
+	smtpd := func(port int) {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			panic(err)
+		}
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Printf("Accept Error: %v\n", err)
+				continue
+			}
+
+			smtp := &MySmtpServer{}
+			smtp.Init(&Option{Socket: conn})
+			session := fake.Milter().Attach(&smtp.Smtp)
+			smtp.SetCallback("DATA", func(args ...string) *Reply {
+				received <- args[0]
+				return &Reply{1, -1, ""}
+			})
+			smtp.Process()
+			session.Close()
+			conn.Close()
+		}
+	}
+
+	server, err := tcptest.Start(smtpd, 30*time.Second)
+	if err != nil {
+		t.Error("Failed to start smtpserver: ", err)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Error("Failed to connect to smtpserver")
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if res, _ := reader.ReadString('\n'); MatchRegex("^220 ", res) != true {
+		t.Error("Wrong Connection Response: " + res)
+	}
+	for _, step := range []struct {
+		command  string
+		response string
+	}{
+		{"HELO localhost", "250 "},
+		{"MAIL FROM: <from@example.net>", "250 "},
+		{"RCPT TO: <unknown@example.com>", "550 5.7.1 Command rejected"},
+		{"RCPT TO: <to@example.com>", "250 "},
+		{"DATA", "354 "},
+		{"Subject: Hi\r\n\r\nHello.\r\n.", "250 "},
+		{"QUIT", "221 "},
+	} {
+		fmt.Fprintf(conn, "%s\r\n", step.command)
+		if res, _ := reader.ReadString('\n'); strings.HasPrefix(res, step.response) == false {
+			t.Errorf("Wrong %s Response: %s", step.command, res)
+		}
+	}
+
+	select {
+	case message := <-received:
+		if strings.HasSuffix(message, "Subject: Hi\r\nX-Milter: seen\r\n\r\nHello.\r\n") == false {
+			t.Error("Wrong message: " + message)
+		}
+	case <-time.After(time.Second):
+		t.Error("Message not received")
+	}
+	// tcptest probes the port with a connection of its own
+	connects := fake.Received('C')
+	if p := connects[len(connects)-1]; strings.HasPrefix(string(p.Data), "[127.0.0.1]\x004") == false {
+		t.Errorf("Wrong connect: %q", p.Data)
+	}
+	for i := 0; i < 10 && len(fake.Received('Q')) < len(connects); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(fake.Received('Q')) != len(connects) {
+		t.Error("Milter not closed")
+	}
+}
@@ -11,10 +11,10 @@ type Pipelining struct {
 	OldHandleMore       bool
 }
 
-var GROUP_COMMANDS []string
+// GROUP_COMMANDS are the commands allowed before the last one of a group.
+var GROUP_COMMANDS = []string{"RSET", "MAIL", "SEND", "SOML", "SAML", "RCPT"}
 
 func (p *Pipelining) Init(parent *Esmtp) Extension {
-	GROUP_COMMANDS = []string{"RSET", "MAIL", "SEND", "SOML", "SAML", "RCPT"}
 	p.Parent = parent
 	return p
 }
@@ -0,0 +1,481 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// http://www.postfix.org/SMTPD_POLICY_README.html
+
+// Protocol states a policy service may be queried at.
+const (
+	PolicyConnect      = "CONNECT"
+	PolicyHelo         = "HELO"
+	PolicyMail         = "MAIL"
+	PolicyRcpt         = "RCPT"
+	PolicyData         = "DATA"
+	PolicyEndOfMessage = "END-OF-MESSAGE"
+	PolicyVrfy         = "VRFY"
+)
+
+// policyEvents gives the events of the protocol states.
+var policyEvents = map[string][]string{
+	PolicyConnect:      []string{"banner"},
+	PolicyHelo:         []string{"HELO", "EHLO", "LHLO"},
+	PolicyMail:         []string{"MAIL"},
+	PolicyRcpt:         []string{"RCPT"},
+	PolicyData:         []string{"DATA-INIT"},
+	PolicyEndOfMessage: []string{"DATA"},
+	PolicyVrfy:         []string{"VRFY"},
+}
+
+// PolicyRequest is the attributes of a policy delegation request.
+type PolicyRequest map[string]string
+
+// PolicyService is a Postfix policy delegation service (postfwd,
+// policyd-spf...). Connections are kept open and shared by the sessions:
+//
+//	policy.Attach(&s.Smtp)
+type PolicyService struct {
+	Network    string        // "tcp" or "unix"
+	Address    string        // e.g. "127.0.0.1:10040"
+	Stages     []string      // protocol states queried (default RCPT)
+	Timeout    time.Duration // connection and reply timeout (default 10s)
+	MaxIdle    int           // idle connections kept (default 4)
+	FailClosed bool          // tempfail when the service is unavailable instead of going on
+	Resolver   Resolver      // for the client names (default DefaultResolver)
+
+	mu   sync.Mutex
+	idle []*policyConn
+}
+
+type policyConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// PolicySession is the state of an SMTP session regarding the policy
+// service: the actions kept for the end of the message.
+type PolicySession struct {
+	Service *PolicyService
+	Smtp    *Smtp
+
+	instance string
+	messages int
+	prepend  []string
+	discard  bool
+	redirect string
+	bcc      []string
+
+	greeting string // verb of the greeting being checked
+
+	// names of the client, looked up once
+	names       bool
+	clientName  string
+	reverseName string
+
+	// LMTP makes one DATA event per recipient
+	eomDone  bool
+	eomData  string
+	eomReply *Reply
+}
+
+func (p *PolicyService) resolver() Resolver {
+	if p.Resolver == nil {
+		return DefaultResolver
+	}
+	return p.Resolver
+}
+
+func (p *PolicyService) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
+
+func (p *PolicyService) get() (*policyConn, bool, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, true, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := net.DialTimeout(p.Network, p.Address, p.timeout())
+	if err != nil {
+		return nil, false, err
+	}
+	return &policyConn{conn: conn, reader: bufio.NewReader(conn)}, false, nil
+}
+
+func (p *PolicyService) put(c *policyConn) {
+	max := p.MaxIdle
+	if max == 0 {
+		max = 4
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) >= max {
+		c.conn.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+}
+
+// Close closes the idle connections.
+func (p *PolicyService) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.idle {
+		c.conn.Close()
+	}
+	p.idle = nil
+}
+
+func (c *policyConn) query(request PolicyRequest, timeout time.Duration) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+
+	var names []string
+	for name := range request {
+		if name != "request" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("request=smtpd_access_policy\n")
+	for _, name := range names {
+		// the protocol has no escaping, line breaks can't be sent
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(request[name])
+		b.WriteString(name + "=" + value + "\n")
+	}
+	b.WriteString("\n")
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		return "", err
+	}
+
+	action := ""
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "action=") {
+			action = strings.TrimPrefix(line, "action=")
+		}
+	}
+	if action == "" {
+		return "", fmt.Errorf("policy reply without action")
+	}
+	return action, nil
+}
+
+// Query sends a request and returns the action of the reply. Pooled
+// connections closed by the service meanwhile are replaced.
+func (p *PolicyService) Query(request PolicyRequest) (string, error) {
+	for {
+		c, pooled, err := p.get()
+		if err != nil {
+			return "", err
+		}
+		action, err := c.query(request, p.timeout())
+		if err != nil {
+			c.conn.Close()
+			if pooled {
+				continue
+			}
+			return "", err
+		}
+		p.put(c)
+		return action, nil
+	}
+}
+
+// Attach registers the filters querying the service at the configured
+// protocol states of a session.
+func (p *PolicyService) Attach(s *Smtp) *PolicySession {
+	ps := &PolicySession{Service: p, Smtp: s}
+
+	stages := p.Stages
+	if stages == nil {
+		stages = []string{PolicyRcpt}
+	}
+
+	// the message state is reset first
+	s.AddFilter("MAIL", ps.reset)
+	for _, stage := range stages {
+		stage := stage
+		if stage == PolicyEndOfMessage {
+			s.AddFilter("DATA", ps.checkEndOfMessage)
+			continue
+		}
+		for _, event := range policyEvents[stage] {
+			event := event
+			s.AddFilter(event, func(args ...string) *Reply {
+				if stage == PolicyHelo {
+					ps.greeting = event
+				}
+				return ps.Check(stage, args...)
+			})
+		}
+	}
+	s.AddFilter("DATA", ps.EndOfMessage)
+	return ps
+}
+
+func (ps *PolicySession) reset(args ...string) *Reply {
+	ps.messages++
+	ps.instance = ""
+	ps.prepend = nil
+	ps.discard = false
+	ps.redirect = ""
+	ps.bcc = nil
+	ps.eomDone = false
+	return nil
+}
+
+// checkEndOfMessage queries the service once per message, the recipients
+// of an LMTP message getting the same reply.
+func (ps *PolicySession) checkEndOfMessage(args ...string) *Reply {
+	if ps.eomDone && args[0] == ps.eomData {
+		return ps.eomReply
+	}
+	reply := ps.Check(PolicyEndOfMessage, args...)
+	ps.eomDone = true
+	ps.eomData = args[0]
+	ps.eomReply = reply
+	return reply
+}
+
+// clientNames returns the name of the client address, as Postfix does:
+// the first name it resolves to and back for client_name, the first name
+// it resolves to for reverse_client_name, "unknown" if there is none.
+func (ps *PolicySession) clientNames() (string, string) {
+	if ps.names {
+		return ps.clientName, ps.reverseName
+	}
+	ps.names = true
+	ps.clientName, ps.reverseName = "unknown", "unknown"
+
+	ip := ps.Smtp.GetRemoteIP()
+	if ip == nil {
+		return ps.clientName, ps.reverseName
+	}
+	resolver := ps.Service.resolver()
+	names, err := resolver.LookupAddr(ip.String())
+	if err != nil || len(names) == 0 {
+		return ps.clientName, ps.reverseName
+	}
+	ps.reverseName = strings.TrimSuffix(names[0], ".")
+	for _, name := range names {
+		addrs, err := resolver.LookupHost(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if net.ParseIP(addr).Equal(ip) {
+				ps.clientName = strings.TrimSuffix(name, ".")
+				return ps.clientName, ps.reverseName
+			}
+		}
+	}
+	return ps.clientName, ps.reverseName
+}
+
+// Request builds the request attributes of a protocol state from the
+// session and the arguments of its event.
+func (ps *PolicySession) Request(stage string, args ...string) PolicyRequest {
+	s := ps.Smtp
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+
+	if ps.instance == "" {
+		ps.instance = fmt.Sprintf("%x.%d", time.Now().UnixNano(), ps.messages)
+	}
+
+	greeting := s.HeloVerb
+	if stage == PolicyHelo {
+		greeting = ps.greeting
+	}
+	protocol := "SMTP"
+	switch greeting {
+	case "EHLO":
+		protocol = "ESMTP"
+	case "LHLO":
+		protocol = "LMTP"
+	}
+	clientName, reverseName := ps.clientNames()
+
+	request := PolicyRequest{
+		"protocol_state":      stage,
+		"protocol_name":       protocol,
+		"helo_name":           s.HeloName,
+		"client_name":         clientName,
+		"reverse_client_name": reverseName,
+		"instance":            ps.instance,
+		"sasl_username":       s.AuthUser,
+		"recipient_count":     strconv.Itoa(s.CountRecipients()),
+	}
+	if ip := s.GetRemoteIP(); ip != nil {
+		request["client_address"] = ip.String()
+	}
+	request["sender"] = s.senderAddress()
+
+	switch stage {
+	case PolicyHelo:
+		request["helo_name"] = arg(0)
+	case PolicyMail:
+		request["sender"] = arg(0)
+	case PolicyRcpt, PolicyVrfy:
+		request["recipient"] = arg(0)
+	case PolicyEndOfMessage:
+		request["size"] = strconv.Itoa(len(arg(0)))
+	}
+	return request
+}
+
+// Check queries the service at a protocol state and maps the action onto
+// the reply of the event.
+func (ps *PolicySession) Check(stage string, args ...string) *Reply {
+	tempfail := &Reply{0, 451, "4.3.5 Server configuration problem"}
+	if stage == PolicyConnect {
+		tempfail = &Reply{0, 421, "4.3.5 Server configuration problem"}
+	}
+
+	action, err := ps.Service.Query(ps.Request(stage, args...))
+	if err != nil {
+		if ps.Service.FailClosed {
+			return tempfail
+		}
+		return nil
+	}
+
+	reply, err := ps.Apply(action)
+	if err != nil {
+		if ps.Service.FailClosed {
+			return tempfail
+		}
+		return nil
+	}
+	return reply
+}
+
+// policyText returns the text of a reply, with an enhanced status code.
+func policyText(text string, status string, fallback string) string {
+	if text == "" {
+		text = fallback
+	}
+	if len(text) >= 5 && text[1] == '.' && (text[0] == '4' || text[0] == '5') {
+		return text
+	}
+	return status + " " + text
+}
+
+// Apply maps an action onto a reply, keeping the actions affecting the
+// message for its end. DEFER_IF_PERMIT defers, as no other restriction
+// may reject afterwards; WARN, INFO, FILTER and DEFER_IF_REJECT don't
+// change the outcome.
+func (ps *PolicySession) Apply(action string) (*Reply, error) {
+	action = strings.TrimSpace(action)
+	verb, text := action, ""
+	if i := strings.IndexAny(action, " \t"); i >= 0 {
+		verb, text = action[:i], strings.TrimSpace(action[i+1:])
+	}
+
+	if len(verb) == 3 && (verb[0] == '4' || verb[0] == '5') {
+		code, err := strconv.Atoi(verb)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy action %q", action)
+		}
+		return &Reply{0, code, policyText(text, verb[:1]+".7.1", "Access denied")}, nil
+	}
+
+	switch strings.ToUpper(verb) {
+	case "OK", "DUNNO", "WARN", "INFO", "FILTER", "DEFER_IF_REJECT":
+		return nil, nil
+	case "REJECT":
+		return &Reply{0, 554, policyText(text, "5.7.1", "Access denied")}, nil
+	case "DEFER", "DEFER_IF_PERMIT":
+		return &Reply{0, 450, policyText(text, "4.7.1", "Service unavailable")}, nil
+	case "PREPEND":
+		if strings.Contains(text, ":") == false {
+			return nil, fmt.Errorf("invalid header field %q", text)
+		}
+		ps.prepend = append(ps.prepend, text)
+	case "HOLD":
+		if text == "" {
+			text = "held by policy service"
+		}
+		ps.Smtp.Quarantine = text
+	case "DISCARD":
+		ps.discard = true
+	case "REDIRECT":
+		if text == "" {
+			return nil, fmt.Errorf("REDIRECT without address")
+		}
+		ps.redirect = text
+	case "BCC":
+		if text == "" {
+			return nil, fmt.Errorf("BCC without address")
+		}
+		ps.bcc = append(ps.bcc, text)
+	default:
+		return nil, fmt.Errorf("unknown policy action %q", verb)
+	}
+	return nil, nil
+}
+
+// EndOfMessage applies the actions kept for the message: the header fields
+// to prepend, the recipient changes and the discard. It is registered
+// after the END-OF-MESSAGE query, so that its actions apply too.
+func (ps *PolicySession) EndOfMessage(args ...string) *Reply {
+	if ps.discard {
+		return &Reply{0, 250, "2.0.0 Ok: message discarded"}
+	}
+
+	s := ps.Smtp
+	if ps.redirect != "" {
+		s.ForwardPath = []string{ps.redirect}
+	}
+	for _, bcc := range ps.bcc {
+		found := false
+		for _, rcpt := range s.ForwardPath {
+			if strings.EqualFold(rcpt, bcc) {
+				found = true
+			}
+		}
+		if found == false {
+			s.ForwardPath = append(s.ForwardPath, bcc)
+		}
+	}
+
+	if len(ps.prepend) > 0 {
+		m := ParseMessage(args[0])
+		// the last action ends up on top, as Postfix does
+		for _, field := range ps.prepend {
+			i := strings.Index(field, ":")
+			m.Prepend(strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:]))
+		}
+		args[0] = m.String()
+	}
+	return nil
+}
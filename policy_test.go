@@ -0,0 +1,295 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// FakePolicyService answers the requests with Respond.
+type FakePolicyService struct {
+	Listener net.Listener
+	Respond  func(request PolicyRequest) string
+
+	mu          sync.Mutex
+	Requests    []PolicyRequest
+	Connections int
+}
+
+func StartFakePolicyService(respond func(request PolicyRequest) string) *FakePolicyService {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	f := &FakePolicyService{Listener: listener, Respond: respond}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.Connections++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *FakePolicyService) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	request := PolicyRequest{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line != "" {
+			kv := strings.SplitN(line, "=", 2)
+			request[kv[0]] = kv[1]
+			continue
+		}
+
+		f.mu.Lock()
+		f.Requests = append(f.Requests, request)
+		f.mu.Unlock()
+		action := f.Respond(request)
+		if action == "" {
+			// never answer
+			continue
+		}
+		fmt.Fprintf(conn, "action=%s\n\n", action)
+		request = PolicyRequest{}
+	}
+}
+
+func (f *FakePolicyService) Service(stages ...string) *PolicyService {
+	return &PolicyService{Network: "tcp", Address: f.Listener.Addr().String(), Stages: stages, Timeout: 200 * time.Millisecond}
+}
+
+func TestPolicyActions(t *testing.T) {
+	fake := StartFakePolicyService(func(request PolicyRequest) string {
+		switch request["recipient"] {
+		case "unknown@example.org":
+			return "REJECT No such user"
+		case "busy@example.org":
+			return "DEFER_IF_PERMIT"
+		case "quota@example.org":
+			return "552 5.2.2 Mailbox full"
+		case "held@example.org":
+			return "HOLD"
+		case "list@example.org":
+			return "PREPEND X-List: yes"
+		case "copy@example.org":
+			return "BCC archive@example.org"
+		case "bogus@example.org":
+			return "FROBNICATE"
+		}
+		if request["protocol_state"] == PolicyEndOfMessage {
+			return "PREPEND X-Size: " + request["size"]
+		}
+		return "DUNNO"
+	})
+	defer fake.Listener.Close()
+
+	service := fake.Service(PolicyRcpt, PolicyEndOfMessage)
+	defer service.Close()
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.HeloName = "client.example.net"
+	s.AuthUser = "joe"
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"1"}
+	session := service.Attach(s)
+
+	for rcpt, expected := range map[string]*Reply{
+		"unknown@example.org": &Reply{0, 554, "5.7.1 No such user"},
+		"busy@example.org":    &Reply{0, 450, "4.7.1 Service unavailable"},
+		"quota@example.org":   &Reply{0, 552, "5.2.2 Mailbox full"},
+	} {
+		if reply := s.Callback("RCPT", rcpt); *reply != *expected {
+			t.Errorf("Wrong reply for %s: %+v", rcpt, reply)
+		}
+	}
+	for _, rcpt := range []string{"held@example.org", "list@example.org", "copy@example.org", "bogus@example.org"} {
+		if reply := s.Callback("RCPT", rcpt); reply.Success == 0 {
+			t.Errorf("Wrong reply for %s: %+v", rcpt, reply)
+		}
+	}
+	if s.Quarantine == "" {
+		t.Error("Message not held")
+	}
+
+	request := fake.Requests[0]
+	if request["request"] != "smtpd_access_policy" || request["protocol_state"] != "RCPT" ||
+		request["helo_name"] != "client.example.net" || request["sender"] != "from@example.net" ||
+		request["sasl_username"] != "joe" || request["recipient"] == "" {
+		t.Errorf("Wrong request: %v", request)
+	}
+
+	s.ForwardPath = []string{"list@example.org", "copy@example.org"}
+	args := []string{"Subject: Hi\r\n\r\nHello.\r\n"}
+	if reply := s.Callback("DATA", args...); reply.Success == 0 {
+		t.Errorf("Message refused: %+v", reply)
+	}
+	if args[0] != "X-Size: 23\r\nX-List: yes\r\nSubject: Hi\r\n\r\nHello.\r\n" {
+		t.Error("Wrong message: " + args[0])
+	}
+	if len(s.ForwardPath) != 3 || s.ForwardPath[2] != "archive@example.org" {
+		t.Errorf("Wrong recipients: %v", s.ForwardPath)
+	}
+
+	// a single connection serves all the requests
+	if fake.Connections != 1 {
+		t.Errorf("%d connections opened", fake.Connections)
+	}
+
+	session.reset()
+	if _, err := session.Apply("DISCARD"); err != nil {
+		t.Fatal(err)
+	}
+	if reply := session.EndOfMessage("Subject: Hi\r\n\r\nHello.\r\n"); reply == nil || reply.Code != 250 {
+		t.Errorf("Message not discarded: %+v", reply)
+	}
+}
+
+func TestPolicyUnavailable(t *testing.T) {
+	fake := StartFakePolicyService(func(request PolicyRequest) string {
+		return ""
+	})
+	defer fake.Listener.Close()
+
+	s := &Smtp{}
+	s.Init(&Option{})
+
+	service := fake.Service(PolicyConnect, PolicyRcpt)
+	session := service.Attach(s)
+	if reply := session.Check(PolicyRcpt, "to@example.org"); reply != nil {
+		t.Errorf("Timeout didn't fail open: %+v", reply)
+	}
+
+	service.FailClosed = true
+	if reply := session.Check(PolicyRcpt, "to@example.org"); reply == nil || reply.Code != 451 {
+		t.Errorf("Timeout didn't fail closed: %+v", reply)
+	}
+
+	fake.Listener.Close()
+	service.Address = fake.Listener.Addr().String()
+	if reply := session.Check(PolicyConnect); reply == nil || reply.Code != 421 {
+		t.Errorf("Connection failure didn't fail closed: %+v", reply)
+	}
+}
+
+func TestPolicySession(t *testing.T) {
+	fake := StartFakePolicyService(func(request PolicyRequest) string {
+		if request["protocol_state"] == PolicyEndOfMessage {
+			return "PREPEND X-Policy: checked"
+		}
+		return "DUNNO"
+	})
+	defer fake.Listener.Close()
+	service := fake.Service(PolicyHelo, PolicyEndOfMessage)
+	service.Resolver = &FakeResolver{
+		Addr:  map[string][]string{"127.0.0.1": []string{"client.example.net."}},
+		Hosts: map[string][]string{"client.example.net": []string{"127.0.0.1"}},
+	}
+	defer service.Close()
+
+	var mu sync.Mutex
+	var messages []string
+	session := func(lmtp bool, commands []string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var s *Smtp
+			var process func() bool
+			if lmtp {
+				l := &Lmtp{}
+				l.Init(&Option{Socket: conn})
+				s, process = &l.Smtp, l.Process
+			} else {
+				e := &Esmtp{}
+				e.Init(&Option{Socket: conn})
+				s, process = &e.Smtp, e.Process
+			}
+			service.Attach(s)
+			s.SetCallback("DATA", func(args ...string) *Reply {
+				mu.Lock()
+				messages = append(messages, args[0])
+				mu.Unlock()
+				return &Reply{1, 250, "2.0.0 Ok"}
+			})
+			process()
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		reader.ReadString('\n')
+		for _, command := range commands {
+			fmt.Fprintf(conn, "%s\r\n", command)
+			for {
+				reply, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(reply) > 3 && reply[3] == ' ' {
+					break
+				}
+			}
+		}
+		// one more reply per recipient with LMTP
+		if lmtp {
+			reader.ReadString('\n')
+		}
+		conn.Close()
+		<-done
+	}
+
+	session(false, []string{"EHLO client.example.net", "MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "DATA", "Subject: Hi\r\n\r\nHello.\r\n.", "QUIT"})
+	session(true, []string{"LHLO client.example.net", "MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "RCPT TO:<c@example.com>", "DATA", "Subject: Hi\r\n\r\nHello.\r\n."})
+
+	fake.mu.Lock()
+	requests := fake.Requests
+	fake.mu.Unlock()
+	var states, protocols []string
+	for _, request := range requests {
+		states = append(states, request["protocol_state"])
+		protocols = append(protocols, request["protocol_name"])
+		if request["client_name"] != "client.example.net" || request["reverse_client_name"] != "client.example.net" {
+			t.Errorf("Wrong client names: %v", request)
+		}
+	}
+	// the LMTP message is checked once for its recipients
+	if strings.Join(states, ",") != "HELO,END-OF-MESSAGE,HELO,END-OF-MESSAGE" || strings.Join(protocols, ",") != "ESMTP,ESMTP,LMTP,LMTP" {
+		t.Errorf("Wrong requests: %v %v", states, protocols)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Wrong messages: %q", messages)
+	}
+	for _, message := range messages {
+		if message != "X-Policy: checked\r\nSubject: Hi\r\n\r\nHello.\r\n" {
+			t.Errorf("Wrong message: %q", message)
+		}
+	}
+}
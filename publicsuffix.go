@@ -0,0 +1,100 @@
+package smtpserver
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"strings"
+	"sync"
+)
+
+// https://publicsuffix.org/list/
+
+// PublicSuffixList holds the rules of a public suffix list.
+type PublicSuffixList struct {
+	mu         sync.RWMutex
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+// Load reads rules in the format of public_suffix_list.dat, adding them to
+// the current ones.
+func (l *PublicSuffixList) Load(r io.Reader) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rules == nil {
+		l.rules = make(map[string]bool)
+		l.wildcards = make(map[string]bool)
+		l.exceptions = make(map[string]bool)
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "//") {
+			continue
+		}
+		rule := strings.ToLower(fields[0])
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			l.exceptions[rule[1:]] = true
+		case strings.HasPrefix(rule, "*."):
+			l.wildcards[rule[2:]] = true
+		default:
+			l.rules[rule] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// PublicSuffix returns the public suffix of a domain. Unknown top-level
+// domains are public suffixes.
+func (l *PublicSuffixList) PublicSuffix(domain string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	labels := strings.Split(domain, ".")
+
+	// the longest matching rule prevails, exceptions first
+	for i := 0; i < len(labels); i++ {
+		suffix := strings.Join(labels[i:], ".")
+		if l.exceptions[suffix] {
+			return strings.Join(labels[i+1:], ".")
+		}
+		if i+1 < len(labels) && l.wildcards[strings.Join(labels[i+1:], ".")] {
+			return suffix
+		}
+		if l.rules[suffix] {
+			return suffix
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// OrganizationalDomain returns the public suffix of a domain and one more
+// label, or the domain itself if it is a public suffix.
+func (l *PublicSuffixList) OrganizationalDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	suffix := l.PublicSuffix(domain)
+	if suffix == domain {
+		return domain
+	}
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	labels := strings.Split(rest, ".")
+	return labels[len(labels)-1] + "." + suffix
+}
+
+// DefaultPublicSuffixList is built from the public suffix list embedded in
+// the package, public_suffix_list.dat. Deployments keeping an up to date copy
+// Load it into a new PublicSuffixList.
+var DefaultPublicSuffixList = &PublicSuffixList{}
+
+//go:embed public_suffix_list.dat
+var embeddedPublicSuffixes string
+
+func init() {
+	DefaultPublicSuffixList.Load(strings.NewReader(embeddedPublicSuffixes))
+}
@@ -0,0 +1,556 @@
+// Package queue is a persistent mail queue. Each entry is a message file
+// and an envelope file, both written to a temporary file, synced and
+// renamed into place; the envelope is written last, so an entry exists
+// once its envelope does. The directory of the envelope gives the state
+// of the entry:
+//
+//	<dir>/tmp/        files being written
+//	<dir>/data/       messages
+//	<dir>/incoming/   envelopes of new entries
+//	<dir>/active/     envelopes of entries being delivered
+//	<dir>/deferred/   envelopes of entries waiting for a retry
+//	<dir>/hold/       envelopes of entries set aside by the administrator
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of the entries.
+const (
+	Incoming = "incoming"
+	Active   = "active"
+	Deferred = "deferred"
+	Hold     = "hold"
+)
+
+// States lists the states in the order entries go through them.
+var States = []string{Incoming, Active, Deferred, Hold}
+
+// ErrNotFound is returned for unknown queue IDs, or entries not in the
+// expected state.
+var ErrNotFound = errors.New("queue: no such entry")
+
+// Delivery status of the recipients.
+const (
+	Pending   = ""
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// Recipient is a recipient of an entry and the outcome of its delivery.
+type Recipient struct {
+	Address    string
+	Notify     []string `json:",omitempty"` // DSN NOTIFY: NEVER, or SUCCESS, FAILURE and DELAY
+	ORcpt      string   `json:",omitempty"` // DSN original recipient, e.g. "rfc822;joe@example.org"
+	Status     string   `json:",omitempty"`
+	Diagnostic string   `json:",omitempty"` // last reply, e.g. "550 5.1.1 User unknown"
+	RemoteMTA  string   `json:",omitempty"` // host the reply came from, if any
+	Relayed    bool     `json:",omitempty"` // delivered to an SMTP server rather than a mailbox
+	Notified   bool     `json:",omitempty"` // the sender was notified of the outcome
+}
+
+// Envelope is the envelope of an entry and its delivery history.
+type Envelope struct {
+	ID          string
+	From        string // "" for the null reverse path
+	Recipients  []*Recipient
+	Helo        string `json:",omitempty"`
+	ClientIP    string `json:",omitempty"`
+	AuthUser    string `json:",omitempty"`
+	HoldReason  string `json:",omitempty"` // an entry with a reason is enqueued on hold
+	Ret         string `json:",omitempty"` // DSN RET: FULL or HDRS
+	EnvID       string `json:",omitempty"` // DSN envelope identifier
+	Created     time.Time
+	Attempts    int
+	NextAttempt time.Time `json:",omitempty"`
+	LastError   string    `json:",omitempty"`
+	Delayed     bool      `json:",omitempty"` // the sender was notified of the delay
+}
+
+// Entry is an entry as found in the queue.
+type Entry struct {
+	Envelope
+	State string
+	Size  int64 // size of the message
+}
+
+// Pending returns the recipients not delivered nor failed yet.
+func (env *Envelope) Pending() []*Recipient {
+	var pending []*Recipient
+	for _, rcpt := range env.Recipients {
+		if rcpt.Status == Pending {
+			pending = append(pending, rcpt)
+		}
+	}
+	return pending
+}
+
+// Queue is a queue directory. Its methods are safe for concurrent use by
+// the sessions and the delivery agents of a process; a directory must not
+// be shared by several processes.
+type Queue struct {
+	Dir string
+
+	mu sync.Mutex
+}
+
+// Recipients builds the recipients of an envelope from addresses.
+func Recipients(addresses []string) []*Recipient {
+	var recipients []*Recipient
+	for _, address := range addresses {
+		recipients = append(recipients, &Recipient{Address: address})
+	}
+	return recipients
+}
+
+// Open opens a queue directory, creating it if needed, and recovers the
+// entries left over by a crash.
+func Open(dir string) (*Queue, error) {
+	q := &Queue{Dir: dir}
+	for _, sub := range append([]string{"tmp", "data"}, States...) {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.Recover(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) dataPath(id string) string {
+	return filepath.Join(q.Dir, "data", id)
+}
+
+func (q *Queue) envelopePath(state string, id string) string {
+	return filepath.Join(q.Dir, state, id)
+}
+
+// validID rejects IDs that would escape the queue directory.
+func validID(id string) bool {
+	return id != "" && strings.ContainsAny(id, "/\\.") == false
+}
+
+// newID returns a queue ID unique in the directory: the creation time and
+// random bits, reserved by creating the message file.
+func (q *Queue) newID() (string, *os.File, error) {
+	for {
+		var random [5]byte
+		if _, err := rand.Read(random[:]); err != nil {
+			return "", nil, err
+		}
+		id := strings.ToUpper(fmt.Sprintf("%x%s", time.Now().Unix(), hex.EncodeToString(random[:])))
+		f, err := os.OpenFile(filepath.Join(q.Dir, "tmp", id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := os.Stat(q.dataPath(id)); err == nil {
+			f.Close()
+			os.Remove(f.Name())
+			continue
+		}
+		return id, f, nil
+	}
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// commit syncs and closes a temporary file, then renames it.
+func commit(f *os.File, path string) error {
+	err := f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeEnvelope writes an envelope atomically.
+func (q *Queue) writeEnvelope(state string, env *Envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Join(q.Dir, "tmp"), env.ID+".env.")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return commit(f, q.envelopePath(state, env.ID))
+}
+
+// Enqueue spools a message and returns its queue ID. The entry is
+// incoming, or on hold if the envelope has a HoldReason. It is on disk
+// when Enqueue returns.
+func (q *Queue) Enqueue(env *Envelope, message []byte) (string, error) {
+	if len(env.Recipients) == 0 {
+		return "", errors.New("queue: no recipients")
+	}
+
+	id, f, err := q.newID()
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(message); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := commit(f, q.dataPath(id)); err != nil {
+		return "", err
+	}
+
+	env.ID = id
+	if env.Created.IsZero() {
+		env.Created = time.Now()
+	}
+	state := Incoming
+	if env.HoldReason != "" {
+		state = Hold
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.writeEnvelope(state, env); err != nil {
+		os.Remove(q.dataPath(id))
+		return "", err
+	}
+	return id, nil
+}
+
+func (q *Queue) read(state string, id string) (*Entry, error) {
+	b, err := ioutil.ReadFile(q.envelopePath(state, id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{State: state}
+	if err := json.Unmarshal(b, &entry.Envelope); err != nil {
+		return nil, fmt.Errorf("queue: corrupt envelope %s: %v", id, err)
+	}
+	entry.ID = id
+	if fi, err := os.Stat(q.dataPath(id)); err == nil {
+		entry.Size = fi.Size()
+	}
+	return entry, nil
+}
+
+// find returns an entry, whatever its state.
+func (q *Queue) find(id string) (*Entry, error) {
+	if validID(id) == false {
+		return nil, ErrNotFound
+	}
+	for _, state := range States {
+		entry, err := q.read(state, id)
+		if err != ErrNotFound {
+			return entry, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Get returns an entry.
+func (q *Queue) Get(id string) (*Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.find(id)
+}
+
+// Message opens the message of an entry.
+func (q *Queue) Message(id string) (io.ReadCloser, error) {
+	if validID(id) == false {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(q.dataPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// List returns the entries in the given states, all of them if none is
+// given, oldest first.
+func (q *Queue) List(states ...string) ([]*Entry, error) {
+	if len(states) == 0 {
+		states = States
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var entries []*Entry
+	for _, state := range states {
+		names, err := readNames(filepath.Join(q.Dir, state))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range names {
+			entry, err := q.read(state, id)
+			if err == ErrNotFound {
+				// moved meanwhile
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+func readNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+// move moves an entry from one of the states from to the state to,
+// applying change to its envelope on the way.
+func (q *Queue) move(id string, from []string, to string, change func(entry *Entry)) (*Entry, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, err := q.find(id)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, state := range from {
+		if entry.State == state {
+			found = true
+		}
+	}
+	if found == false {
+		return nil, ErrNotFound
+	}
+
+	if change != nil {
+		change(entry)
+		if err := q.writeEnvelope(entry.State, &entry.Envelope); err != nil {
+			return nil, err
+		}
+	}
+	if to != entry.State {
+		if err := os.Rename(q.envelopePath(entry.State, id), q.envelopePath(to, id)); err != nil {
+			return nil, err
+		}
+		if err := syncDir(filepath.Join(q.Dir, to)); err != nil {
+			return nil, err
+		}
+		if err := syncDir(filepath.Join(q.Dir, entry.State)); err != nil {
+			return nil, err
+		}
+		entry.State = to
+	}
+	return entry, nil
+}
+
+// Hold sets an entry aside until it is released. Active entries can't be
+// held.
+func (q *Queue) Hold(id string, reason string) error {
+	_, err := q.move(id, []string{Incoming, Deferred, Hold}, Hold, func(entry *Entry) {
+		entry.HoldReason = reason
+	})
+	return err
+}
+
+// Release makes an entry on hold due for delivery.
+func (q *Queue) Release(id string) error {
+	_, err := q.move(id, []string{Hold}, Incoming, func(entry *Entry) {
+		entry.HoldReason = ""
+		entry.NextAttempt = time.Time{}
+	})
+	return err
+}
+
+// Delete removes an entry. Active entries can't be deleted.
+func (q *Queue) Delete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if entry.State == Active {
+		return fmt.Errorf("queue: entry %s is being delivered", id)
+	}
+	return q.remove(entry)
+}
+
+// remove deletes the envelope first, so that a crash leaves an orphan
+// message for Recover rather than an envelope without message.
+func (q *Queue) remove(entry *Entry) error {
+	if err := os.Remove(q.envelopePath(entry.State, entry.ID)); err != nil {
+		return err
+	}
+	if err := os.Remove(q.dataPath(entry.ID)); err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	return syncDir(filepath.Join(q.Dir, entry.State))
+}
+
+// Due returns the incoming entries and the deferred entries whose retry
+// time has come, oldest first.
+func (q *Queue) Due(now time.Time) ([]*Entry, error) {
+	entries, err := q.List(Incoming, Deferred)
+	if err != nil {
+		return nil, err
+	}
+	var due []*Entry
+	for _, entry := range entries {
+		if entry.State == Incoming || entry.NextAttempt.After(now) == false {
+			due = append(due, entry)
+		}
+	}
+	return due, nil
+}
+
+// Activate takes an incoming or deferred entry for delivery.
+func (q *Queue) Activate(id string) (*Entry, error) {
+	return q.move(id, []string{Incoming, Deferred}, Active, nil)
+}
+
+// Update rewrites the envelope of an entry, e.g. the recipients delivered
+// so far.
+func (q *Queue) Update(entry *Entry) error {
+	_, err := q.move(entry.ID, []string{entry.State}, entry.State, func(e *Entry) {
+		e.Envelope = entry.Envelope
+	})
+	return err
+}
+
+// Defer puts an active entry back, to be retried at next.
+func (q *Queue) Defer(entry *Entry, next time.Time, reason string) error {
+	moved, err := q.move(entry.ID, []string{Active}, Deferred, func(e *Entry) {
+		e.Envelope = entry.Envelope
+		e.Attempts++
+		e.NextAttempt = next
+		e.LastError = reason
+	})
+	if err == nil {
+		*entry = *moved
+	}
+	return err
+}
+
+// Complete removes an active entry once delivered or bounced.
+func (q *Queue) Complete(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry, err := q.find(id)
+	if err != nil {
+		return err
+	}
+	if entry.State != Active {
+		return ErrNotFound
+	}
+	return q.remove(entry)
+}
+
+// Recover repairs the directory after a crash: files being written are
+// removed, entries being delivered are put back in incoming, and messages
+// without envelope are removed, as are envelopes without message.
+func (q *Queue) Recover() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	tmp := filepath.Join(q.Dir, "tmp")
+	names, err := readNames(tmp)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(tmp, name)); err != nil {
+			return err
+		}
+	}
+
+	names, err = readNames(filepath.Join(q.Dir, Active))
+	if err != nil {
+		return err
+	}
+	for _, id := range names {
+		if err := os.Rename(q.envelopePath(Active, id), q.envelopePath(Incoming, id)); err != nil {
+			return err
+		}
+	}
+
+	envelopes := map[string]bool{}
+	for _, state := range States {
+		names, err := readNames(filepath.Join(q.Dir, state))
+		if err != nil {
+			return err
+		}
+		for _, id := range names {
+			if _, err := os.Stat(q.dataPath(id)); os.IsNotExist(err) {
+				if err := os.Remove(q.envelopePath(state, id)); err != nil {
+					return err
+				}
+				continue
+			}
+			envelopes[id] = true
+		}
+	}
+
+	names, err = readNames(filepath.Join(q.Dir, "data"))
+	if err != nil {
+		return err
+	}
+	for _, id := range names {
+		if envelopes[id] == false {
+			if err := os.Remove(q.dataPath(id)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sub := range append([]string{"tmp", "data"}, States...) {
+		if err := syncDir(filepath.Join(q.Dir, sub)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempQueue(t *testing.T) *Queue {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestEnqueue(t *testing.T) {
+	q := tempQueue(t)
+	defer os.RemoveAll(q.Dir)
+
+	env := &Envelope{From: "from@example.net", Recipients: Recipients([]string{"a@example.org", "b@example.org"})}
+	id, err := q.Enqueue(env, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := q.Enqueue(&Envelope{Recipients: Recipients([]string{"c@example.org"})}, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id == other || validID(id) == false {
+		t.Errorf("Wrong queue IDs %s and %s", id, other)
+	}
+	if _, err := q.Enqueue(&Envelope{}, []byte("x")); err == nil {
+		t.Error("Entry without recipients accepted")
+	}
+
+	entry, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.State != Incoming || entry.From != "from@example.net" || len(entry.Recipients) != 2 ||
+		entry.Recipients[1].Address != "b@example.org" || entry.Size != 23 || entry.Created.IsZero() {
+		t.Errorf("Wrong entry: %+v", entry)
+	}
+	r, err := q.Message(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	r.Close()
+	if string(data) != "Subject: Hi\r\n\r\nHello.\r\n" {
+		t.Errorf("Wrong message: %q", data)
+	}
+
+	if entries, _ := q.List(); len(entries) != 2 || entries[0].ID != id {
+		t.Errorf("Wrong entries: %v", entries)
+	}
+	if _, err := q.Get("../data/" + id); err != ErrNotFound {
+		t.Errorf("Path accepted as queue ID: %v", err)
+	}
+	if names, _ := readNames(filepath.Join(q.Dir, "tmp")); len(names) != 0 {
+		t.Errorf("Temporary files left: %v", names)
+	}
+}
+
+func TestStates(t *testing.T) {
+	q := tempQueue(t)
+	defer os.RemoveAll(q.Dir)
+
+	id, err := q.Enqueue(&Envelope{Recipients: Recipients([]string{"a@example.org"}), HoldReason: "policy"}, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := q.Get(id); entry.State != Hold || entry.HoldReason != "policy" {
+		t.Errorf("Entry not held: %+v", entry)
+	}
+	if due, _ := q.Due(time.Now()); len(due) != 0 {
+		t.Error("Held entry due")
+	}
+
+	if err := q.Release(id); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ := q.Due(time.Now()); len(due) != 1 || due[0].ID != id {
+		t.Errorf("Released entry not due: %v", due)
+	}
+
+	entry, err := q.Activate(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Hold(id, "admin"); err != ErrNotFound {
+		t.Errorf("Active entry held: %v", err)
+	}
+	if err := q.Delete(id); err == nil {
+		t.Error("Active entry deleted")
+	}
+
+	next := time.Now().Add(time.Hour)
+	if err := q.Defer(entry, next, "421 try later"); err != nil {
+		t.Fatal(err)
+	}
+	if entry.State != Deferred || entry.Attempts != 1 || entry.LastError != "421 try later" {
+		t.Errorf("Wrong deferred entry: %+v", entry)
+	}
+	if due, _ := q.Due(time.Now()); len(due) != 0 {
+		t.Error("Deferred entry due early")
+	}
+	if due, _ := q.Due(next); len(due) != 1 {
+		t.Error("Deferred entry not due")
+	}
+
+	if _, err := q.Activate(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Complete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Get(id); err != ErrNotFound {
+		t.Errorf("Completed entry found: %v", err)
+	}
+	if _, err := os.Stat(q.dataPath(id)); os.IsNotExist(err) == false {
+		t.Error("Message of completed entry left")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	q := tempQueue(t)
+	defer os.RemoveAll(q.Dir)
+
+	active, _ := q.Enqueue(&Envelope{Recipients: Recipients([]string{"a@example.org"})}, []byte("x"))
+	q.Activate(active)
+	deleted, _ := q.Enqueue(&Envelope{Recipients: Recipients([]string{"a@example.org"})}, []byte("x"))
+	os.Remove(q.dataPath(deleted))
+	ioutil.WriteFile(filepath.Join(q.Dir, "tmp", "partial"), []byte("x"), 0600)
+	ioutil.WriteFile(q.dataPath("ORPHAN"), []byte("x"), 0600)
+
+	q, err := Open(q.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := q.List()
+	if len(entries) != 1 || entries[0].ID != active || entries[0].State != Incoming {
+		t.Errorf("Wrong entries after recovery: %v", entries)
+	}
+	for _, sub := range []string{"tmp", "data"} {
+		names, _ := readNames(filepath.Join(q.Dir, sub))
+		if (sub == "tmp" && len(names) != 0) || (sub == "data" && len(names) != 1) {
+			t.Errorf("Wrong files in %s after recovery: %v", sub, names)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package smtpserver
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate configures a token bucket: Burst events at once, refilled at
+// PerSecond events per second. A zero Burst disables the limit.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+type tokenBucket struct {
+	Rate   Rate
+	Tokens float64
+	Last   time.Time
+}
+
+func (b *tokenBucket) Refill(now time.Time) {
+	b.Tokens += now.Sub(b.Last).Seconds() * b.Rate.PerSecond
+	if b.Tokens > float64(b.Rate.Burst) {
+		b.Tokens = float64(b.Rate.Burst)
+	}
+	b.Last = now
+}
+
+func (b *tokenBucket) Take(now time.Time) bool {
+	b.Refill(now)
+
+	if b.Tokens < 1 {
+		return false
+	}
+	b.Tokens--
+	return true
+}
+
+// ConnectionLimiter bounds the concurrent sessions and the rate of
+// connections, messages and recipients of the clients. A single
+// ConnectionLimiter is meant to be shared by all the sessions through
+// Option. A zero value disables the corresponding limit.
+type ConnectionLimiter struct {
+	MaxSessions    int  // concurrent sessions
+	MaxPerIP       int  // concurrent sessions per address
+	MaxPerNetwork  int  // concurrent sessions per /24 (IPv4) or /64 (IPv6)
+	ConnectionRate Rate // per address
+	MessageRate    Rate // per address
+	RecipientRate  Rate // per address
+
+	mu         sync.Mutex
+	sessions   int
+	perIP      map[string]int
+	perNetwork map[string]int
+	buckets    map[string]*tokenBucket
+	swept      time.Time
+}
+
+// sweepInterval is how often the state kept about clients is swept of
+// what is no longer needed, e.g. the token buckets which are full again.
+const sweepInterval = time.Minute
+
+// ConnectionCounts is a snapshot of the concurrent sessions.
+type ConnectionCounts struct {
+	Sessions int
+	IP       int
+	Network  int
+}
+
+func NetworkKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+func (l *ConnectionLimiter) init() {
+	if l.perIP == nil {
+		l.perIP = make(map[string]int)
+		l.perNetwork = make(map[string]int)
+		l.buckets = make(map[string]*tokenBucket)
+	}
+}
+
+// Open registers a new session of the client. It returns false, without
+// registering anything, if a limit is exceeded.
+func (l *ConnectionLimiter) Open(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	addr, network := ip.String(), NetworkKey(ip)
+
+	if l.MaxSessions > 0 && l.sessions >= l.MaxSessions {
+		return false
+	}
+	if l.MaxPerIP > 0 && l.perIP[addr] >= l.MaxPerIP {
+		return false
+	}
+	if l.MaxPerNetwork > 0 && l.perNetwork[network] >= l.MaxPerNetwork {
+		return false
+	}
+	if l.take("connection", addr, l.ConnectionRate) == false {
+		return false
+	}
+
+	l.sessions++
+	l.perIP[addr]++
+	l.perNetwork[network]++
+	return true
+}
+
+// Close unregisters a session opened with Open.
+func (l *ConnectionLimiter) Close(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	addr, network := ip.String(), NetworkKey(ip)
+
+	l.sessions--
+	if l.perIP[addr]--; l.perIP[addr] <= 0 {
+		delete(l.perIP, addr)
+	}
+	if l.perNetwork[network]--; l.perNetwork[network] <= 0 {
+		delete(l.perNetwork, network)
+	}
+}
+
+func (l *ConnectionLimiter) AllowMessage(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.take("message", ip.String(), l.MessageRate)
+}
+
+func (l *ConnectionLimiter) AllowRecipient(ip net.IP) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+	return l.take("recipient", ip.String(), l.RecipientRate)
+}
+
+func (l *ConnectionLimiter) take(kind string, addr string, rate Rate) bool {
+	if rate.Burst <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	key := kind + " " + addr
+	b, ok := l.buckets[key]
+	if ok == false {
+		b = &tokenBucket{Rate: rate, Tokens: float64(rate.Burst), Last: now}
+		l.buckets[key] = b
+	}
+	allowed := b.Take(now)
+
+	// forget the buckets which are full again, from time to time rather
+	// than at each check: a full bucket is as good as none
+	if now.Sub(l.swept) >= sweepInterval {
+		l.swept = now
+		for k, other := range l.buckets {
+			if other.Refill(now); other.Tokens >= float64(other.Rate.Burst) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	return allowed
+}
+
+// Counts returns the current number of sessions, in total, of the address
+// and of its network.
+func (l *ConnectionLimiter) Counts(ip net.IP) *ConnectionCounts {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.init()
+
+	return &ConnectionCounts{
+		Sessions: l.sessions,
+		IP:       l.perIP[ip.String()],
+		Network:  l.perNetwork[NetworkKey(ip)],
+	}
+}
+
+func (c *ConnectionCounts) Arguments() []string {
+	return []string{strconv.Itoa(c.Sessions), strconv.Itoa(c.IP), strconv.Itoa(c.Network)}
+}
@@ -0,0 +1,141 @@
+package smtpserver
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiterConcurrency(t *testing.T) {
+	limiter := &ConnectionLimiter{MaxSessions: 3, MaxPerIP: 1, MaxPerNetwork: 2}
+	a := net.ParseIP("192.0.2.1")
+	b := net.ParseIP("192.0.2.2")
+	c := net.ParseIP("192.0.2.3")
+	d := net.ParseIP("2001:db8::1")
+
+	if limiter.Open(a) != true {
+		t.Error("First session refused")
+	}
+	if limiter.Open(a) != false {
+		t.Error("Second session of the same address accepted")
+	}
+	if limiter.Open(b) != true {
+		t.Error("Session of the same network refused")
+	}
+	if limiter.Open(c) != false {
+		t.Error("Third session of the same network accepted")
+	}
+	if limiter.Open(d) != true {
+		t.Error("IPv6 session refused")
+	}
+	if counts := limiter.Counts(a); counts.Sessions != 3 || counts.IP != 1 || counts.Network != 2 {
+		t.Errorf("Wrong counts: %+v", counts)
+	}
+
+	limiter.Close(a)
+	if limiter.Open(c) != true {
+		t.Error("Session refused after close")
+	}
+}
+
+func TestConnectionLimiterRate(t *testing.T) {
+	limiter := &ConnectionLimiter{RecipientRate: Rate{PerSecond: 0.001, Burst: 2}}
+	ip := net.ParseIP("192.0.2.1")
+
+	if limiter.AllowRecipient(ip) != true || limiter.AllowRecipient(ip) != true {
+		t.Error("Burst refused")
+	}
+	if limiter.AllowRecipient(ip) != false {
+		t.Error("Rate limit not enforced")
+	}
+	if limiter.AllowRecipient(net.ParseIP("192.0.2.2")) != true {
+		t.Error("Other address limited")
+	}
+	if limiter.AllowMessage(ip) != true {
+		t.Error("Unlimited message rate enforced")
+	}
+}
+
+func TestConnectionLimiterSweep(t *testing.T) {
+	limiter := &ConnectionLimiter{MessageRate: Rate{PerSecond: 100, Burst: 1}}
+	for i := 1; i <= 100; i++ {
+		limiter.AllowMessage(net.IPv4(192, 0, 2, byte(i)))
+	}
+	if len(limiter.buckets) != 100 {
+		t.Errorf("Buckets swept at each check: %d", len(limiter.buckets))
+	}
+
+	// once due, the sweep keeps the buckets not full only
+	time.Sleep(20 * time.Millisecond)
+	limiter.swept = time.Now().Add(-sweepInterval)
+	limiter.AllowMessage(net.ParseIP("192.0.2.1"))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("Full buckets not swept: %d", len(limiter.buckets))
+	}
+	if limiter.AllowMessage(net.ParseIP("192.0.2.1")) != false {
+		t.Error("Rate limit not enforced after the sweep")
+	}
+}
+
+func TestConnectionLimiterSession(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	replies := make(chan string, 10)
+	go func() {
+		reader := bufio.NewReader(client)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			replies <- line
+		}
+	}()
+
+	// malformed commands don't count against the rates
+	limiter := &ConnectionLimiter{MessageRate: Rate{PerSecond: 0.001, Burst: 1}, RecipientRate: Rate{PerSecond: 0.001, Burst: 1}}
+	s := &Smtp{}
+	s.Init(&Option{Socket: server, Limiter: limiter})
+	s.ReversePath = "1"
+	for _, test := range []struct {
+		command func(obj interface{}, args ...string) bool
+		args    string
+		reply   string
+	}{
+		{s.Mail, "FROM:joe@example.net", "501 "},
+		{s.Mail, "FROM:<joe@example.net> SIZE", "555 "},
+		{s.Mail, "FROM:<joe@example.net>", "250 "},
+		{s.Rcpt, "TO:jane@example.com", "501 "},
+		{s.Rcpt, "TO:<jane@example.com> NOTIFY=NEVER", "555 "},
+		{s.Rcpt, "TO:<jane@example.com>", "250 "},
+		{s.Rcpt, "TO:<john@example.com>", "421 "},
+	} {
+		test.command(s, test.args)
+		if reply := <-replies; strings.HasPrefix(reply, test.reply) == false {
+			t.Errorf("Wrong reply to %s: %q", test.args, reply)
+		}
+	}
+	server.Close()
+
+	// the client is told why it is disconnected, whatever the callback says
+	server, client = net.Pipe()
+	defer client.Close()
+	go func() {
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		replies <- line
+	}()
+	limiter = &ConnectionLimiter{MaxSessions: 1}
+	limiter.Open(nil)
+	s = &Smtp{}
+	s.Init(&Option{Socket: server, Limiter: limiter})
+	s.SetCallback("toomanyconnections", func(args ...string) *Reply { return &Reply{0, -1, ""} })
+	if s.Process() != true {
+		t.Error("Connection not closed")
+	}
+	server.Close()
+	if reply := <-replies; reply != "421 4.7.0 Too many connections, try again later\r\n" {
+		t.Errorf("Wrong reply: %q", reply)
+	}
+}
@@ -0,0 +1,44 @@
+package smtpserver
+
+import (
+	"net"
+)
+
+// Resolver is the DNS interface used by the policy checks, so that they can
+// be run against a fake DNS in tests.
+type Resolver interface {
+	LookupHost(host string) ([]string, error)
+	LookupTXT(name string) ([]string, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// NetResolver resolves through the net package.
+type NetResolver struct{}
+
+func (r *NetResolver) LookupHost(host string) ([]string, error) {
+	return net.LookupHost(host)
+}
+
+func (r *NetResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+func (r *NetResolver) LookupMX(name string) ([]*net.MX, error) {
+	return net.LookupMX(name)
+}
+
+func (r *NetResolver) LookupAddr(addr string) ([]string, error) {
+	return net.LookupAddr(addr)
+}
+
+var DefaultResolver Resolver = &NetResolver{}
+
+// IsNotFound tells whether a lookup failed because the name or the record
+// doesn't exist, as opposed to a temporary failure.
+func IsNotFound(err error) bool {
+	if dnserr, ok := err.(*net.DNSError); ok {
+		return dnserr.IsNotFound
+	}
+	return false
+}
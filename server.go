@@ -14,19 +14,36 @@ type MailServer struct {
 	DoJob               bool
 	Context             string
 	CallbackMap         map[string]*Callback
+	FilterMap           map[string][]func(...string) *Reply
 	Verb                map[string]func(interface{}, ...string) (close bool)
 	NextInput           func(string) bool
 	Options             *Option
 	BannerString        string
 	CurProcessOperation func(string) bool
+	NextTimeout         func() time.Duration
+	ReplyTimeout        time.Duration
+	PreCommand          func(verb string) (ok bool, close bool)
+	PostCommand         func(verb string, close bool) bool
+	LastReplyCode       int
+	ConsecutiveErrors   int
+	Authenticated       bool   // set by the AUTH verb of the server, as the package has none
+	AuthUser            string // user of the client, set with Authenticated
+	EarlyInput          []byte
+
+	filterRejected bool // the last event was refused by a filter
 }
 
 type Option struct {
-	HandleIn       net.Conn
-	HandleOut      net.Conn
-	Socket         net.Conn
-	ErrorSleepTime int
-	IdleTimeout    int
+	HandleIn        net.Conn
+	HandleOut       net.Conn
+	Socket          net.Conn
+	ErrorSleepTime  int // nanoseconds, used when Tarpit is nil. Deprecated: use Tarpit
+	Tarpit          *Tarpit
+	Limiter         *ConnectionLimiter
+	IdleTimeout     int
+	Timeouts        *Timeouts
+	GreetingDelay   time.Duration
+	MultilineBanner bool
 }
 
 type Reply struct {
@@ -56,9 +73,15 @@ func (m *MailServer) Init(options *Option) *MailServer {
 	m.In = options.Socket
 	m.Out = options.Socket
 	m.CallbackMap = make(map[string]*Callback)
+	m.FilterMap = make(map[string][]func(...string) *Reply)
 	m.Verb = make(map[string]func(interface{}, ...string) (close bool))
 
 	m.CurProcessOperation = m.ProcessOperation
+	m.ConsecutiveErrors = 0
+	m.Authenticated = false
+	m.AuthUser = ""
+	m.EarlyInput = nil
+	m.NextTimeout = m.CommandTimeout
 
 	return m
 }
@@ -136,6 +159,15 @@ func (m *MailServer) HandleReply(verb string, reply *Reply) {
 }
 
 func (m *MailServer) Callback(name string, args ...string) *Reply {
+	// the first filter which fails decides of the reply
+	m.filterRejected = false
+	for _, filter := range m.FilterMap[name] {
+		if reply := filter(args...); reply != nil && reply.Success == 0 {
+			m.filterRejected = true
+			return reply
+		}
+	}
+
 	if cb, ok := m.CallbackMap[name]; ok == true {
 		m.Context = cb.Context
 		reply := cb.Code(args...)
@@ -153,6 +185,14 @@ func (m *MailServer) SetCallback(name string, code func(...string) *Reply, conte
 	m.CallbackMap[name] = cb
 }
 
+// AddFilter registers a policy check run before the callback of an event.
+// A filter returning a failure prevents the callback from being called;
+// nil or any other reply lets the event go on. A filter may rewrite the
+// arguments in place, e.g. the message of the DATA event.
+func (m *MailServer) AddFilter(name string, code func(...string) *Reply) {
+	m.FilterMap[name] = append(m.FilterMap[name], code)
+}
+
 func (m *MailServer) DefVerb(verb string, cb func(interface{}, ...string) bool) {
 	m.Verb[strings.ToUpper(verb)] = cb
 }
@@ -190,37 +230,57 @@ func (m *MailServer) TellNextInputMethod(input string) bool {
 func (m *MailServer) Process() bool {
 	in := m.In
 
-	m.Banner()
+	if limiter := m.Options.Limiter; limiter != nil {
+		ip := m.GetRemoteIP()
+		if limiter.Open(ip) == false {
+			// the connection is closed whatever the callback says
+			tooMany := &Reply{Code: 421, Message: "4.7.0 Too many connections, try again later"}
+			m.MakeEvent(&Event{
+				Name:         "toomanyconnections",
+				Arguments:    limiter.Counts(ip).Arguments(),
+				SuccessReply: tooMany,
+				FailureReply: tooMany,
+			})
+			return true
+		}
+		defer limiter.Close(ip)
+	}
+
+	if m.Banner() {
+		return true
+	}
 
 	var buffer []byte
-	ch := make(chan int)
+	greeting := true
 	for {
-		rv := 0
-
 		buffer = make([]byte, 512*1024)
-		read_size := 0
-
-		go func() {
-			var err error
-			read_size, err = in.(*net.TCPConn).Read(buffer)
-			if err != nil {
-				ch <- 0
-				return
-			}
-			ch <- 1
-		}()
-		if m.Options.IdleTimeout > 0 {
-			go func() {
-				time.Sleep(time.Second * time.Duration(m.Options.IdleTimeout))
-				in.(*net.TCPConn).Close()
-				ch <- 0
-			}()
+
+		var timeout time.Duration
+		if greeting {
+			timeout = m.Options.GetTimeouts().Greeting
+			greeting = false
+		} else {
+			timeout = m.NextTimeout()
+		}
+		if timeout > 0 {
+			in.SetReadDeadline(time.Now().Add(timeout))
 		}
-		rv = <-ch
 
-		if rv == 0 {
-			// timeout, read error or connection closed
-			break
+		// input received before the greeting is handled first
+		var read_size int
+		var err error
+		if len(m.EarlyInput) > 0 {
+			read_size = copy(buffer, m.EarlyInput)
+			m.EarlyInput = nil
+		} else {
+			read_size, err = in.Read(buffer)
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return m.Timeout()
+			}
+			// read error or connection closed
+			return true
 		}
 
 		// process all terminated lines
@@ -261,8 +321,10 @@ func (m *MailServer) Process() bool {
 			return true
 		}
 	}
+}
 
-	return m.Timeout()
+func (m *MailServer) CommandTimeout() time.Duration {
+	return m.Options.GetTimeouts().Command
 }
 
 func (m *MailServer) ProcessOnce(operation string) bool {
@@ -284,12 +346,25 @@ func (m *MailServer) ProcessOperation(operation string) bool {
 }
 
 func (m *MailServer) ProcessCommand(verb string, params string) bool {
+	if m.PreCommand != nil {
+		if ok, close := m.PreCommand(verb); ok == false {
+			return close
+		}
+	}
+
+	m.LastReplyCode = 0
+
+	rv := false
 	if action, ok := m.Verb[verb]; ok {
-		return m.ExecAction(action, params)
+		rv = m.ExecAction(action, params)
 	} else {
 		m.Reply(500, "Syntax error: unrecognized command")
-		return false
 	}
+
+	if m.PostCommand != nil {
+		rv = m.PostCommand(verb, rv)
+	}
+	return rv
 }
 
 func (m *MailServer) ExecAction(action func(interface{}, ...string) (close bool), params string) bool {
@@ -308,11 +383,32 @@ func (m *MailServer) TokenizeCommand(line string) (verb string, params string) {
 }
 
 func (m *MailServer) Reply(code int, msg string) {
+	// tempo on error
+	if code >= 400 {
+		m.ConsecutiveErrors++
+		if delay := m.ErrorDelay(); delay > 0 {
+			time.Sleep(delay)
+		}
+	} else {
+		m.ConsecutiveErrors = 0
+	}
+
+	m.LastReplyCode = code
+	m.writeReply(code, msg, true)
+}
+
+// writeReply writes the lines of a reply within the write timeout. Unless
+// last, the reply goes on with more lines.
+func (m *MailServer) writeReply(code int, msg string, last bool) {
 	out := m.Out
 
-	// tempo on error
-	if code >= 400 && m.Options.ErrorSleepTime > 0 {
-		time.Sleep(time.Duration(m.Options.ErrorSleepTime))
+	timeout := m.Options.GetTimeouts().Write
+	if m.ReplyTimeout > 0 {
+		timeout = m.ReplyTimeout
+		m.ReplyTimeout = 0
+	}
+	if out != nil && timeout > 0 {
+		out.SetWriteDeadline(time.Now().Add(timeout))
 	}
 
 	// default message
@@ -333,7 +429,7 @@ func (m *MailServer) Reply(code int, msg string) {
 		// RFC says that all lines but the last must
 		// split the code and the message with a dash (-)
 		var sep string
-		if i == len(lines)-1 {
+		if i == len(lines)-1 && last {
 			sep = " "
 		} else {
 			sep = "-"
@@ -342,6 +438,34 @@ func (m *MailServer) Reply(code int, msg string) {
 	}
 }
 
+func (m *MailServer) ErrorDelay() time.Duration {
+	if m.Options.Tarpit != nil {
+		return m.Options.Tarpit.Wait(m.GetRemoteIP(), m.ConsecutiveErrors, m.Authenticated)
+	}
+	return time.Duration(m.Options.ErrorSleepTime)
+}
+
+// GetConnectionCounts returns the current number of sessions, or nil if
+// they are not limited.
+func (m *MailServer) GetConnectionCounts() *ConnectionCounts {
+	if m.Options.Limiter == nil {
+		return nil
+	}
+	return m.Options.Limiter.Counts(m.GetRemoteIP())
+}
+
+// GetRemoteIP returns the address of the client, or nil if unknown.
+func (m *MailServer) GetRemoteIP() net.IP {
+	if m.In == nil || m.In.RemoteAddr() == nil {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(m.In.RemoteAddr().String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
 func (m *MailServer) GetHostname() string {
 	h, _ := os.Hostname()
 	return h
@@ -355,7 +479,9 @@ func (m *MailServer) GetAppname() string {
 	return "mailserver (Go)"
 }
 
-func (m *MailServer) Banner() {
+// Banner sends the greeting. It returns true if the connection has to be
+// closed because the client talked before the greeting or was refused.
+func (m *MailServer) Banner() bool {
 	if m.BannerString == "" {
 		hostname := m.GetHostname()
 		protoname := m.GetProtoname()
@@ -375,14 +501,65 @@ func (m *MailServer) Banner() {
 		m.BannerString = str
 	}
 
-	m.MakeEvent(&Event{
+	if m.Options.GreetingDelay > 0 {
+		// bots that don't wait for the last line of a multi-line
+		// greeting are caught as well
+		if m.Options.MultilineBanner {
+			m.writeReply(220, m.BannerString, false)
+		}
+		if m.DetectEarlyTalker(m.Options.GreetingDelay) {
+			return true
+		}
+	}
+
+	// a client refused by a filter, or with a 421 or 5xx reply, is
+	// disconnected; a callback failing otherwise keeps the session going
+	m.LastReplyCode = 0
+	if m.MakeEvent(&Event{
 		Name: "banner",
 		SuccessReply: &Reply{
 			Code:    220,
 			Message: m.BannerString,
 		},
 		FailureReply: &Reply{},
-	})
+	}) > 0 {
+		return false
+	}
+	return m.filterRejected || m.LastReplyCode == 421 || m.LastReplyCode >= 500
+}
+
+// DetectEarlyTalker waits for the given delay and reports a client which
+// sends anything meanwhile. Unless a callback of the "earlytalker" event
+// returns a failure, the client gets a 554 and true is returned. Otherwise
+// the input is kept to be processed after the greeting.
+func (m *MailServer) DetectEarlyTalker(delay time.Duration) bool {
+	in := m.In
+
+	buffer := make([]byte, 1024)
+	in.SetReadDeadline(time.Now().Add(delay))
+	read_size, err := in.Read(buffer)
+	in.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return false
+		}
+		// connection closed before the greeting
+		return true
+	}
+
+	input := buffer[:read_size]
+	if m.MakeEvent(&Event{
+		Name:         "earlytalker",
+		Arguments:    []string{string(input)},
+		SuccessReply: &Reply{Code: 554, Message: "5.5.1 Protocol error: input received before the greeting"},
+		FailureReply: &Reply{},
+	}) > 0 {
+		return true
+	}
+
+	m.EarlyInput = append(m.EarlyInput, input...)
+	return false
 }
 
 func (m *MailServer) Timeout() bool {
@@ -390,7 +567,7 @@ func (m *MailServer) Timeout() bool {
 		Name: "timeout",
 		SuccessReply: &Reply{
 			Code:    421,
-			Message: m.GetHostname() + " Timeout exceeded, closing transmission channel",
+			Message: "4.4.2 " + m.GetHostname() + " Timeout exceeded, closing transmission channel",
 		},
 	})
 
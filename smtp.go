@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+
+	"github.com/memememomo/go-smtpserver/queue"
 )
 
 type Smtp struct {
@@ -15,6 +17,28 @@ type Smtp struct {
 	DataHandleMoreData bool
 	LastChunk          string
 	OptionHandler      func(string, string, []string) bool
+	DataFinisher       func(string) bool
+	HeloName           string
+	HeloVerb           string // HELO, EHLO or LHLO
+	SPFHelo            *SPFCheck
+	SPFMailFrom        *SPFCheck
+	DKIMResults        []*DKIMVerification
+	DMARC              *DMARCCheck
+	ARC                *ARCResult
+	Spam               *SpamResult
+	Quarantine         string // reason given by a filter to hold the message
+	DSNParams          *DSNParams
+	Limits             Limits
+	BounceQueue        *queue.Queue // where DeliverLocal notifies the recipients it fails for
+	CommandCount       int
+	ErrorCount         int
+	MessageCount       int
+	NoopCount          int
+
+	// outcomes of the local delivery of the current message
+	localResults map[string]error
+	localMessage int
+	localData    string
 }
 
 func (s *Smtp) Init(options *Option) *Smtp {
@@ -39,11 +63,24 @@ func (s *Smtp) Init(options *Option) *Smtp {
 	s.ReversePath = "0"
 	s.ForwardPath = []string{}
 	s.StepMaildataPath(false)
+	s.HeloName = ""
+	s.HeloVerb = ""
+	s.SPFHelo = nil
+	s.SPFMailFrom = nil
 
 	// handle data after the end of data indicator (.)
 	s.DataHandleMoreData = false
 
 	s.OptionHandler = s.HandleOptions
+	s.DataFinisher = s.DataFinished
+	s.NextTimeout = s.StageTimeout
+
+	s.CommandCount = 0
+	s.ErrorCount = 0
+	s.MessageCount = 0
+	s.NoopCount = 0
+	s.PreCommand = s.CheckCommandLimits
+	s.PostCommand = s.CheckErrorLimit
 
 	return s
 }
@@ -64,6 +101,15 @@ func (s *Smtp) GetSender() string {
 	return s.ReversePath
 }
 
+// senderAddress returns the reverse path of the transaction, "" for the
+// null reverse path or before MAIL.
+func (s *Smtp) senderAddress() string {
+	if s.ReversePath == "0" || s.ReversePath == "1" {
+		return ""
+	}
+	return s.ReversePath
+}
+
 func (s *Smtp) GetRecipients() []string {
 	return s.ForwardPath
 }
@@ -85,6 +131,8 @@ func (s *Smtp) Helo(obj interface{}, args ...string) (close bool) {
 			s.ReversePath = "1"
 			s.ForwardPath = []string{}
 			s.MaildataPath = false
+			s.HeloName = hostname
+			s.HeloVerb = "HELO"
 		},
 		SuccessReply: &Reply{
 			Code:    250,
@@ -163,6 +211,12 @@ func (s *Smtp) Mail(obj interface{}, args ...string) (close bool) {
 		return false
 	}
 
+	if s.Limits.MaxMessages > 0 && s.MessageCount >= s.Limits.MaxMessages {
+		if s.MakeLimitEvent("toomanymessages", "4.7.0 Too many messages, closing transmission channel") {
+			return true
+		}
+	}
+
 	re, _ = regexp.Compile("^<(.*?)>(?: (\\S.*))?$")
 	if re.MatchString(args[0]) == false {
 		s.Reply(501, "Syntax error in parameters or arguments")
@@ -176,16 +230,25 @@ func (s *Smtp) Mail(obj interface{}, args ...string) (close bool) {
 		options = strings.Split(rets[0][2], " ")
 	}
 
+	s.DSNParams = nil
 	if s.OptionHandler("MAIL", address, options) == false {
 		return false
 	}
 
+	// only well-formed commands count against the rate
+	if limiter := s.Options.Limiter; limiter != nil && limiter.AllowMessage(s.GetRemoteIP()) == false {
+		if s.MakeLimitEvent("messagerate", "4.7.0 Message rate limit exceeded, closing transmission channel") {
+			return true
+		}
+	}
+
 	s.MakeEvent(&Event{
 		Name:      "MAIL",
 		Arguments: []string{address},
 		OnSuccess: func() {
 			s.ReversePath = address
 			s.ForwardPath = []string{"1"}
+			s.Quarantine = ""
 		},
 		SuccessReply: &Reply{Code: 250, Message: fmt.Sprintf("sender %s OK", address)},
 		FailureReply: &Reply{Code: 550, Message: "Failure"},
@@ -216,14 +279,32 @@ func (s *Smtp) Rcpt(obj interface{}, args ...string) (close bool) {
 	address := rets[0][1]
 
 	var options []string
-	if len(rets) > 1 {
-		options = strings.Split(rets[1][1], " ")
+	if rets[0][2] != "" {
+		options = strings.Split(rets[0][2], " ")
+	}
+
+	if s.Limits.MaxRecipients > 0 && s.CountRecipients() >= s.Limits.MaxRecipients {
+		if s.MakeEvent(&Event{
+			Name:         "toomanyrecipients",
+			Arguments:    []string{address},
+			SuccessReply: &Reply{Code: 452, Message: "4.5.3 Too many recipients"},
+			FailureReply: &Reply{},
+		}) > 0 {
+			return false
+		}
 	}
 
 	if s.OptionHandler("RCPT", address, options) == false {
 		return false
 	}
 
+	// only well-formed commands count against the rate
+	if limiter := s.Options.Limiter; limiter != nil && limiter.AllowRecipient(s.GetRemoteIP()) == false {
+		if s.MakeLimitEvent("recipientrate", "4.7.0 Recipient rate limit exceeded, closing transmission channel") {
+			return true
+		}
+	}
+
 	s.MakeEvent(&Event{
 		Name:      "RCPT",
 		Arguments: []string{address},
@@ -320,19 +401,12 @@ func (s *Smtp) DataPart(data string) bool {
 
 		s.DataBuf += data
 
-		// RFC 2821 by the letter
-		re, _ = regexp.Compile("^\\.(.+\015\012)(.)?")
-		cb = func(s string) string {
-			match := re.FindStringSubmatch(s)
-			if match[2] == "" || match[2] != "\n" {
-				return match[1]
-			} else {
-				return s
-			}
-		}
-		s.DataBuf = re.ReplaceAllStringFunc(s.DataBuf, cb)
+		// RFC 5321 4.5.2: the first period of any line with other
+		// characters is deleted
+		re, _ = regexp.Compile("(?m)^\\.([^\n])")
+		s.DataBuf = re.ReplaceAllString(s.DataBuf, "$1")
 
-		return s.DataFinished(more_data)
+		return s.DataFinisher(more_data)
 	}
 
 	n := len(data)
@@ -360,11 +434,13 @@ func (s *Smtp) DataPart(data string) bool {
 }
 
 func (s *Smtp) DataFinished(more_data string) bool {
+	s.ReplyTimeout = s.Options.GetTimeouts().DataTermination
 	s.MakeEvent(&Event{
 		Name:         "DATA",
 		Arguments:    []string{s.DataBuf},
 		SuccessReply: &Reply{Code: 250, Message: "message sent"},
 	})
+	s.MessageCount++
 
 	// reinitiate the connection
 	s.ReversePath = "1"
@@ -2,11 +2,13 @@ package smtpserver
 
 import (
 	. "./testutil"
+	"bufio"
 	"fmt"
 	"github.com/lestrrat/go-tcptest"
 	"log"
 	"net"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -38,7 +40,7 @@ func TestSmtpMain(t *testing.T) {
 
 	server, err := tcptest.Start(smtpd, 30*time.Second)
 	if err != nil {
-		t.Error("Failed to start smtpserver: %s", err)
+		t.Error("Failed to start smtpserver: ", err)
 	}
 
 	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
@@ -84,3 +86,287 @@ func TestSmtpMain(t *testing.T) {
 		t.Error("Wrong data in queue: " + smtp.Queue[0])
 	}
 }
+
+func TestSmtpTimeout(t *testing.T) {
+	smtpd := func(port int) {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			panic(err)
+		}
+
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				log.Printf("Accept Error: %v\n", err)
+				continue
+			}
+
+			smtp := &Smtp{}
+			smtp.Init(&Option{Socket: conn, Timeouts: &Timeouts{Greeting: 200 * time.Millisecond, Command: 200 * time.Millisecond}})
+			smtp.Process()
+			conn.Close()
+		}
+	}
+
+	server, err := tcptest.Start(smtpd, 30*time.Second)
+	if err != nil {
+		t.Error("Failed to start smtpserver: ", err)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Error("Failed to connect to smtpserver")
+	}
+	defer conn.Close()
+
+	if res := ReadIO(conn); MatchRegex("^220 ", res) != true {
+		t.Error("Wrong Connection Response: " + res)
+	}
+
+	if res := ReadIO(conn); MatchRegex("^421 4\\.4\\.2 .+ Timeout exceeded", res) != true {
+		t.Error("Wrong Timeout Response: " + res)
+	}
+}
+
+func TestPartialTimeouts(t *testing.T) {
+	// the timeouts left zero keep their default
+	timeouts := (&Option{Timeouts: &Timeouts{DataBlock: time.Minute}}).GetTimeouts()
+	expected := DefaultTimeouts
+	expected.DataBlock = time.Minute
+	if *timeouts != expected {
+		t.Errorf("Wrong timeouts: %+v", timeouts)
+	}
+}
+
+func TestSmtpLimits(t *testing.T) {
+	smtpd := func(port int) {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			panic(err)
+		}
+
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				log.Printf("Accept Error: %v\n", err)
+				continue
+			}
+
+			smtp := &MySmtpServer{}
+			smtp.Limits = Limits{MaxRecipients: 1, MaxErrors: 1}
+			smtp.Init(&Option{Socket: conn})
+			smtp.SetCallback("RCPT", smtp.ValidateRecipient)
+			smtp.Process()
+			conn.Close()
+		}
+	}
+
+	server, err := tcptest.Start(smtpd, 30*time.Second)
+	if err != nil {
+		t.Error("Failed to start smtpserver: ", err)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Error("Failed to connect to smtpserver")
+	}
+	defer conn.Close()
+
+	if res := ReadIO(conn); MatchRegex("^220 ", res) != true {
+		t.Error("Wrong Connection Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "HELO localhost\r\n")
+	if res := ReadIO(conn); res != "250 Requested mail action okey, completed\r\n" {
+		t.Error("Wrong HELO Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "MAIL FROM: <from@example.net>\r\n")
+	if res := ReadIO(conn); res != "250 sender from@example.net OK\r\n" {
+		t.Error("Wrong MAIL FROM Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "RCPT TO: <to@example.com>\r\n")
+	if res := ReadIO(conn); res != "250 recipient to@example.com OK\r\n" {
+		t.Error("Wrong RCPT TO Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "RCPT TO: <to2@example.com>\r\n")
+	if res := ReadIO(conn); res != "452 4.5.3 Too many recipients\r\n" {
+		t.Error("Wrong RCPT TO Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "FOO\r\n")
+	if res := ReadIO(conn); MatchRegex("^500 ", res) != true {
+		t.Error("Wrong FOO Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "BAR\r\n")
+	reader := bufio.NewReader(conn)
+	if res, _ := reader.ReadString('\n'); MatchRegex("^500 ", res) != true {
+		t.Error("Wrong BAR Response: " + res)
+	}
+	if res, _ := reader.ReadString('\n'); res != "421 4.7.0 Too many errors, closing transmission channel\r\n" {
+		t.Error("Wrong error limit Response: " + res)
+	}
+}
+
+func TestSmtpEarlyTalker(t *testing.T) {
+	smtpd := func(port int) {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			panic(err)
+		}
+
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				log.Printf("Accept Error: %v\n", err)
+				continue
+			}
+
+			smtp := &Smtp{}
+			smtp.Init(&Option{Socket: conn, GreetingDelay: 500 * time.Millisecond, MultilineBanner: true})
+			smtp.Process()
+			conn.Close()
+		}
+	}
+
+	server, err := tcptest.Start(smtpd, 30*time.Second)
+	if err != nil {
+		t.Error("Failed to start smtpserver: ", err)
+	}
+
+	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(server.Port()))
+	if err != nil {
+		t.Error("Failed to connect to smtpserver")
+	}
+	defer conn.Close()
+
+	if res := ReadIO(conn); MatchRegex("^220-", res) != true {
+		t.Error("Wrong Connection Response: " + res)
+	}
+
+	fmt.Fprintf(conn, "HELO localhost\r\n")
+	if res := ReadIO(conn); MatchRegex("^554 5\\.5\\.1 ", res) != true {
+		t.Error("Wrong early talker Response: " + res)
+	}
+}
+
+func TestSmtpGreetingDelay(t *testing.T) {
+	for _, multiline := range []bool{false, true} {
+		server, client := net.Pipe()
+		go func() {
+			s := &Smtp{}
+			s.Init(&Option{Socket: server, GreetingDelay: 50 * time.Millisecond, MultilineBanner: multiline})
+			s.BannerString = "mx.example.com Service ready"
+			s.Process()
+			server.Close()
+		}()
+
+		// a client waiting for the greeting is served
+		reader := bufio.NewReader(client)
+		expected := []string{"220 mx.example.com Service ready\r\n"}
+		if multiline {
+			expected = []string{"220-mx.example.com Service ready\r\n", "220 mx.example.com Service ready\r\n"}
+		}
+		for _, line := range expected {
+			if res, _ := reader.ReadString('\n'); res != line {
+				t.Errorf("Wrong greeting line (multiline %v): %q", multiline, res)
+			}
+		}
+		fmt.Fprintf(client, "HELO localhost\r\n")
+		if res, _ := reader.ReadString('\n'); MatchRegex("^250 ", res) != true {
+			t.Errorf("Wrong HELO Response (multiline %v): %q", multiline, res)
+		}
+		client.Close()
+	}
+
+	// the continuation line is written within the write timeout
+	server, client := net.Pipe()
+	defer client.Close()
+	s := &Smtp{}
+	s.Init(&Option{Socket: server, GreetingDelay: time.Millisecond, MultilineBanner: true, Timeouts: &Timeouts{Write: 50 * time.Millisecond}})
+	done := make(chan bool)
+	go func() {
+		done <- s.Banner()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Greeting blocked on a client not reading")
+	}
+	server.Close()
+}
+
+func TestSmtpSessionLimits(t *testing.T) {
+	for _, test := range []struct {
+		limits   Limits
+		commands []string
+		replies  []string
+	}{
+		{
+			Limits{MaxMessages: 1},
+			[]string{"MAIL FROM:<a@example.net>", "RCPT TO:<b@example.com>", "DATA", "Subject: Hi\r\n\r\nHello.\r\n.", "MAIL FROM:<a@example.net>"},
+			[]string{"250 ", "250 ", "354 ", "250 ", "421 4.7.0 Too many messages"},
+		},
+		{
+			Limits{MaxCommands: 2},
+			[]string{"NOOP", "MAIL FROM:<a@example.net>", "NOOP"},
+			[]string{"250 ", "250 ", "421 4.7.0 Too many commands"},
+		},
+		{
+			Limits{MaxNoops: 2},
+			[]string{"NOOP", "RSET", "MAIL FROM:<a@example.net>", "NOOP"},
+			[]string{"250 ", "250 ", "250 ", "421 4.7.0 Too many NOOP/RSET commands"},
+		},
+		{
+			Limits{MaxErrors: 2},
+			[]string{"FOO", "BAR", "NOOP", "BAZ"},
+			[]string{"500 ", "500 ", "250 ", "500 ", "421 4.7.0 Too many errors"},
+		},
+	} {
+		server, client := net.Pipe()
+		closed := make(chan bool)
+		go func() {
+			s := &Smtp{}
+			s.Init(&Option{Socket: server})
+			s.Limits = test.limits
+			s.ReversePath = "1"
+			s.Process()
+			server.Close()
+			close(closed)
+		}()
+
+		reader := bufio.NewReader(client)
+		reader.ReadString('\n')
+		replies := []string{}
+		for _, command := range test.commands {
+			fmt.Fprintf(client, "%s\r\n", command)
+			res, _ := reader.ReadString('\n')
+			replies = append(replies, res)
+		}
+		for {
+			res, err := reader.ReadString('\n')
+			if err != nil {
+				break
+			}
+			replies = append(replies, res)
+		}
+		<-closed
+		client.Close()
+
+		if len(replies) != len(test.replies) {
+			t.Errorf("Wrong replies with %+v: %q", test.limits, replies)
+			continue
+		}
+		for i, expected := range test.replies {
+			if strings.HasPrefix(replies[i], expected) == false {
+				t.Errorf("Wrong reply %d with %+v: %q", i, test.limits, replies[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package smtpserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of a spam verdict, as rspamd names them.
+const (
+	SpamNoAction       = "no action"
+	SpamGreylist       = "greylist"
+	SpamAddHeader      = "add header"
+	SpamRewriteSubject = "rewrite subject"
+	SpamSoftReject     = "soft reject"
+	SpamReject         = "reject"
+)
+
+// SpamRequest is a message and its envelope, as sent to a spam engine.
+type SpamRequest struct {
+	Message    string
+	IP         net.IP
+	Helo       string
+	From       string
+	Recipients []string
+	User       string // authenticated user
+	Hostname   string // our hostname
+}
+
+// SpamResult is the verdict of a spam engine.
+type SpamResult struct {
+	Score     float64
+	Threshold float64
+	Spam      bool
+	Action    string
+	Symbols   []string
+	Subject   string // rewritten subject proposed by the engine
+}
+
+// SpamEngine scores messages.
+type SpamEngine interface {
+	Check(request *SpamRequest) (*SpamResult, error)
+}
+
+// Spamd is a SpamAssassin spamd speaking SPAMC/1.5. The envelope is
+// passed in a Received header field prepended to the message, as spamd
+// has no other way to learn it.
+type Spamd struct {
+	Network string        // "tcp" or "unix"
+	Address string        // e.g. "127.0.0.1:783"
+	User    string        // user whose preferences apply, optional
+	Timeout time.Duration // default 30s
+}
+
+// Rspamd is a rspamd normal worker answering /checkv2.
+type Rspamd struct {
+	URL      string // e.g. "http://127.0.0.1:11333"
+	Password string // optional
+	Timeout  time.Duration
+	Client   *http.Client // default a client with Timeout (30s)
+}
+
+// SpamCheck consults a spam engine at the end of DATA and applies its
+// verdict: rejection, temporary failure, X-Spam-* header fields and
+// subject rewriting. It is meant to be registered as a DATA filter:
+//
+//	s.AddFilter("DATA", spam.Filter(&s.Smtp))
+type SpamCheck struct {
+	Engine        SpamEngine
+	RejectScore   float64 // reject from this score, whatever the action (0 to rely on the action)
+	TempfailScore float64 // tempfail from this score, whatever the action (0 to rely on the action)
+	SubjectTag    string  // prefix of the subject of spam, e.g. "[SPAM]"; "" leaves subjects alone
+	MaxSize       int     // larger messages aren't checked, 0 for no limit
+	FailClosed    bool    // tempfail when the engine fails instead of accepting
+}
+
+func (d *Spamd) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return 30 * time.Second
+	}
+	return d.Timeout
+}
+
+// spamdReceived builds the Received header field giving the envelope.
+func spamdReceived(request *SpamRequest) string {
+	ip := "unknown"
+	if request.IP != nil {
+		ip = request.IP.String()
+	}
+	received := fmt.Sprintf("Received: from %s ([%s])\r\n\tby %s", request.Helo, ip, request.Hostname)
+	if request.User != "" {
+		received += " with ESMTPA"
+	} else {
+		received += " with ESMTP"
+	}
+	if request.From != "" {
+		received += "\r\n\t(envelope-from <" + request.From + ">)"
+	}
+	if len(request.Recipients) == 1 {
+		received += "\r\n\tfor <" + request.Recipients[0] + ">"
+	}
+	return received + "; " + time.Now().Format(time.RFC1123Z) + "\r\n"
+}
+
+func (d *Spamd) Check(request *SpamRequest) (*SpamResult, error) {
+	conn, err := net.DialTimeout(d.Network, d.Address, d.timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(d.timeout()))
+
+	message := spamdReceived(request) + ToCRLF(request.Message)
+	header := "SYMBOLS SPAMC/1.5\r\n"
+	header += "Content-length: " + strconv.Itoa(len(message)) + "\r\n"
+	if d.User != "" {
+		header += "User: " + d.User + "\r\n"
+	}
+	if _, err := io.WriteString(conn, header+"\r\n"+message); err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(status)
+	if len(fields) < 3 || strings.HasPrefix(fields[0], "SPAMD/") == false {
+		return nil, fmt.Errorf("unexpected spamd reply %q", strings.TrimSpace(status))
+	}
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("spamd: %s", strings.Join(fields[2:], " "))
+	}
+
+	result := &SpamResult{Action: SpamNoAction}
+	found := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		// Spam: True ; 15.0 / 5.0
+		if strings.HasPrefix(strings.ToLower(line), "spam:") {
+			var flag string
+			_, err := fmt.Sscanf(strings.Replace(line[5:], ";", " ; ", 1), "%s ; %g / %g", &flag, &result.Score, &result.Threshold)
+			if err != nil {
+				return nil, fmt.Errorf("malformed spamd header %q", line)
+			}
+			result.Spam = strings.EqualFold(flag, "true") || strings.EqualFold(flag, "yes")
+			found = true
+		}
+	}
+	if found == false {
+		return nil, fmt.Errorf("spamd reply without Spam header")
+	}
+
+	body, _ := ioutil.ReadAll(r)
+	for _, symbol := range strings.Split(strings.TrimSpace(string(body)), ",") {
+		if symbol != "" {
+			result.Symbols = append(result.Symbols, symbol)
+		}
+	}
+	if result.Spam {
+		result.Action = SpamAddHeader
+	}
+	return result, nil
+}
+
+func (r *Rspamd) Check(request *SpamRequest) (*SpamResult, error) {
+	client := r.Client
+	if client == nil {
+		timeout := r.Timeout
+		if timeout == 0 {
+			timeout = 30 * time.Second
+		}
+		client = &http.Client{Timeout: timeout}
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(r.URL, "/")+"/checkv2", strings.NewReader(request.Message))
+	if err != nil {
+		return nil, err
+	}
+	if request.IP != nil {
+		req.Header.Set("IP", request.IP.String())
+	}
+	if request.Helo != "" {
+		req.Header.Set("Helo", request.Helo)
+	}
+	if request.From != "" {
+		req.Header.Set("From", request.From)
+	}
+	for _, rcpt := range request.Recipients {
+		req.Header.Add("Rcpt", rcpt)
+	}
+	if request.User != "" {
+		req.Header.Set("User", request.User)
+	}
+	if request.Hostname != "" {
+		req.Header.Set("MTA-Name", request.Hostname)
+	}
+	if r.Password != "" {
+		req.Header.Set("Password", r.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd: %s", resp.Status)
+	}
+
+	var reply struct {
+		Score         float64                `json:"score"`
+		RequiredScore float64                `json:"required_score"`
+		Action        string                 `json:"action"`
+		Subject       string                 `json:"subject"`
+		Symbols       map[string]interface{} `json:"symbols"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, err
+	}
+
+	result := &SpamResult{
+		Score:     reply.Score,
+		Threshold: reply.RequiredScore,
+		Action:    reply.Action,
+		Subject:   reply.Subject,
+	}
+	if result.Action == "" {
+		result.Action = SpamNoAction
+	}
+	result.Spam = result.Action != SpamNoAction && result.Action != SpamGreylist
+	for symbol := range reply.Symbols {
+		result.Symbols = append(result.Symbols, symbol)
+	}
+	sort.Strings(result.Symbols)
+	return result, nil
+}
+
+// Action returns the action to apply for a verdict, the score thresholds
+// prevailing.
+func (c *SpamCheck) Action(result *SpamResult) string {
+	switch {
+	case c.RejectScore > 0 && result.Score >= c.RejectScore:
+		return SpamReject
+	case c.TempfailScore > 0 && result.Score >= c.TempfailScore:
+		return SpamSoftReject
+	}
+	return result.Action
+}
+
+// Tag removes the X-Spam-* header fields of a message and adds ours. The
+// subject of spam is rewritten if SubjectTag is set.
+func (c *SpamCheck) Tag(data string, result *SpamResult, action string) string {
+	m := ParseMessage(data)
+	for _, h := range append([]*MessageHeader{}, m.Headers...) {
+		if strings.HasPrefix(strings.ToLower(h.Name), "x-spam-") {
+			m.Remove(h)
+		}
+	}
+
+	score := strconv.FormatFloat(result.Score, 'f', 1, 64)
+	flag := "No"
+	if result.Spam {
+		flag = "Yes"
+		m.Prepend("X-Spam-Flag", "YES")
+	}
+	status := flag + ", score=" + score + " required=" + strconv.FormatFloat(result.Threshold, 'f', 1, 64)
+	if len(result.Symbols) > 0 {
+		status += "\r\n\ttests=" + strings.Join(result.Symbols, ",")
+	}
+	m.Prepend("X-Spam-Status", status)
+	m.Prepend("X-Spam-Score", score)
+	if action != SpamNoAction {
+		m.Prepend("X-Spam-Action", action)
+	}
+
+	if action == SpamRewriteSubject || (c.SubjectTag != "" && result.Spam) {
+		h := m.Get("Subject")
+		if h == nil {
+			h = &MessageHeader{Name: "Subject"}
+			m.Headers = append(m.Headers, h)
+		}
+		subject := h.Value()
+		if action == SpamRewriteSubject && result.Subject != "" {
+			subject = result.Subject
+		} else if c.SubjectTag != "" && strings.HasPrefix(subject, c.SubjectTag) == false {
+			subject = strings.TrimSpace(c.SubjectTag + " " + subject)
+		}
+		h.Raw = h.Name + ": " + subject + "\r\n"
+	}
+	return m.String()
+}
+
+// Filter returns a DATA filter checking the message. The verdict is kept
+// in Spam for the callbacks.
+func (c *SpamCheck) Filter(s *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		s.Spam = nil
+		if c.MaxSize > 0 && len(args[0]) > c.MaxSize {
+			return nil
+		}
+
+		request := &SpamRequest{
+			Message:  args[0],
+			IP:       s.GetRemoteIP(),
+			Helo:     s.HeloName,
+			User:     s.AuthUser,
+			Hostname: s.GetHostname(),
+			From:     s.senderAddress(),
+		}
+		if s.CountRecipients() > 0 {
+			request.Recipients = s.ForwardPath
+		}
+
+		result, err := c.Engine.Check(request)
+		if err != nil {
+			if c.FailClosed {
+				return &Reply{0, 451, "4.3.0 Spam check failed, try again later"}
+			}
+			return nil
+		}
+		s.Spam = result
+
+		switch action := c.Action(result); action {
+		case SpamReject:
+			return &Reply{0, 550, "5.7.1 Message rejected as spam"}
+		case SpamSoftReject:
+			return &Reply{0, 451, "4.7.1 Try again later"}
+		case SpamGreylist:
+			return &Reply{0, 451, "4.7.1 Greylisted, please try again later"}
+		default:
+			args[0] = c.Tag(args[0], result, action)
+		}
+		return nil
+	}
+}
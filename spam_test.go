@@ -0,0 +1,172 @@
+package smtpserver
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// StartFakeSpamd answers SYMBOLS requests, scoring 10 the messages
+// containing "viagra".
+func StartFakeSpamd(received chan string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				request, _ := r.ReadString('\n')
+				length := 0
+				for {
+					line, _ := r.ReadString('\n')
+					if line == "\r\n" || line == "" {
+						break
+					}
+					if strings.HasPrefix(line, "Content-length: ") {
+						length, _ = strconv.Atoi(strings.TrimSpace(line[16:]))
+					}
+				}
+				body := make([]byte, length)
+				io.ReadFull(r, body)
+				received <- request + string(body)
+
+				if strings.Contains(string(body), "viagra") {
+					fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 19\r\nSpam: True ; 10.0 / 5.0\r\n\r\nDRUGS,MISSING_DATE")
+				} else {
+					fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: 0\r\nSpam: False ; 0.5 / 5.0\r\n\r\n")
+				}
+			}(conn)
+		}
+	}()
+	return listener
+}
+
+func TestSpamd(t *testing.T) {
+	received := make(chan string, 10)
+	spamd := StartFakeSpamd(received)
+	defer spamd.Close()
+
+	check := &SpamCheck{Engine: &Spamd{Network: "tcp", Address: spamd.Addr().String(), Timeout: time.Second}, SubjectTag: "[SPAM]"}
+
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.HeloName = "client.example.net"
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"to@example.org"}
+	filter := check.Filter(s)
+
+	args := []string{"X-Spam-Flag: YES\r\nSubject: Hi\r\n\r\nHello.\r\n"}
+	if reply := filter(args...); reply != nil {
+		t.Errorf("Ham refused: %+v", reply)
+	}
+	if args[0] != "X-Spam-Score: 0.5\r\nX-Spam-Status: No, score=0.5 required=5.0\r\nSubject: Hi\r\n\r\nHello.\r\n" {
+		t.Error("Wrong ham: " + args[0])
+	}
+	request := <-received
+	if strings.HasPrefix(request, "SYMBOLS SPAMC/1.5\r\nReceived: from client.example.net") == false ||
+		strings.Contains(request, "(envelope-from <from@example.net>)\r\n\tfor <to@example.org>;") == false {
+		t.Error("Wrong request: " + request)
+	}
+
+	args = []string{"Subject: Cheap viagra\r\n\r\nBuy.\r\n"}
+	if reply := filter(args...); reply != nil {
+		t.Errorf("Tagged spam refused: %+v", reply)
+	}
+	expected := "X-Spam-Action: add header\r\nX-Spam-Score: 10.0\r\n" +
+		"X-Spam-Status: Yes, score=10.0 required=5.0\r\n\ttests=DRUGS,MISSING_DATE\r\nX-Spam-Flag: YES\r\n" +
+		"Subject: [SPAM] Cheap viagra\r\n\r\nBuy.\r\n"
+	if args[0] != expected {
+		t.Error("Wrong spam: " + args[0])
+	}
+	if s.Spam == nil || s.Spam.Score != 10 {
+		t.Errorf("Wrong verdict: %+v", s.Spam)
+	}
+
+	check.RejectScore = 8
+	if reply := filter("Subject: Cheap viagra\r\n\r\nBuy.\r\n"); reply == nil || reply.Code != 550 {
+		t.Errorf("Spam not rejected: %+v", reply)
+	}
+
+	spamd.Close()
+	if reply := filter("Subject: Hi\r\n\r\nHello.\r\n"); reply != nil {
+		t.Errorf("Engine failure didn't fail open: %+v", reply)
+	}
+	check.FailClosed = true
+	if reply := filter("Subject: Hi\r\n\r\nHello.\r\n"); reply == nil || reply.Code != 451 {
+		t.Errorf("Engine failure didn't fail closed: %+v", reply)
+	}
+}
+
+func TestRspamd(t *testing.T) {
+	var headers http.Header
+	rspamd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" {
+			http.NotFound(w, r)
+			return
+		}
+		headers = r.Header
+		body, _ := ioutil.ReadAll(r.Body)
+		switch {
+		case strings.Contains(string(body), "casino"):
+			fmt.Fprint(w, `{"score": 20.5, "required_score": 15, "action": "reject", "symbols": {"CASINO": {}}}`)
+		case strings.Contains(string(body), "lottery"):
+			fmt.Fprint(w, `{"score": 9, "required_score": 15, "action": "rewrite subject", "subject": "*** SPAM *** You won", "symbols": {"LOTTERY": {}, "BAYES_SPAM": {}}}`)
+		case strings.Contains(string(body), "maybe"):
+			fmt.Fprint(w, `{"score": 7, "required_score": 15, "action": "soft reject"}`)
+		default:
+			fmt.Fprint(w, `{"score": -1.2, "required_score": 15, "action": "no action"}`)
+		}
+	}))
+	defer rspamd.Close()
+
+	check := &SpamCheck{Engine: &Rspamd{URL: rspamd.URL}}
+	s := &Smtp{}
+	s.Init(&Option{})
+	s.HeloName = "client.example.net"
+	s.AuthUser = "joe"
+	s.ReversePath = "from@example.net"
+	s.ForwardPath = []string{"a@example.org", "b@example.org"}
+	filter := check.Filter(s)
+
+	if reply := filter("Subject: Hi\r\n\r\nHello.\r\n"); reply != nil {
+		t.Errorf("Ham refused: %+v", reply)
+	}
+	if headers.Get("Helo") != "client.example.net" || headers.Get("From") != "from@example.net" ||
+		headers.Get("User") != "joe" || len(headers["Rcpt"]) != 2 {
+		t.Errorf("Wrong headers: %v", headers)
+	}
+
+	if reply := filter("Subject: casino\r\n\r\nPlay.\r\n"); reply == nil || reply.Code != 550 {
+		t.Errorf("Spam not rejected: %+v", reply)
+	}
+	if reply := filter("Subject: maybe\r\n\r\nHm.\r\n"); reply == nil || reply.Code != 451 {
+		t.Errorf("Spam not deferred: %+v", reply)
+	}
+
+	args := []string{"Subject: You won\r\nFrom: lottery@example.com\r\n\r\nClaim.\r\n"}
+	if reply := filter(args...); reply != nil {
+		t.Errorf("Tagged spam refused: %+v", reply)
+	}
+	m := ParseMessage(args[0])
+	if m.Get("Subject").Value() != "*** SPAM *** You won" || m.Headers[len(m.Headers)-2].Name != "Subject" {
+		t.Error("Subject not rewritten: " + args[0])
+	}
+	if status := m.Get("X-Spam-Status").Value(); status != "Yes, score=9.0 required=15.0\ttests=BAYES_SPAM,LOTTERY" {
+		t.Error("Wrong status: " + status)
+	}
+}
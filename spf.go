@@ -0,0 +1,715 @@
+package smtpserver
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// https://tools.ietf.org/html/rfc7208
+
+type SPFResult string
+
+const (
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFNeutral   SPFResult = "neutral"
+	SPFNone      SPFResult = "none"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+	spfMaxPtrNames    = 10
+)
+
+// SPFCheck is the outcome of the evaluation of an identity.
+type SPFCheck struct {
+	Result      SPFResult
+	Identity    string // "mailfrom" or "helo"
+	Sender      string
+	Domain      string
+	Explanation string
+	Err         error
+}
+
+// SPF verifies the MAIL FROM and HELO identities of the clients. It is
+// meant to be registered as a MAIL filter:
+//
+//	s.AddFilter("MAIL", spf.Filter(&s.Smtp))
+type SPF struct {
+	Resolver   Resolver // default DefaultResolver
+	Hostname   string   // the receiving host, %{r} in explanations
+	CheckHelo  bool     // evaluate the HELO identity before MAIL FROM
+	RejectFail bool     // reject the sender when the result is "fail"
+}
+
+type spfEvaluation struct {
+	spf      *SPF
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+	resolver Resolver
+}
+
+type spfError struct {
+	Result SPFResult
+	Msg    string
+}
+
+func (e *spfError) Error() string {
+	return string(e.Result) + ": " + e.Msg
+}
+
+func spfPermError(format string, args ...interface{}) *spfError {
+	return &spfError{SPFPermError, fmt.Sprintf(format, args...)}
+}
+
+func spfTempError(format string, args ...interface{}) *spfError {
+	return &spfError{SPFTempError, fmt.Sprintf(format, args...)}
+}
+
+// CheckHost evaluates the SPF policy of domain for a message sent from ip
+// by sender, the client having said helo.
+func (s *SPF) CheckHost(ip net.IP, domain string, sender string, helo string) *SPFCheck {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = DefaultResolver
+	}
+
+	if strings.HasPrefix(sender, "@") {
+		sender = "postmaster" + sender
+	} else if strings.Contains(sender, "@") == false {
+		sender = "postmaster@" + domain
+	}
+
+	e := &spfEvaluation{spf: s, ip: ip, sender: sender, helo: helo, resolver: resolver}
+	check := &SPFCheck{Sender: sender, Domain: domain}
+	check.Result, check.Explanation, check.Err = e.checkHost(domain)
+	return check
+}
+
+func (e *spfEvaluation) checkHost(domain string) (SPFResult, string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if IsValidDomain(domain) == false {
+		return SPFNone, "", nil
+	}
+
+	record, err := e.record(domain)
+	if err != nil {
+		if serr, ok := err.(*spfError); ok {
+			return serr.Result, "", err
+		}
+		return SPFTempError, "", err
+	}
+	if record == "" {
+		return SPFNone, "", nil
+	}
+
+	return e.evaluate(domain, record)
+}
+
+// record returns the SPF record of a domain, or "" if there is none.
+func (e *spfEvaluation) record(domain string) (string, error) {
+	txts, err := e.resolver.LookupTXT(domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return "", nil
+		}
+		return "", spfTempError("%s", err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			records = append(records, txt)
+		}
+	}
+	if len(records) > 1 {
+		return "", spfPermError("multiple SPF records for %s", domain)
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0], nil
+}
+
+var spfModifierRe = regexp.MustCompile("^([a-zA-Z][a-zA-Z0-9._-]*)=(.*)$")
+var spfCidrRe = regexp.MustCompile("^(.*?)(?:/([0-9]+))?(?://([0-9]+))?$")
+
+func (e *spfEvaluation) evaluate(domain string, record string) (SPFResult, string, error) {
+	terms := strings.Fields(record)[1:]
+
+	var redirect, exp string
+	var haveRedirect, haveExp bool
+	var directives []string
+
+	// modifiers are parsed first so that syntax errors are detected
+	// whatever the position of the term
+	for _, term := range terms {
+		m := spfModifierRe.FindStringSubmatch(term)
+		if m == nil {
+			directives = append(directives, term)
+			continue
+		}
+		switch strings.ToLower(m[1]) {
+		case "redirect":
+			if haveRedirect {
+				return SPFPermError, "", spfPermError("duplicate redirect modifier")
+			}
+			haveRedirect, redirect = true, m[2]
+		case "exp":
+			if haveExp {
+				return SPFPermError, "", spfPermError("duplicate exp modifier")
+			}
+			haveExp, exp = true, m[2]
+		}
+	}
+
+	for _, directive := range directives {
+		qualifier := SPFPass
+		switch directive[0] {
+		case '+':
+			directive = directive[1:]
+		case '-':
+			qualifier, directive = SPFFail, directive[1:]
+		case '~':
+			qualifier, directive = SPFSoftFail, directive[1:]
+		case '?':
+			qualifier, directive = SPFNeutral, directive[1:]
+		}
+
+		match, err := e.mechanism(domain, directive)
+		if err != nil {
+			serr, ok := err.(*spfError)
+			if ok == false {
+				serr = spfTempError("%s", err)
+			}
+			return serr.Result, "", serr
+		}
+		if match {
+			if qualifier == SPFFail && haveExp {
+				return qualifier, e.explanation(domain, exp), nil
+			}
+			return qualifier, "", nil
+		}
+	}
+
+	if haveRedirect {
+		if err := e.countLookup(); err != nil {
+			return SPFPermError, "", err
+		}
+		target, err := e.expandDomain(redirect, domain, false)
+		if err != nil {
+			return SPFPermError, "", err
+		}
+		result, explanation, err := e.checkHost(target)
+		if result == SPFNone {
+			return SPFPermError, "", spfPermError("redirect to %s without SPF record", target)
+		}
+		return result, explanation, err
+	}
+
+	return SPFNeutral, "", nil
+}
+
+func (e *spfEvaluation) countLookup() error {
+	e.lookups++
+	if e.lookups > spfMaxLookups {
+		return spfPermError("too many DNS lookups")
+	}
+	return nil
+}
+
+func (e *spfEvaluation) countVoid(n int, err error) error {
+	if (err != nil && IsNotFound(err)) || (err == nil && n == 0) {
+		e.voids++
+		if e.voids > spfMaxVoidLookups {
+			return spfPermError("too many void DNS lookups")
+		}
+	}
+	return nil
+}
+
+func (e *spfEvaluation) mechanism(domain string, directive string) (bool, error) {
+	name, value := directive, ""
+	if i := strings.IndexAny(directive, ":/"); i >= 0 {
+		name, value = directive[:i], directive[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		if value != "" {
+			return false, spfPermError("invalid mechanism %s", directive)
+		}
+		return true, nil
+
+	case "include":
+		if strings.HasPrefix(value, ":") == false {
+			return false, spfPermError("invalid mechanism %s", directive)
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.expandDomain(value[1:], domain, false)
+		if err != nil {
+			return false, err
+		}
+		result, _, err := e.checkHost(target)
+		switch result {
+		case SPFPass:
+			return true, nil
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, nil
+		case SPFTempError:
+			return false, err
+		}
+		return false, spfPermError("include of %s: %s", target, result)
+
+	case "a", "mx":
+		target, ip4mask, ip6mask, err := e.parseTarget(domain, value)
+		if err != nil {
+			return false, err
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+
+		hosts := []string{target}
+		if strings.ToLower(name) == "mx" {
+			mxs, err := e.resolver.LookupMX(target)
+			if verr := e.countVoid(len(mxs), err); verr != nil {
+				return false, verr
+			}
+			if err != nil && IsNotFound(err) == false {
+				return false, spfTempError("%s", err)
+			}
+			if len(mxs) > spfMaxLookups {
+				return false, spfPermError("too many MX records for %s", target)
+			}
+			hosts = nil
+			for _, mx := range mxs {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := e.resolver.LookupHost(host)
+			if strings.ToLower(name) == "a" {
+				if verr := e.countVoid(len(addrs), err); verr != nil {
+					return false, verr
+				}
+			}
+			if err != nil && IsNotFound(err) == false {
+				return false, spfTempError("%s", err)
+			}
+			for _, addr := range addrs {
+				if e.matchAddr(net.ParseIP(addr), ip4mask, ip6mask) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		target := domain
+		if value != "" {
+			if strings.HasPrefix(value, ":") == false {
+				return false, spfPermError("invalid mechanism %s", directive)
+			}
+			var err error
+			if target, err = e.expandDomain(value[1:], domain, false); err != nil {
+				return false, err
+			}
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		for _, name := range e.validatedNames() {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			target = strings.ToLower(target)
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		if strings.HasPrefix(value, ":") == false {
+			return false, spfPermError("invalid mechanism %s", directive)
+		}
+		network := value[1:]
+		bits := 32
+		if strings.ToLower(name) == "ip6" {
+			bits = 128
+		}
+		if strings.Contains(network, "/") == false {
+			network += "/" + strconv.Itoa(bits)
+		}
+		_, ipnet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, spfPermError("invalid network %s", network)
+		}
+		if ones, size := ipnet.Mask.Size(); size != bits || ones > bits {
+			return false, spfPermError("invalid network %s", network)
+		}
+		if (bits == 32) != (e.ip.To4() != nil) {
+			return false, nil
+		}
+		return ipnet.Contains(e.ip), nil
+
+	case "exists":
+		if strings.HasPrefix(value, ":") == false {
+			return false, spfPermError("invalid mechanism %s", directive)
+		}
+		if err := e.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := e.expandDomain(value[1:], domain, false)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := e.resolver.LookupHost(target)
+		if verr := e.countVoid(len(addrs), err); verr != nil {
+			return false, verr
+		}
+		if err != nil && IsNotFound(err) == false {
+			return false, spfTempError("%s", err)
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, spfPermError("unknown mechanism %s", directive)
+}
+
+// parseTarget parses the [":" domain-spec] [dual-cidr-length] part of the
+// a and mx mechanisms.
+func (e *spfEvaluation) parseTarget(domain string, value string) (string, int, int, error) {
+	m := spfCidrRe.FindStringSubmatch(value)
+	target := domain
+	if m[1] != "" {
+		if strings.HasPrefix(m[1], ":") == false {
+			return "", 0, 0, spfPermError("invalid domain-spec %s", value)
+		}
+		var err error
+		if target, err = e.expandDomain(m[1][1:], domain, false); err != nil {
+			return "", 0, 0, err
+		}
+	}
+
+	ip4mask, ip6mask := 32, 128
+	if m[2] != "" {
+		ip4mask, _ = strconv.Atoi(m[2])
+		if ip4mask > 32 || (len(m[2]) > 1 && m[2][0] == '0') {
+			return "", 0, 0, spfPermError("invalid cidr length %s", value)
+		}
+	}
+	if m[3] != "" {
+		ip6mask, _ = strconv.Atoi(m[3])
+		if ip6mask > 128 || (len(m[3]) > 1 && m[3][0] == '0') {
+			return "", 0, 0, spfPermError("invalid cidr length %s", value)
+		}
+	}
+	return target, ip4mask, ip6mask, nil
+}
+
+func (e *spfEvaluation) matchAddr(addr net.IP, ip4mask int, ip6mask int) bool {
+	if addr == nil {
+		return false
+	}
+	if ip4 := e.ip.To4(); ip4 != nil {
+		addr4 := addr.To4()
+		if addr4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(ip4mask, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(ip6mask, 128)
+	return e.ip.To16().Mask(mask).Equal(addr.To16().Mask(mask))
+}
+
+// validatedNames returns the names of the client address which resolve
+// back to it.
+func (e *spfEvaluation) validatedNames() []string {
+	names, err := e.resolver.LookupAddr(e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > spfMaxPtrNames {
+		names = names[:spfMaxPtrNames]
+	}
+
+	var validated []string
+	for _, name := range names {
+		addrs, err := e.resolver.LookupHost(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && ip.Equal(e.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+func (e *spfEvaluation) explanation(domain string, exp string) string {
+	target, err := e.expandDomain(exp, domain, false)
+	if err != nil {
+		return ""
+	}
+	txts, err := e.resolver.LookupTXT(target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	explanation, err := e.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return explanation
+}
+
+func (e *spfEvaluation) expandDomain(spec string, domain string, exp bool) (string, error) {
+	target, err := e.expand(spec, domain, exp)
+	if err != nil {
+		return "", err
+	}
+	target = strings.TrimSuffix(target, ".")
+
+	// truncate to 253 characters by removing labels from the left
+	for len(target) > 253 {
+		i := strings.Index(target, ".")
+		if i < 0 {
+			break
+		}
+		target = target[i+1:]
+	}
+	return target, nil
+}
+
+// expand expands the macros of a macro-string.
+func (e *spfEvaluation) expand(spec string, domain string, exp bool) (string, error) {
+	var out strings.Builder
+
+	for i := 0; i < len(spec); i++ {
+		c := spec[i]
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", spfPermError("invalid macro in %s", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", spfPermError("invalid macro in %s", spec)
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 0 {
+			return "", spfPermError("invalid macro in %s", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		value, err := e.macro(macro, domain, exp)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+	}
+
+	return out.String(), nil
+}
+
+var spfMacroRe = regexp.MustCompile("^([a-zA-Z])([0-9]*)(r?)([.+,/_=-]*)$")
+
+func (e *spfEvaluation) macro(macro string, domain string, exp bool) (string, error) {
+	m := spfMacroRe.FindStringSubmatch(macro)
+	if m == nil {
+		return "", spfPermError("invalid macro %%{%s}", macro)
+	}
+	letter, digits, reverse, delimiters := m[1], m[2], m[3] == "r", m[4]
+
+	at := strings.LastIndex(e.sender, "@")
+	var value string
+	switch strings.ToLower(letter) {
+	case "s":
+		value = e.sender
+	case "l":
+		value = e.sender[:at]
+	case "o":
+		value = e.sender[at+1:]
+	case "d":
+		value = domain
+	case "i":
+		if e.ip.To4() != nil {
+			value = e.ip.To4().String()
+		} else {
+			value = reverseLabels(ReverseIP(e.ip))
+		}
+	case "p":
+		value = "unknown"
+		names := e.validatedNames()
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if strings.EqualFold(name, domain) || strings.HasSuffix(strings.ToLower(name), "."+strings.ToLower(domain)) {
+				value = name
+				break
+			}
+		}
+		if value == "unknown" && len(names) > 0 {
+			value = strings.TrimSuffix(names[0], ".")
+		}
+	case "v":
+		if e.ip.To4() != nil {
+			value = "in-addr"
+		} else {
+			value = "ip6"
+		}
+	case "h":
+		value = e.helo
+	case "c", "r", "t":
+		if exp == false {
+			return "", spfPermError("macro %%{%s} only allowed in explanations", macro)
+		}
+		switch strings.ToLower(letter) {
+		case "c":
+			value = e.ip.String()
+		case "r":
+			value = e.spf.Hostname
+			if value == "" {
+				value = "unknown"
+			}
+		case "t":
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	default:
+		return "", spfPermError("invalid macro %%{%s}", macro)
+	}
+
+	if delimiters == "" {
+		delimiters = "."
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits != "" {
+		n, _ := strconv.Atoi(digits)
+		if n == 0 {
+			return "", spfPermError("invalid macro %%{%s}", macro)
+		}
+		if n < len(parts) {
+			parts = parts[len(parts)-n:]
+		}
+	}
+	value = strings.Join(parts, ".")
+
+	if letter != strings.ToLower(letter) {
+		value = url.QueryEscape(value)
+		value = strings.Replace(value, "+", "%20", -1)
+	}
+	return value, nil
+}
+
+func reverseLabels(name string) string {
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+// IsValidDomain tells whether name is a fully qualified domain name.
+func IsValidDomain(name string) bool {
+	if name == "" || len(name) > 253 || strings.Contains(name, ".") == false {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns a MAIL filter evaluating the identities of the session.
+// The results are kept in SPFHelo and SPFMailFrom for the callbacks.
+func (s *SPF) Filter(smtp *Smtp) func(...string) *Reply {
+	return func(args ...string) *Reply {
+		ip := smtp.GetRemoteIP()
+		if ip == nil {
+			return nil
+		}
+		helo := smtp.HeloName
+
+		smtp.SPFHelo = nil
+		if s.CheckHelo && helo != "" {
+			check := s.CheckHost(ip, helo, "postmaster@"+helo, helo)
+			check.Identity = "helo"
+			smtp.SPFHelo = check
+			if s.RejectFail && check.Result == SPFFail {
+				return s.failReply(check)
+			}
+		}
+
+		sender := args[0]
+		domain := helo
+		if i := strings.LastIndex(sender, "@"); i >= 0 {
+			domain = sender[i+1:]
+		} else {
+			sender = "postmaster@" + helo
+		}
+		check := s.CheckHost(ip, domain, sender, helo)
+		check.Identity = "mailfrom"
+		smtp.SPFMailFrom = check
+		if s.RejectFail && check.Result == SPFFail {
+			return s.failReply(check)
+		}
+		return nil
+	}
+}
+
+func (s *SPF) failReply(check *SPFCheck) *Reply {
+	msg := fmt.Sprintf("5.7.23 SPF validation failed for %s", check.Domain)
+	if check.Explanation != "" {
+		msg += ": " + check.Explanation
+	}
+	return &Reply{0, 550, msg}
+}
@@ -0,0 +1,104 @@
+package smtpserver
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSPFMacro(t *testing.T) {
+	e := &spfEvaluation{spf: &SPF{}, ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", resolver: &FakeResolver{}}
+
+	tests := map[string]string{
+		"%{s}":                     "strong-bad@email.example.com",
+		"%{o}":                     "email.example.com",
+		"%{d}":                     "email.example.com",
+		"%{d4}":                    "email.example.com",
+		"%{d2}":                    "example.com",
+		"%{d1}":                    "com",
+		"%{dr}":                    "com.example.email",
+		"%{d2r}":                   "example.email",
+		"%{l}":                     "strong-bad",
+		"%{l-}":                    "strong.bad",
+		"%{lr-}":                   "bad.strong",
+		"%{l1r-}":                  "strong",
+		"%{ir}.%{v}._spf.%{d2}":    "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":     "bad.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.%%": "example.com.trusted-domains.%",
+	}
+	for spec, expected := range tests {
+		if value, err := e.expand(spec, "email.example.com", false); err != nil || value != expected {
+			t.Errorf("Wrong expansion of %s: %s (%v)", spec, value, err)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	if value, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false); value != "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com" {
+		t.Error("Wrong IPv6 expansion: " + value)
+	}
+
+	if _, err := e.expand("%{c}", "email.example.com", false); err == nil {
+		t.Error("Explanation macro accepted outside explanation")
+	}
+}
+
+func TestSPFCheckHost(t *testing.T) {
+	resolver := &FakeResolver{
+		TXT: map[string][]string{
+			"example.com":          []string{"v=spf1 ip4:192.0.2.0/24 a:mail.example.com/28 mx include:_spf.example.net -all exp=exp.example.com"},
+			"_spf.example.net":     []string{"v=spf1 ip6:2001:db8::/32 ~all"},
+			"exp.example.com":      []string{"%{i} is not allowed to send for %{d}"},
+			"redirect.example.com": []string{"v=spf1 redirect=example.com"},
+			"soft.example.com":     []string{"v=spf1 ?ip4:203.0.113.1 ~all"},
+			"double.example.com":   []string{"v=spf1 -all", "v=spf1 +all"},
+			"loop.example.com":     []string{"v=spf1 include:loop.example.com -all"},
+			"bad.example.com":      []string{"v=spf1 foo:bar -all"},
+			"temp.example.com":     []string{"v=spf1 include:broken.example.com -all"},
+			"void.example.com":     []string{"v=spf1 a:n1.example.com a:n2.example.com a:n3.example.com -all"},
+		},
+		Hosts: map[string][]string{
+			"mail.example.com": []string{"198.51.100.1"},
+			"mx.example.com":   []string{"203.0.113.7"},
+		},
+		MX: map[string][]*net.MX{
+			"example.com": []*net.MX{&net.MX{Host: "mx.example.com.", Pref: 10}},
+		},
+		Errors: map[string]error{
+			"broken.example.com": &net.DNSError{Err: "server misbehaving", Name: "broken.example.com", IsTemporary: true},
+		},
+	}
+	spf := &SPF{Resolver: resolver}
+
+	tests := []struct {
+		ip     string
+		domain string
+		result SPFResult
+	}{
+		{"192.0.2.10", "example.com", SPFPass},
+		{"198.51.100.14", "example.com", SPFPass},
+		{"198.51.100.16", "example.com", SPFFail},
+		{"203.0.113.7", "example.com", SPFPass},
+		{"2001:db8::1", "example.com", SPFPass},
+		{"2001:db9::1", "example.com", SPFFail},
+		{"192.0.2.10", "redirect.example.com", SPFPass},
+		{"203.0.113.1", "soft.example.com", SPFNeutral},
+		{"203.0.113.2", "soft.example.com", SPFSoftFail},
+		{"192.0.2.10", "nospf.example.com", SPFNone},
+		{"192.0.2.10", "localhost", SPFNone},
+		{"192.0.2.10", "double.example.com", SPFPermError},
+		{"192.0.2.10", "loop.example.com", SPFPermError},
+		{"192.0.2.10", "bad.example.com", SPFPermError},
+		{"192.0.2.10", "temp.example.com", SPFTempError},
+		{"192.0.2.10", "void.example.com", SPFPermError},
+	}
+	for _, test := range tests {
+		check := spf.CheckHost(net.ParseIP(test.ip), test.domain, "sender@"+test.domain, "helo.example.org")
+		if check.Result != test.result {
+			t.Errorf("Wrong result for %s from %s: %s (%v)", test.domain, test.ip, check.Result, check.Err)
+		}
+	}
+
+	check := spf.CheckHost(net.ParseIP("198.51.100.16"), "example.com", "sender@example.com", "helo.example.org")
+	if check.Explanation != "198.51.100.16 is not allowed to send for example.com" {
+		t.Error("Wrong explanation: " + check.Explanation)
+	}
+}
@@ -0,0 +1,113 @@
+package smtpserver
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tarpit delays error replies to slow down dictionary attacks. The delay
+// grows with each consecutive error of a session and with the errors
+// recently made by the same client address in other sessions. A single
+// Tarpit is meant to be shared by all the sessions through Option.
+type Tarpit struct {
+	Delay     time.Duration // delay before the first error reply
+	Backoff   float64       // multiplier for each consecutive error (default 2)
+	MaxDelay  time.Duration // upper bound of any delay (default 30s)
+	IPPenalty time.Duration // extra delay per error remembered for the address
+	Window    time.Duration // how long the errors of an address are remembered (default 1h)
+	AllowList []*net.IPNet  // addresses never delayed
+
+	mu      sync.Mutex
+	clients map[string]*tarpitClient
+	swept   time.Time
+}
+
+type tarpitClient struct {
+	Errors int
+	Last   time.Time
+}
+
+func (t *Tarpit) IsExempt(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range t.AllowList {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wait records an error of the client and returns how long to wait before
+// replying. consecutive counts the errors of the session so far, including
+// this one.
+func (t *Tarpit) Wait(ip net.IP, consecutive int, authenticated bool) time.Duration {
+	if authenticated || t.IsExempt(ip) {
+		return 0
+	}
+
+	remembered := 0
+	if ip != nil && t.IPPenalty > 0 {
+		remembered = t.record(ip.String())
+	}
+
+	backoff := t.Backoff
+	if backoff == 0 {
+		backoff = 2
+	}
+	if consecutive < 1 {
+		consecutive = 1
+	}
+
+	delay := float64(t.Delay) * math.Pow(backoff, float64(consecutive-1))
+	delay += float64(t.IPPenalty) * float64(remembered)
+	max := t.MaxDelay
+	if max == 0 {
+		max = 30 * time.Second
+	}
+	if delay > float64(max) {
+		return max
+	}
+	return time.Duration(delay)
+}
+
+// record counts an error of the address and returns how many errors were
+// remembered before it.
+func (t *Tarpit) record(addr string) int {
+	window := t.Window
+	if window == 0 {
+		window = time.Hour
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients == nil {
+		t.clients = make(map[string]*tarpitClient)
+	}
+
+	// the addresses forgotten are swept from time to time rather than at
+	// each error
+	now := time.Now()
+	if now.Sub(t.swept) >= sweepInterval {
+		t.swept = now
+		for k, c := range t.clients {
+			if now.Sub(c.Last) > window {
+				delete(t.clients, k)
+			}
+		}
+	}
+
+	c, ok := t.clients[addr]
+	if ok == false || now.Sub(c.Last) > window {
+		c = &tarpitClient{}
+		t.clients[addr] = c
+	}
+	remembered := c.Errors
+	c.Errors++
+	c.Last = now
+	return remembered
+}
@@ -0,0 +1,73 @@
+package smtpserver
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTarpitBackoff(t *testing.T) {
+	tarpit := &Tarpit{Delay: time.Second, MaxDelay: 5 * time.Second}
+	ip := net.ParseIP("192.0.2.1")
+
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if d := tarpit.Wait(ip, i+1, false); d != e {
+			t.Errorf("Wrong delay for error %d: %s", i+1, d)
+		}
+	}
+
+	if d := tarpit.Wait(ip, 1, true); d != 0 {
+		t.Error("Authenticated client delayed: ", d)
+	}
+
+	// delays are bounded by default
+	if d := (&Tarpit{Delay: time.Second}).Wait(ip, 1000, false); d != 30*time.Second {
+		t.Error("Wrong default bound: ", d)
+	}
+}
+
+func TestTarpitEscalation(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("198.51.100.0/24")
+	tarpit := &Tarpit{Delay: time.Second, IPPenalty: time.Second, AllowList: []*net.IPNet{allowed}}
+	ip := net.ParseIP("192.0.2.1")
+
+	tarpit.Wait(ip, 1, false)
+	tarpit.Wait(ip, 1, false)
+	if d := tarpit.Wait(ip, 1, false); d != 3*time.Second {
+		t.Error("Wrong escalated delay: ", d)
+	}
+
+	if d := tarpit.Wait(net.ParseIP("198.51.100.7"), 3, false); d != 0 {
+		t.Error("Allow-listed client delayed: ", d)
+	}
+}
+
+func TestErrorSleepTime(t *testing.T) {
+	// the legacy setting is in nanoseconds
+	m := &MailServer{Options: &Option{ErrorSleepTime: 500}}
+	if d := m.ErrorDelay(); d != 500*time.Nanosecond {
+		t.Error("Wrong error delay: ", d)
+	}
+}
+
+func TestTarpitWindow(t *testing.T) {
+	tarpit := &Tarpit{IPPenalty: time.Second, Window: 20 * time.Millisecond}
+	for i := 1; i <= 100; i++ {
+		tarpit.Wait(net.IPv4(192, 0, 2, byte(i)), 1, false)
+	}
+	if len(tarpit.clients) != 100 {
+		t.Errorf("Clients swept at each error: %d", len(tarpit.clients))
+	}
+
+	// the errors out of the window are forgotten before the sweep
+	time.Sleep(30 * time.Millisecond)
+	if d := tarpit.Wait(net.ParseIP("192.0.2.1"), 1, false); d != 0 {
+		t.Error("Error out of the window remembered: ", d)
+	}
+	tarpit.swept = time.Now().Add(-sweepInterval)
+	tarpit.Wait(net.ParseIP("192.0.2.1"), 1, false)
+	if len(tarpit.clients) != 1 {
+		t.Errorf("Clients not swept: %d", len(tarpit.clients))
+	}
+}
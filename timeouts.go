@@ -0,0 +1,81 @@
+package smtpserver
+
+import (
+	"time"
+)
+
+// Timeouts holds the per-state timeouts of a session.
+// https://tools.ietf.org/html/rfc5321#section-4.5.3.2
+type Timeouts struct {
+	Greeting        time.Duration // waiting for the first command after the banner
+	Command         time.Duration // waiting for any other command
+	Mail            time.Duration // waiting for RCPT after MAIL was accepted
+	Rcpt            time.Duration // waiting for RCPT or DATA after RCPT was accepted
+	DataInit        time.Duration // waiting for the first data block after 354
+	DataBlock       time.Duration // waiting for each following data block
+	DataTermination time.Duration // sending the reply to the final "."
+	Write           time.Duration // sending any other reply
+}
+
+// RFC 5321 recommends these values as minimums.
+var DefaultTimeouts = Timeouts{
+	Greeting:        5 * time.Minute,
+	Command:         5 * time.Minute,
+	Mail:            5 * time.Minute,
+	Rcpt:            5 * time.Minute,
+	DataInit:        2 * time.Minute,
+	DataBlock:       3 * time.Minute,
+	DataTermination: 10 * time.Minute,
+	Write:           5 * time.Minute,
+}
+
+// GetTimeouts returns the timeouts in effect: the configured Timeouts, with
+// DefaultTimeouts for the ones left zero. The legacy IdleTimeout, in
+// seconds, still applies to every read when no Timeouts are configured.
+func (o *Option) GetTimeouts() *Timeouts {
+	t := DefaultTimeouts
+	if o.Timeouts != nil {
+		set := func(value *time.Duration, configured time.Duration) {
+			if configured != 0 {
+				*value = configured
+			}
+		}
+		set(&t.Greeting, o.Timeouts.Greeting)
+		set(&t.Command, o.Timeouts.Command)
+		set(&t.Mail, o.Timeouts.Mail)
+		set(&t.Rcpt, o.Timeouts.Rcpt)
+		set(&t.DataInit, o.Timeouts.DataInit)
+		set(&t.DataBlock, o.Timeouts.DataBlock)
+		set(&t.DataTermination, o.Timeouts.DataTermination)
+		set(&t.Write, o.Timeouts.Write)
+		return &t
+	}
+
+	if o.IdleTimeout > 0 {
+		idle := time.Second * time.Duration(o.IdleTimeout)
+		t.Greeting = idle
+		t.Command = idle
+		t.Mail = idle
+		t.Rcpt = idle
+		t.DataInit = idle
+		t.DataBlock = idle
+	}
+	return &t
+}
+
+// StageTimeout returns how long to wait for the next input in the current
+// state of the transaction.
+func (s *Smtp) StageTimeout() time.Duration {
+	t := s.Options.GetTimeouts()
+	switch {
+	case s.NextInput != nil && s.DataBuf == "" && s.LastChunk == "":
+		return t.DataInit
+	case s.NextInput != nil:
+		return t.DataBlock
+	case s.MaildataPath:
+		return t.Rcpt
+	case len(s.ForwardPath) > 0:
+		return t.Mail
+	}
+	return t.Command
+}
@@ -0,0 +1,140 @@
+package smtpserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// http://www.postfix.org/transport.5.html
+
+// Kinds of transports, as named in the Postfix master.cf.
+const (
+	TransportSMTP  = "smtp"
+	TransportLMTP  = "lmtp"
+	TransportLocal = "local"
+)
+
+// TLS security levels of a next hop, as Postfix smtp_tls_security_level.
+const (
+	TLSNone    = "none"    // no STARTTLS
+	TLSMay     = "may"     // STARTTLS if offered, certificates not checked
+	TLSEncrypt = "encrypt" // STARTTLS required, certificates not checked
+	TLSVerify  = "verify"  // STARTTLS required with a valid certificate for the host
+)
+
+// Transport is the way to the recipients routed to it.
+type Transport struct {
+	Kind string // TransportSMTP (default), TransportLMTP or TransportLocal
+	// SMTP: a host, looked up as a domain (MX then A/AAAA), or [host] to
+	// skip the MX lookup, with an optional :port; "" for the MX hosts of
+	// the recipient domain. LMTP: unix:/path, inet:host:port or host:port.
+	Nexthop   string
+	Username  string      // AUTH user, if the next hop requires authentication
+	Password  string      // AUTH password
+	TLS       string      // TLS security level (default TLSMay)
+	TLSConfig *tls.Config // overrides the default TLS settings of the deliveries
+}
+
+// ParseTransport parses a transport:nexthop value of a transport map, e.g.
+// "smtp:[relay.example.com]:587" or "lmtp:unix:/run/dovecot/lmtp". An
+// empty transport is smtp.
+func ParseTransport(value string) (*Transport, error) {
+	value = strings.TrimSpace(value)
+	kind, nexthop := value, ""
+	if i := strings.Index(value, ":"); i >= 0 {
+		kind, nexthop = value[:i], value[i+1:]
+	}
+	if kind == "" {
+		kind = TransportSMTP
+	}
+	switch kind {
+	case TransportSMTP, TransportLMTP:
+	case TransportLocal:
+		if nexthop != "" {
+			return nil, fmt.Errorf("local transport with next hop %q", nexthop)
+		}
+	default:
+		return nil, fmt.Errorf("unknown transport %q", kind)
+	}
+	if kind == TransportLMTP && nexthop == "" {
+		return nil, fmt.Errorf("lmtp transport without next hop")
+	}
+	return &Transport{Kind: kind, Nexthop: nexthop}, nil
+}
+
+func (t *Transport) String() string {
+	return t.Kind + ":" + t.Nexthop
+}
+
+// TransportMap routes recipients by address or domain. Keys are full
+// addresses, domains, .domain for the subdomains of a domain, and * for
+// the other recipients:
+//
+//	TransportMap{
+//		"example.com":   &Transport{Kind: TransportLMTP, Nexthop: "unix:/run/dovecot/lmtp"},
+//		".example.com":  &Transport{Nexthop: "[mail.example.com]"},
+//		"*":             &Transport{Nexthop: "[smtp.provider.net]:587", Username: "joe", Password: "secret", TLS: TLSEncrypt},
+//	}
+type TransportMap map[string]*Transport
+
+// Lookup returns the transport of a recipient, or nil if the map has
+// none. Postfix order applies: the address, its domain, then the parent
+// domains as .domain, then *.
+func (m TransportMap) Lookup(address string) *Transport {
+	for _, key := range lookupKeys(address) {
+		if t, ok := m[key]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+// lookupKeys returns the keys of an address in a map, in the order of the
+// Postfix lookup tables.
+func lookupKeys(address string) []string {
+	address = strings.ToLower(address)
+	keys := []string{address}
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return append(keys, "*")
+	}
+	domain := address[i+1:]
+	keys = append(keys, domain)
+	for {
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+		keys = append(keys, "."+domain)
+	}
+	return append(keys, "*")
+}
+
+// ParseTransportMap reads a transport map in the Postfix format: a
+// pattern and a transport:nexthop per line, # starting comments.
+func ParseTransportMap(r io.Reader) (TransportMap, error) {
+	m := TransportMap{}
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a pattern and a transport", n)
+		}
+		t, err := ParseTransport(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		m[strings.ToLower(fields[0])] = t
+	}
+	return m, scanner.Err()
+}
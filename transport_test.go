@@ -0,0 +1,204 @@
+package smtpserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/memememomo/go-smtpserver/queue"
+)
+
+func TestTransportMap(t *testing.T) {
+	m, err := ParseTransportMap(strings.NewReader(`
+# routes
+postmaster@example.com  local
+example.com             lmtp:unix:/run/dovecot/lmtp
+.example.com            :[mail.example.com]
+*                       smtp:[smtp.provider.net]:587
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, expected := range map[string]string{
+		"postmaster@example.com": "local:",
+		"joe@example.com":        "lmtp:unix:/run/dovecot/lmtp",
+		"joe@sub.example.com":    "smtp:[mail.example.com]",
+		"joe@a.b.example.com":    "smtp:[mail.example.com]",
+		"joe@example.org":        "smtp:[smtp.provider.net]:587",
+	} {
+		if transport := m.Lookup(address); transport == nil || transport.String() != expected {
+			t.Errorf("Wrong transport for %s: %v", address, transport)
+		}
+	}
+
+	if (TransportMap{}).Lookup("joe@example.org") != nil {
+		t.Error("Transport found in an empty map")
+	}
+
+	// .domain is for the subdomains only
+	subdomains := TransportMap{".example.com": &Transport{Nexthop: "[mail.example.com]"}}
+	if transport := subdomains.Lookup("joe@example.com"); transport != nil {
+		t.Errorf("Wrong transport for the domain itself: %v", transport)
+	}
+	if transport := subdomains.Lookup("joe@sub.example.com"); transport == nil {
+		t.Error("No transport for a subdomain")
+	}
+	for _, bad := range []string{"uucp:host", "lmtp:", "local:host"} {
+		if _, err := ParseTransport(bad); err == nil {
+			t.Errorf("Transport %q accepted", bad)
+		}
+	}
+}
+
+// StartTestLMTP runs this library's LMTP server on a unix socket. The
+// mailboxes of full@ are full.
+func StartTestLMTP(path string) (net.Listener, *[]string) {
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic(err)
+	}
+	var mu sync.Mutex
+	deliveries := &[]string{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				lmtp := &Lmtp{}
+				lmtp.Init(&Option{Socket: conn})
+				lmtp.SetCallback("LHLO", func(args ...string) *Reply {
+					return &Reply{1, 250, lmtp.GetHostname() + "\nPIPELINING"}
+				})
+				lmtp.SetCallback("DATA", func(args ...string) *Reply {
+					if strings.HasPrefix(args[1], "full@") {
+						return &Reply{0, 452, "4.2.2 Mailbox full"}
+					}
+					mu.Lock()
+					*deliveries = append(*deliveries, args[1])
+					mu.Unlock()
+					return &Reply{1, 250, "2.0.0 Ok"}
+				})
+				lmtp.Process()
+			}(conn)
+		}
+	}()
+	return listener, deliveries
+}
+
+// FakeLocalAgent delivers to the mailboxes it knows.
+type FakeLocalAgent struct {
+	Mailboxes map[string][]string
+}
+
+func (a *FakeLocalAgent) Deliver(from string, recipients []string, message []byte) []error {
+	results := make([]error, len(recipients))
+	for i, rcpt := range recipients {
+		if _, ok := a.Mailboxes[rcpt]; ok == false {
+			results[i] = &ClientReply{550, []string{"5.1.1 No such mailbox"}}
+			continue
+		}
+		if rcpt == "broken@local.example" {
+			results[i] = errors.New("disk full")
+			continue
+		}
+		a.Mailboxes[rcpt] = append(a.Mailboxes[rcpt], string(message))
+	}
+	return results
+}
+
+func TestDeliveryTransports(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := queue.Open(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	smarthost := StartTestMTA("PIPELINING", "AUTH PLAIN LOGIN")
+	defer smarthost.Listener.Close()
+	plain := StartTestMTA()
+	defer plain.Listener.Close()
+	lmtp, deliveries := StartTestLMTP(filepath.Join(dir, "lmtp"))
+	defer lmtp.Close()
+	local := &FakeLocalAgent{Mailboxes: map[string][]string{"joe@local.example": nil, "broken@local.example": nil}}
+
+	port := func(mta *TestMTA) string {
+		return strings.TrimPrefix(mta.Listener.Addr().String(), "127.0.0.1")
+	}
+	d := &Delivery{
+		Queue:    q,
+		Resolver: &FakeResolver{Hosts: map[string][]string{"smtp.provider.net": []string{"127.0.0.1"}}},
+		Hostname: "mx.example.com",
+		Timeout:  time.Second,
+		Transports: TransportMap{
+			"*":                 &Transport{Nexthop: "[smtp.provider.net]" + port(smarthost), Username: "joe", Password: "secret"},
+			"mail.example":      &Transport{Kind: TransportLMTP, Nexthop: "unix:" + filepath.Join(dir, "lmtp")},
+			"local.example":     &Transport{Kind: TransportLocal},
+			"secure.example":    &Transport{Nexthop: "[127.0.0.1]" + port(plain), TLS: TLSEncrypt},
+			"wrongpass.example": &Transport{Nexthop: "[127.0.0.1]" + port(smarthost), Username: "joe", Password: "guess"},
+		},
+		Local: local,
+	}
+
+	id, err := q.Enqueue(&queue.Envelope{
+		From: "from@example.net",
+		Recipients: queue.Recipients([]string{
+			"a@example.org", "b@example.org", "c@mail.example", "full@mail.example",
+			"joe@local.example", "broken@local.example", "nobody@local.example",
+			"d@secure.example", "e@wrongpass.example",
+		}),
+	}, []byte("Subject: Hi\r\n\r\nHello.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Deliver(id); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{
+		"delivered 250 2.0.0 Ok: queued",
+		"delivered 250 2.0.0 Ok: queued",
+		"delivered 250 2.0.0 Ok",
+		" 452 4.2.2 Mailbox full",
+		"delivered 250 2.0.0 Ok: delivered to mailbox",
+		" 451 4.3.0 disk full",
+		"failed 550 5.1.1 No such mailbox",
+		" 451 4.7.4 TLS is required, but was not offered by host [127.0.0.1]",
+		" 451 4.7.0 SASL authentication failed with host [127.0.0.1]: 535 5.7.8 Authentication credentials invalid",
+	} {
+		if rcpt := entry.Recipients[i]; rcpt.Status+" "+rcpt.Diagnostic != expected {
+			t.Errorf("Wrong outcome for %s: %s %s", rcpt.Address, rcpt.Status, rcpt.Diagnostic)
+		}
+	}
+
+	// a single transaction with the smarthost, authenticated
+	if len(smarthost.Messages) != 1 || strings.HasPrefix(smarthost.Messages[0], "from@example.net a@example.org,b@example.org\r\n") == false ||
+		smarthost.Users[0] != "joe" {
+		t.Errorf("Wrong smarthost messages: %q %v", smarthost.Messages, smarthost.Users)
+	}
+	if len(plain.Messages) != 0 {
+		t.Error("Message sent in the clear")
+	}
+	if len(*deliveries) != 1 || (*deliveries)[0] != "c@mail.example" {
+		t.Errorf("Wrong LMTP deliveries: %v", *deliveries)
+	}
+	if len(local.Mailboxes["joe@local.example"]) != 1 {
+		t.Errorf("Wrong local deliveries: %v", local.Mailboxes)
+	}
+}
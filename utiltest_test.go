@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"regexp"
+	"strings"
 )
 
 type MySmtpServer struct {
@@ -154,3 +155,48 @@ func PrepareEsmtpServer() (*MyEsmtpServer, func(port int), chan int) {
 
 	return esmtp, esmtpd, fin
 }
+
+type FakeResolver struct {
+	Hosts   map[string][]string
+	TXT     map[string][]string
+	MX      map[string][]*net.MX
+	Addr    map[string][]string
+	Errors  map[string]error
+	Queries int
+}
+
+func (r *FakeResolver) lookup(records map[string][]string, name string) ([]string, error) {
+	r.Queries++
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if err, ok := r.Errors[name]; ok {
+		return nil, err
+	}
+	if values, ok := records[name]; ok {
+		return values, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *FakeResolver) LookupHost(host string) ([]string, error) {
+	return r.lookup(r.Hosts, host)
+}
+
+func (r *FakeResolver) LookupTXT(name string) ([]string, error) {
+	return r.lookup(r.TXT, name)
+}
+
+func (r *FakeResolver) LookupAddr(addr string) ([]string, error) {
+	return r.lookup(r.Addr, addr)
+}
+
+func (r *FakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	r.Queries++
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if err, ok := r.Errors[name]; ok {
+		return nil, err
+	}
+	if mx, ok := r.MX[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}